@@ -2,16 +2,25 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs"
-	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs/checkpoints"
-	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
 	"github.com/google/uuid"
+	"github.com/gorilla/mux"
 
+	"github.com/microtest/common/auth"
 	"github.com/microtest/common/config"
+	"github.com/microtest/common/health"
+	"github.com/microtest/common/lifecycle"
+	"github.com/microtest/common/messaging"
 	"github.com/microtest/common/shared"
 	"github.com/microtest/common/telemetry"
 )
@@ -20,60 +29,192 @@ const (
 	SERVICE_NAME = "Consumervnext"
 )
 
+// Feature flags of the consumer
+const (
+	// Logs received events without their body, to reduce the telemetry volume
+	CompactEventLogFlag = "CompactEventLog"
+)
+
+// Structured logger for the consumer
+var logger = telemetry.NewLogger(SERVICE_NAME)
+
+// Consumer settings, loaded from the configuration providers
+type Settings struct {
+	AppInsightsInstrumentationKey   string        `config:"APPINSIGHTS_INSTRUMENTATIONKEY" required:"true" secret:"true"`
+	EventHubName                    string        `config:"EVENTHUB_NAME" required:"true"`
+	EventHubConnectionString        string        `config:"EVENTHUB_CONSUMERVNEXT_CONNECTION_STRING" required:"true" secret:"true"`
+	ConsumerGroup                   string        `config:"CONSUMER_GROUP" default:"$Default"`
+	CheckpointStoreType             string        `config:"CHECKPOINTSTORE_TYPE" default:"blob"`
+	CheckpointStoreContainerName    string        `config:"CHECKPOINTSTORE_CONTAINER_NAME"`
+	CheckpointStoreConnectionString string        `config:"CHECKPOINTSTORE_STORAGE_CONNECTION_STRING" secret:"true"`
+	CheckpointStoreDir              string        `config:"CHECKPOINTSTORE_DIR"`
+	RefreshInterval                 time.Duration `config:"CONFIG_REFRESH_INTERVAL" default:"30s"`
+	SentinelKey                     string        `config:"CONFIG_SENTINEL_KEY"`
+	AdminPort                       int           `config:"ADMIN_PORT" default:"8081"`
+	AdminAPIKeys                    string        `config:"ADMIN_API_KEYS" secret:"true"`
+	ShutdownTimeout                 time.Duration `config:"SHUTDOWN_TIMEOUT" default:"20s"`
+	PartitionMetricsInterval        time.Duration `config:"PARTITION_METRICS_INTERVAL" default:"60s"`
+	StartPosition                   string        `config:"START_POSITION" default:"latest"`
+	PartitionStartPositions         string        `config:"START_POSITION_PARTITIONS"`
+	Checkpoint                      CheckpointSettings
+	Workers                         WorkerSettings
+	LoadBalancing                   LoadBalancingSettings
+	Receive                         ReceiveSettings
+	Backpressure                    BackpressureSettings
+}
+
+// How events are received from a partition
+type ReceiveSettings struct {
+	BatchSize int           `config:"RECEIVE_BATCH_SIZE" default:"100"`
+	Wait      time.Duration `config:"RECEIVE_WAIT" default:"1m"`
+	Prefetch  int           `config:"RECEIVE_PREFETCH" default:"300"`
+}
+
+// When receiving slows down, a zero latency is not checked
+type BackpressureSettings struct {
+	MaxInFlight  int           `config:"BACKPRESSURE_MAX_IN_FLIGHT"`
+	MaxLatency   time.Duration `config:"BACKPRESSURE_MAX_LATENCY" default:"2s"`
+	MaxDelay     time.Duration `config:"BACKPRESSURE_MAX_DELAY" default:"5s"`
+	MinBatchSize int           `config:"BACKPRESSURE_MIN_BATCH_SIZE" default:"1"`
+}
+
+// FlowControl returns the flow control options of a partition.
+// The in-flight limit defaults to what the lanes can queue, so receiving waits instead of blocking on a full lane.
+func (s Settings) FlowControl() messaging.FlowControlOptions {
+	maxInFlight := s.Backpressure.MaxInFlight
+	if maxInFlight == 0 {
+		maxInFlight = s.Workers.Lanes * s.Workers.QueueSize
+	}
+	return messaging.FlowControlOptions{
+		MaxBatchSize: s.Receive.BatchSize,
+		MinBatchSize: s.Backpressure.MinBatchSize,
+		MaxInFlight:  maxInFlight,
+		MaxLatency:   s.Backpressure.MaxLatency,
+		MaxDelay:     s.Backpressure.MaxDelay,
+	}
+}
+
+// How the consumers of the consumer group share the partitions
+type LoadBalancingSettings struct {
+	Strategy            string        `config:"LOAD_BALANCING_STRATEGY" default:"balanced"`
+	UpdateInterval      time.Duration `config:"LOAD_BALANCING_UPDATE_INTERVAL" default:"10s"`
+	PartitionExpiration time.Duration `config:"PARTITION_EXPIRATION" default:"60s"`
+}
+
+// How the events of a partition are processed concurrently
+type WorkerSettings struct {
+	Lanes     int `config:"PARTITION_WORKERS" default:"1"`
+	QueueSize int `config:"PARTITION_QUEUE_SIZE" default:"100"`
+}
+
+// When partitions write their checkpoint
+type CheckpointSettings struct {
+	Mode     string        `config:"CHECKPOINT_POLICY" default:"batch"`
+	Count    int           `config:"CHECKPOINT_EVERY" default:"100"`
+	Interval time.Duration `config:"CHECKPOINT_INTERVAL" default:"10s"`
+	Timeout  time.Duration `config:"CHECKPOINT_TIMEOUT" default:"10s"`
+}
+
+// Policy returns the checkpoint policy of the settings
+func (s CheckpointSettings) Policy() messaging.CheckpointPolicy {
+	return messaging.CheckpointPolicy{Mode: s.Mode, Count: s.Count, Interval: s.Interval, Timeout: s.Timeout}
+}
+
+// StartPositions returns where partitions without a checkpoint start
+func (s Settings) StartPositions() (azeventhubs.StartPositions, error) {
+	return messaging.ParseStartPositions(s.StartPosition, s.PartitionStartPositions)
+}
+
+var settings Settings
+
+// Partition client the events are received from, implemented by *azeventhubs.ProcessorPartitionClient
+type partitionReceiver interface {
+	messaging.CheckpointUpdater
+	PartitionID() string
+	ReceiveEvents(ctx context.Context, count int, options *azeventhubs.ReceiveEventsOptions) ([]*azeventhubs.ReceivedEventData, error)
+	Close(ctx context.Context) error
+}
+
+// Counts the events processed in the partitions, implemented by *messaging.Processor
+type processedRecorder interface {
+	PartitionStarted(partitionID string)
+	PartitionStopped(partitionID string)
+	RecordProcessed(partitionID string, event *azeventhubs.ReceivedEventData)
+}
+
+// Processor served by the /partitions endpoint, nil until it is created
+var activeProcessor atomic.Pointer[messaging.Processor]
+
+// Start positions of the checkpoint reset requested on the admin endpoint, applied once the processor stopped
+var (
+	resetMu        sync.Mutex
+	resetPositions *azeventhubs.StartPositions
+)
+
 func main() {
-	// Get the configuration settings from App Configuration
-	err := config.InitializeConfig()
-	if err != nil {
-		log.Println("Consumervnext::Error initializing config", err)
-		panic(err)
+	// "consumervnext config dump" prints the effective configuration and exits
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(runConfigCommand(os.Args[2:]))
 	}
-	appinsights_instrumentationkey, _ := config.GetVar("APPINSIGHTS_INSTRUMENTATIONKEY")
-	eventHubName, _ := config.GetVar("EVENTHUB_NAME")
-	eventHubConnectionString, _ := config.GetVar("EVENTHUB_CONSUMERVNEXT_CONNECTION_STRING")
-	containerName, _ := config.GetVar("CHECKPOINTSTORE_CONTAINER_NAME")
-	checkpointStoreConnectionString, _ := config.GetVar("CHECKPOINTSTORE_STORAGE_CONNECTION_STRING")
-	log.Println("Consumervnext::AppInsightsInstrumentationKey::", appinsights_instrumentationkey)
-	log.Println("Consumervnext::EventHubName::", eventHubName)
-	log.Println("Consumervnext::EventHubConnectionString::", eventHubConnectionString)
-	log.Println("Consumervnext::ContainerName::", containerName)
-	log.Println("Consumervnext::CheckpointStoreConnectionString::", checkpointStoreConnectionString)
 
-	// Initialize telemetry
-	err = telemetry.InitTelemetryKey(SERVICE_NAME, appinsights_instrumentationkey)
-	if err != nil {
-		log.Println("Consumervnext::Error initializing telemetry", err)
-		panic(err)
+	// "consumervnext checkpoints reset" moves the checkpoints to the start positions and exits
+	if len(os.Args) > 1 && os.Args[1] == "checkpoints" {
+		os.Exit(runCheckpointsCommand(os.Args[2:]))
 	}
 
-	// create a container client using a connection string and container name
-	checkClient, err := container.NewClientFromConnectionString(checkpointStoreConnectionString, containerName, nil)
+	// Track any panic and flush telemetry before the process exits
+	defer telemetry.RecoverPanic()
+
+	// Cancelled on SIGTERM, when Kubernetes stops the pod
+	stopCtx := lifecycle.Start()
+
+	// Get the configuration settings from the configuration providers
+	ctx := context.Background()
+	if err := loadConfig(ctx); err != nil {
+		panic(err)
+	}
+	logger.Info(ctx, "Configuration loaded", config.LogFields(&settings)...)
+	if err := settings.Checkpoint.Policy().Validate(); err != nil {
+		logger.Critical(ctx, "Invalid checkpoint policy", "Error", err)
+		panic(err)
+	}
+	startPositions, err := settings.StartPositions()
 	if err != nil {
-		handleError("Consumervnext::Error creating container client", err)
+		logger.Critical(ctx, "Invalid start position", "Error", err)
 		panic(err)
 	}
 
-	// create a checkpoint store that will be used by the event hub
-	checkpointStore, err := checkpoints.NewBlobStore(checkClient, nil)
+	// Serve the admin endpoints in the background, readiness fails until the processor runs
+	adminServer, err := startAdminServer()
 	if err != nil {
-		handleError("Consumervnext::Error creating checkpoint store", err)
+		logger.Critical(ctx, "Invalid admin API keys", "Error", err)
 		panic(err)
 	}
 
-	// create a consumer client using a connection string to the namespace and the event hub
-	consumerClient, err := azeventhubs.NewConsumerClientFromConnectionString(eventHubConnectionString, eventHubName, azeventhubs.DefaultConsumerGroup, nil)
+	// Initialize telemetry
+	err = telemetry.InitTelemetryKey(SERVICE_NAME, settings.AppInsightsInstrumentationKey)
 	if err != nil {
-		handleError("Consumervnext::Error creating consumer client", err)
+		logger.Critical(ctx, "Error initializing telemetry", "Error", err)
 		panic(err)
 	}
 
-	defer consumerClient.Close(context.TODO())
+	// Apply configuration changes without a restart
+	config.SubscribeTelemetry()
+	config.StartRefresh(ctx, config.RefreshOptions{Interval: settings.RefreshInterval, SentinelKey: settings.SentinelKey})
 
-	// Create a processor to receive and process events
-	processor, err := azeventhubs.NewProcessor(consumerClient, checkpointStore, nil)
+	// Create a processor to receive and process events, partitions without a checkpoint start at START_POSITION
+	processor, err := newProcessor(startPositions)
 	if err != nil {
-		handleError("Consumervnext::Error creating processor", err)
 		panic(err)
 	}
+	checkpointStore := processor.CheckpointStore()
+	activeProcessor.Store(processor)
+
+	// Readiness depends on the broker and the checkpoint store, the config store and telemetry are reported only
+	health.Register("eventhub", processor.Check)
+	health.Register("checkpointstore", checkpointStore.Check)
+	health.RegisterOptional("config", config.Check)
+	health.RegisterOptional("telemetry", telemetry.Check)
 
 	// For each partition in the event hub, create a partition client with processEvents as the function to process events
 	dispatchPartitionClients := func() {
@@ -89,20 +230,28 @@ func main() {
 				break
 			}
 
+			// Partitions are drained on shutdown
+			done := lifecycle.Track()
+
 			go func() {
+				defer done()
+				defer telemetry.RecoverPanic()
+
 				// Define the operation ID using the defined OperationID type
 				operationID := uuid.New().String()
-				log.Printf("Consumervnext::OperationID::%s::Creating new partition client\n", operationID)
 
-				// Create a new context with the operation ID
-				ctx := context.WithValue(context.Background(), shared.OperationIDKeyContextKey, operationID)
+				// Create a new context with the operation and partition IDs, cancelled when the service stops
+				ctx := context.WithValue(stopCtx, shared.OperationIDKeyContextKey, operationID)
+				ctx = context.WithValue(ctx, shared.PartitionIDKeyContextKey, partitionClient.PartitionID())
 
-				log.Printf("Consumervnext::PartitionID::%s::Partition client initialized\n", partitionClient.PartitionID())
-				telemetry.TrackDependencyCtx(ctx, "New partition client initialized for partition "+partitionClient.PartitionID(), SERVICE_NAME, "EventHub", eventHubName, true, startTime, time.Now(), map[string]string{"PartitionID": partitionClient.PartitionID()})
+				logger.Verbose(ctx, "Partition client initialized")
+				telemetry.TrackDependencyCtx(ctx, "New partition client initialized for partition "+partitionClient.PartitionID(), SERVICE_NAME, "EventHub", settings.EventHubName, true, startTime, time.Now(), map[string]string{"PartitionID": partitionClient.PartitionID()})
 
-				if err := processEvents(ctx, partitionClient); err != nil {
-					handleError("Consumervnext::Error processing events for partition "+partitionClient.PartitionID(), err)
-					panic(err)
+				// Only the errors the partition cannot recover from stop the service, a partition taken over
+				// by another consumer is closed by processEvents and balanced again by the processor
+				if err := processEvents(ctx, processor, partitionClient); err != nil {
+					handleError("Error processing events for partition "+partitionClient.PartitionID(), err)
+					lifecycle.Fail(err)
 				}
 			}()
 		}
@@ -111,60 +260,418 @@ func main() {
 	// Run all partition clients
 	go dispatchPartitionClients()
 
-	processorCtx, processorCancel := context.WithCancel(context.TODO())
-	defer processorCancel()
+	// Export the partition lag and throughput until the service stops
+	go trackPartitionMetrics(stopCtx, processor)
 
-	if err := processor.Run(processorCtx); err != nil {
-		handleError("Consumervnext::Error processor run", err)
-		panic(err)
+	// The processor keeps running until the partitions are drained, it releases their ownership when it stops
+	processorCtx, processorCancel := context.WithCancel(context.Background())
+	processorDone := make(chan struct{})
+	go func() {
+		defer telemetry.RecoverPanic()
+		defer close(processorDone)
+
+		if err := processor.Run(processorCtx); err != nil {
+			handleError("Error processor run", err)
+			lifecycle.Fail(err)
+		}
+	}()
+	health.SetReady()
+
+	// Shutdown order: partitions stop receiving when SIGTERM cancels their context and checkpoint the last
+	// processed event, then the processor stops and the consumer client is closed. Telemetry is flushed last.
+	lifecycle.OnShutdown("partitions", lifecycle.Drain)
+	lifecycle.OnShutdown("processor", func(ctx context.Context) error {
+		processorCancel()
+		select {
+		case <-processorDone:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	lifecycle.OnShutdown("checkpoint reset", func(ctx context.Context) error {
+		resetMu.Lock()
+		positions := resetPositions
+		resetMu.Unlock()
+		if positions == nil {
+			return nil
+		}
+		_, err := processor.ResetCheckpoints(ctx, *positions)
+		return err
+	})
+	lifecycle.OnShutdown("consumer client", processor.Close)
+	lifecycle.OnShutdown("admin server", adminServer.Shutdown)
+
+	// Graceful shutdown
+	<-stopCtx.Done()
+	if err := lifecycle.Shutdown(settings.ShutdownTimeout); err != nil {
+		os.Exit(1)
 	}
 }
 
-// ProcessEvents implements the logic that is executed when events are received from the event hub
-func processEvents(ctx context.Context, partitionClient *azeventhubs.ProcessorPartitionClient) error {
-	defer closePartitionResources(partitionClient)
+// Initializes the configuration providers and loads the settings
+func loadConfig(ctx context.Context) error {
+	err := config.InitializeConfig()
+	if err != nil {
+		logger.Critical(ctx, "Error initializing config", "Error", err)
+		return err
+	}
+
+	// Keys namespaced for this service win over the shared ones
+	config.SetKeyPrefix("consumervnext:")
+	err = config.Bind(ctx, &settings)
+	if err != nil {
+		logger.Critical(ctx, "Error loading configuration", "Error", err)
+		return err
+	}
+	return nil
+}
+
+// Creates the checkpoint store selected by CHECKPOINTSTORE_TYPE (blob, file or memory) and the processor
+func newProcessor(startPositions azeventhubs.StartPositions) (*messaging.Processor, error) {
+	checkpointStore, err := messaging.NewCheckpointStore(messaging.CheckpointStoreOptions{
+		Type:             settings.CheckpointStoreType,
+		ConnectionString: settings.CheckpointStoreConnectionString,
+		ContainerName:    settings.CheckpointStoreContainerName,
+		Dir:              settings.CheckpointStoreDir,
+	})
+	if err != nil {
+		handleError("Error creating checkpoint store", err)
+		return nil, err
+	}
+
+	processor, err := messaging.ProcessorInit(SERVICE_NAME, settings.EventHubConnectionString, settings.EventHubName, checkpointStore, messaging.ProcessorOptions{
+		ConsumerGroup:               settings.ConsumerGroup,
+		StartPositions:              startPositions,
+		LoadBalancingStrategy:       settings.LoadBalancing.Strategy,
+		UpdateInterval:              settings.LoadBalancing.UpdateInterval,
+		PartitionExpirationDuration: settings.LoadBalancing.PartitionExpiration,
+		Prefetch:                    settings.Receive.Prefetch,
+	})
+	if err != nil {
+		handleError("Error creating processor", err)
+		return nil, err
+	}
+	return processor, nil
+}
+
+// Runs the checkpoints subcommand, returns the exit code.
+// The consumers must be stopped, e.g. scaled to zero, otherwise they overwrite the checkpoints.
+func runCheckpointsCommand(args []string) int {
+	if len(args) != 1 || args[0] != "reset" {
+		fmt.Fprintln(os.Stderr, "usage: consumervnext checkpoints reset")
+		return 2
+	}
+
+	ctx := context.Background()
+	telemetry.SetLogOutput(os.Stderr)
+	if err := loadConfig(ctx); err != nil {
+		return 1
+	}
+	startPositions, err := settings.StartPositions()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	processor, err := newProcessor(startPositions)
+	if err != nil {
+		return 1
+	}
+	defer processor.Close(ctx)
 
-	// Get the operation ID from the context
-	operationID := ctx.Value(shared.OperationIDKeyContextKey).(string)
-	log.Printf("Consumervnext::PartitionID=%s::OperationID=%s::Start\n", partitionClient.PartitionID(), operationID)
+	checkpoints, err := processor.ResetCheckpoints(ctx, startPositions)
+	for _, checkpoint := range checkpoints {
+		fmt.Printf("partition %s: offset %d, sequence number %d\n", checkpoint.PartitionID, *checkpoint.Offset, *checkpoint.SequenceNumber)
+	}
+	if err != nil {
+		handleError("Error resetting checkpoints", err)
+		return 1
+	}
+	return 0
+}
+
+// Runs the config subcommand, returns the exit code
+func runConfigCommand(args []string) int {
+	if len(args) != 1 || args[0] != "dump" {
+		fmt.Fprintln(os.Stderr, "usage: consumervnext config dump")
+		return 2
+	}
+
+	// Logs go to stderr so the dump can be redirected
+	telemetry.SetLogOutput(os.Stderr)
+	err := loadConfig(context.Background())
+	if dumpErr := config.Dump(os.Stdout); dumpErr != nil {
+		fmt.Fprintln(os.Stderr, dumpErr)
+		return 1
+	}
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// Serves the admin endpoints on ADMIN_PORT in the background, the consumer keeps running if the server fails.
+// The checkpoint reset is only served when ADMIN_API_KEYS is set, and requires one of its keys.
+func startAdminServer() (*http.Server, error) {
+	router := mux.NewRouter()
+
+	// Effective configuration, secrets are masked
+	router.Handle("/admin/config", config.Handler()).Methods("GET")
+
+	// Liveness and readiness probes
+	router.Handle("/healthz", health.LivenessHandler()).Methods("GET")
+	router.Handle("/readyz", health.ReadinessHandler()).Methods("GET")
+
+	// Ownership, checkpoint and lag of the partitions
+	router.HandleFunc("/partitions", partitionsHandler).Methods("GET")
+
+	// Replay from a start position, it rewinds or skips events so it requires an admin key
+	adminKeys, err := auth.ParseCredentials(settings.AdminAPIKeys)
+	if err != nil {
+		return nil, fmt.Errorf("ADMIN_API_KEYS: %w", err)
+	}
+	if len(adminKeys) > 0 {
+		for _, keys := range adminKeys {
+			telemetry.RegisterSecret(keys...)
+		}
+		requireAdminKey := auth.Middleware(auth.NewAPIKeyAuthenticator(adminKeys))
+		router.Handle("/admin/checkpoints/reset", requireAdminKey(http.HandlerFunc(resetCheckpointsHandler))).Methods("POST")
+	} else {
+		logger.Info(context.Background(), "Checkpoint reset endpoint disabled, ADMIN_API_KEYS is not set")
+	}
 
+	port := strconv.Itoa(settings.AdminPort)
+	server := &http.Server{
+		Addr:              ":" + port,
+		Handler:           router,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	logger.Info(context.Background(), "Admin server started on port "+port, "port", port)
+	go func() {
+		defer telemetry.RecoverPanic()
+
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			handleError("Admin server stopped", err)
+		}
+	}()
+	return server, nil
+}
+
+// Serves the status of the partitions as JSON
+func partitionsHandler(w http.ResponseWriter, r *http.Request) {
+	processor := activeProcessor.Load()
+	if processor == nil {
+		http.Error(w, "consumer is starting", http.StatusServiceUnavailable)
+		return
+	}
+
+	statuses, err := processor.Partitions(r.Context())
+	if err != nil {
+		handleError("Error reading partitions", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// Sends the partition metrics every PARTITION_METRICS_INTERVAL until the context is cancelled
+func trackPartitionMetrics(ctx context.Context, processor *messaging.Processor) {
+	defer telemetry.RecoverPanic()
+	if settings.PartitionMetricsInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(settings.PartitionMetricsInterval)
+	defer ticker.Stop()
 	for {
-		receiveCtx, receiveCtxCancel := context.WithTimeout(ctx, time.Minute)
-		events, err := partitionClient.ReceiveEvents(receiveCtx, 100, nil)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := processor.TrackPartitionMetrics(ctx); err != nil && ctx.Err() == nil {
+				handleError("Error tracking partition metrics", err)
+			}
+		}
+	}
+}
+
+// Resets the checkpoints of the consumer group to the start positions of the query, position and partitions,
+// or to START_POSITION and START_POSITION_PARTITIONS. The consumer stops, resets the checkpoints once the processor
+// released its partitions, and exits so it is restarted from the new checkpoints.
+// Other replicas must be stopped first, otherwise they overwrite the checkpoints.
+func resetCheckpointsHandler(w http.ResponseWriter, r *http.Request) {
+	if health.GetState() != health.Ready {
+		http.Error(w, "consumer is not running", http.StatusServiceUnavailable)
+		return
+	}
+
+	position, partitions := settings.StartPosition, settings.PartitionStartPositions
+	if query := r.URL.Query(); query.Has("position") || query.Has("partitions") {
+		position, partitions = query.Get("position"), query.Get("partitions")
+	}
+	positions, err := messaging.ParseStartPositions(position, partitions)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resetMu.Lock()
+	resetPositions = &positions
+	resetMu.Unlock()
+
+	identity, _ := auth.IdentityFrom(r.Context())
+	logger.Warning(r.Context(), "Checkpoint reset requested, stopping", "Position", position, "Partitions", partitions, "RequestedBy", identity.ClientID)
+	lifecycle.Stop()
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, "checkpoints are reset once the consumer stopped")
+}
+
+// ProcessEvents implements the logic that is executed when events are received from the event hub.
+// Events are handled by a pool of lanes, events of the same order are handled in order in the same lane.
+// Events are acknowledged once handled and checkpointed following the checkpoint policy.
+// The flow controller slows receiving down while the handlers cannot keep up.
+// It returns nil once the context is cancelled, after checkpointing the acknowledged events, and when another
+// consumer took the partition over, without checkpointing so the checkpoint of the new owner is not moved back.
+func processEvents(ctx context.Context, processor processedRecorder, partitionClient partitionReceiver) error {
+	defer closePartitionResources(partitionClient)
+
+	// The partition stats only cover this claim of the partition, they are dropped once every event is handled
+	processor.PartitionStarted(partitionClient.PartitionID())
+	defer processor.PartitionStopped(partitionClient.PartitionID())
+
+	// Checkpoints are not bound to ctx, so they are also written while the service stops
+	checkpointer := messaging.NewCheckpointer(partitionClient, settings.Checkpoint.Policy())
+	ownershipLost := false
+	defer func() {
+		if ownershipLost {
+			return
+		}
+		if err := checkpointer.Flush(context.Background()); err != nil {
+			handleError("Error updating checkpoint", err)
+		}
+	}()
+
+	// A checkpoint that cannot be written stops the partition
+	partitionCtx, cancelPartition := context.WithCancel(ctx)
+	defer cancelPartition()
+	var checkpointErr error
+	var checkpointErrOnce sync.Once
+
+	flow := messaging.NewFlowController(settings.FlowControl())
+	pool := messaging.NewWorkerPool(settings.Workers.Lanes, settings.Workers.QueueSize, func(ctx context.Context, event *azeventhubs.ReceivedEventData) {
+		// An event that fails is logged with its position, so it can be replayed, and acknowledged anyway:
+		// otherwise it would hold the checkpoint of the partition back forever
+		startTime := time.Now()
+		err := handleEvent(ctx, event)
+		flow.Finished(time.Since(startTime))
+		if err != nil {
+			logger.Error(ctx, "Error handling event, skipping it", "SequenceNumber", event.SequenceNumber, "Offset", event.Offset, "EnqueuedTime", event.EnqueuedTime, "Error", err)
+			telemetry.TrackMetric("EventsFailed", 1, map[string]string{"PartitionID": partitionClient.PartitionID()})
+		} else {
+			processor.RecordProcessed(partitionClient.PartitionID(), event)
+		}
+		if err := checkpointer.Ack(context.Background(), event); err != nil {
+			checkpointErrOnce.Do(func() {
+				checkpointErr = err
+				cancelPartition()
+			})
+		}
+	})
+	defer pool.Close()
+
+	logger.Verbose(ctx, "Start processing events", "Lanes", settings.Workers.Lanes)
+
+	for partitionCtx.Err() == nil {
+		batchSize, err := flow.Next(partitionCtx)
+		if err != nil {
+			break
+		}
+
+		receiveCtx, receiveCtxCancel := context.WithTimeout(partitionCtx, settings.Receive.Wait)
+		events, err := partitionClient.ReceiveEvents(receiveCtx, batchSize, nil)
 		receiveCtxCancel()
 
-		if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) && partitionCtx.Err() == nil {
+			if messaging.IsOwnershipLost(err) {
+				logger.Warning(ctx, "Partition taken over by another consumer, closing it", "Error", err)
+				ownershipLost = true
+				break
+			}
 			return err
 		}
 
-		// Uncomment the following line to verify that the consumer is trying to receive events
-		log.Printf("Consumervnext::PartitionID=%s::OperationID=%s::Processing %d event(s)\n", partitionClient.PartitionID(), operationID, len(events))
+		logger.Verbose(ctx, "Processing events", "Count", len(events), "BatchSize", batchSize, "InFlight", flow.InFlight())
 
+		checkpointer.Track(events)
 		for _, event := range events {
-			// Events received!! Process the message
-			log.Printf("Consumervnext::PartitionID::%s::Events received %v\n", partitionClient.PartitionID(), string(event.Body))
-			log.Printf("Offset: %d Sequence number: %d MessageID: %s\n", event.Offset, event.SequenceNumber, *event.MessageID)
-			telemetry.TrackTraceCtx(ctx, "Consumervnext::PartitionID::"+partitionClient.PartitionID()+"::Event received", telemetry.Information, map[string]string{"Client": SERVICE_NAME, "PartitionID": partitionClient.PartitionID(), "Event": string(event.Body)})
+			// Fails when the service is stopping, the events left are received again after a restart
+			flow.Started()
+			if err := pool.Submit(partitionCtx, eventKey(event), event); err != nil {
+				flow.Finished(0)
+				break
+			}
 		}
 
-		if len(events) != 0 {
-			if err := partitionClient.UpdateCheckpoint(context.TODO(), events[len(events)-1], nil); err != nil {
-				handleError("Consumervnext::Error updating checkpoint", err)
-				return err
-			}
+		if err := checkpointer.BatchDone(context.Background()); err != nil {
+			handleError("Error updating checkpoint", err)
+			return err
 		}
 	}
+
+	// Wait for the lanes before reading the checkpoint error
+	pool.Close()
+	if checkpointErr != nil {
+		handleError("Error updating checkpoint", checkpointErr)
+		return checkpointErr
+	}
+	logger.Info(ctx, "Stopped processing events")
+	return nil
+}
+
+// Returns the key that orders the event: the order ID, else the partition key.
+// Events without a key can be handled in any order.
+func eventKey(event *azeventhubs.ReceivedEventData) string {
+	var payload messaging.Event
+	if err := json.Unmarshal(event.Body, &payload); err == nil && payload.OrderPayload.Id != "" {
+		return payload.OrderPayload.Id
+	}
+	if event.PartitionKey != nil {
+		return *event.PartitionKey
+	}
+	return strconv.FormatInt(event.SequenceNumber, 10)
+}
+
+// Handles a single event, the event is acknowledged when it returns nil
+func handleEvent(ctx context.Context, event *azeventhubs.ReceivedEventData) error {
+	// Each event gets its own operation ID, so telemetry sampling keeps or drops the whole event
+	eventCtx := context.WithValue(ctx, shared.OperationIDKeyContextKey, uuid.New().String())
+
+	// Feature flags are evaluated for the customer and product category of the order
+	var payload messaging.Event
+	if err := json.Unmarshal(event.Body, &payload); err == nil {
+		eventCtx = config.WithTargeting(eventCtx, payload.OrderPayload.CustomerID, payload.OrderPayload.ProductCategory)
+	}
+
+	// Events received!! Process the message
+	fields := []interface{}{"Client", SERVICE_NAME, "Offset", event.Offset, "SequenceNumber", event.SequenceNumber, "PublishedBy", event.Properties["ClientID"]}
+	if config.IsEnabled(eventCtx, CompactEventLogFlag) {
+		fields = append(fields, "EventID", payload.EventID, "OrderID", payload.OrderPayload.Id, "Size", len(event.Body))
+	} else {
+		fields = append(fields, "Event", string(event.Body))
+	}
+	logger.Info(eventCtx, "Event received", fields...)
+	return nil
 }
 
 // Closes the partition client
-func closePartitionResources(partitionClient *azeventhubs.ProcessorPartitionClient) {
+func closePartitionResources(partitionClient partitionReceiver) {
 	defer partitionClient.Close(context.TODO())
 }
 
 // Logs the error message and sends an exception to App Insights
 func handleError(message string, err error) {
-	// Log the error using telemetry
-	log.Println("Consumervnext::handleError::Message: ", message)
-	log.Println("Consumervnext::handleError::Error: ", err)
-	telemetry.TrackException(err, telemetry.Error, map[string]string{"Client": SERVICE_NAME, "Error": err.Error(), "Message": message})
+	logger.Error(context.Background(), message, "Client", SERVICE_NAME, "Error", err)
 }
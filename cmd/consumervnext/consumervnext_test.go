@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs"
+
+	"github.com/microtest/common/telemetry"
+)
+
+// Partition client that returns the batches in order, then fails with err, or waits until the context is done
+type fakePartitionClient struct {
+	mu          sync.Mutex
+	batches     [][]*azeventhubs.ReceivedEventData
+	err         error
+	exhausted   func()
+	checkpoints []int64
+	closed      bool
+}
+
+func (f *fakePartitionClient) PartitionID() string { return "0" }
+
+func (f *fakePartitionClient) ReceiveEvents(ctx context.Context, count int, options *azeventhubs.ReceiveEventsOptions) ([]*azeventhubs.ReceivedEventData, error) {
+	f.mu.Lock()
+	if len(f.batches) > 0 {
+		batch := f.batches[0]
+		f.batches = f.batches[1:]
+		f.mu.Unlock()
+		return batch, nil
+	}
+	err, exhausted := f.err, f.exhausted
+	f.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+	if exhausted != nil {
+		exhausted()
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (f *fakePartitionClient) UpdateCheckpoint(ctx context.Context, latestEvent *azeventhubs.ReceivedEventData, options *azeventhubs.UpdateCheckpointOptions) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.checkpoints = append(f.checkpoints, latestEvent.SequenceNumber)
+	return nil
+}
+
+func (f *fakePartitionClient) Close(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+// Records the processed events, and those processed outside of PartitionStarted and PartitionStopped
+type fakeProcessedRecorder struct {
+	mu        sync.Mutex
+	started   bool
+	stopped   bool
+	processed []int64
+	outside   []int64
+}
+
+func (f *fakeProcessedRecorder) PartitionStarted(partitionID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.started = true
+}
+
+func (f *fakeProcessedRecorder) PartitionStopped(partitionID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stopped = true
+}
+
+func (f *fakeProcessedRecorder) RecordProcessed(partitionID string, event *azeventhubs.ReceivedEventData) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.processed = append(f.processed, event.SequenceNumber)
+	if !f.started || f.stopped {
+		f.outside = append(f.outside, event.SequenceNumber)
+	}
+}
+
+// Uses small lanes and batches for the duration of the test, checkpoints are only written when the partition stops
+func useTestSettings(t *testing.T) {
+	t.Helper()
+	telemetry.SetLogOutput(io.Discard)
+	previous := settings
+	settings = Settings{
+		Checkpoint:   CheckpointSettings{Mode: "count", Count: 100, Timeout: time.Second},
+		Workers:      WorkerSettings{Lanes: 2, QueueSize: 10},
+		Receive:      ReceiveSettings{BatchSize: 10, Wait: time.Second},
+		Backpressure: BackpressureSettings{MinBatchSize: 1, MaxDelay: 10 * time.Millisecond},
+	}
+	t.Cleanup(func() {
+		settings = previous
+		telemetry.SetLogOutput(os.Stdout)
+	})
+}
+
+func testBatch(sequenceNumbers ...int64) []*azeventhubs.ReceivedEventData {
+	batch := make([]*azeventhubs.ReceivedEventData, len(sequenceNumbers))
+	for i, sequenceNumber := range sequenceNumbers {
+		batch[i] = &azeventhubs.ReceivedEventData{EventData: azeventhubs.EventData{Body: []byte("{}")}, SequenceNumber: sequenceNumber}
+	}
+	return batch
+}
+
+func TestProcessEvents(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		wantErr        bool
+		wantCheckpoint bool
+	}{
+		{"ownership lost to another consumer", &azeventhubs.Error{Code: azeventhubs.ErrorCodeOwnershipLost}, false, false},
+		{"connection lost", &azeventhubs.Error{Code: azeventhubs.ErrorCodeConnectionLost}, true, true},
+		{"unexpected error", errors.New("link detached"), true, true},
+		{"service stopping", nil, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestSettings(t)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			client := &fakePartitionClient{batches: [][]*azeventhubs.ReceivedEventData{testBatch(1, 2), testBatch(3)}, err: tt.err, exhausted: cancel}
+			recorder := &fakeProcessedRecorder{}
+			err := processEvents(ctx, recorder, client)
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("processEvents error = %v, want error %t", err, tt.wantErr)
+			}
+			if !client.closed {
+				t.Error("partition client not closed")
+			}
+			if !recorder.started || !recorder.stopped || len(recorder.outside) != 0 {
+				t.Errorf("partition stats started %t, stopped %t, events counted outside %v, want every event counted between the start and the stop",
+					recorder.started, recorder.stopped, recorder.outside)
+			}
+
+			// Events received before the partition stopped are handled before it is closed
+			sort.Slice(recorder.processed, func(i, j int) bool { return recorder.processed[i] < recorder.processed[j] })
+			if len(recorder.processed) != 3 || recorder.processed[2] != 3 {
+				t.Errorf("processed %v, want events 1 to 3", recorder.processed)
+			}
+
+			// A partition that stopped on its own checkpoints its last event, a partition taken over leaves it to the new owner
+			if tt.wantCheckpoint && (len(client.checkpoints) != 1 || client.checkpoints[0] != 3) {
+				t.Errorf("checkpoints %v, want a single checkpoint at 3", client.checkpoints)
+			}
+			if !tt.wantCheckpoint && len(client.checkpoints) != 0 {
+				t.Errorf("checkpoints %v written after the ownership was lost", client.checkpoints)
+			}
+		})
+	}
+}
@@ -3,17 +3,26 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 
+	"github.com/microtest/common/auth"
+	"github.com/microtest/common/breaker"
 	"github.com/microtest/common/config"
+	"github.com/microtest/common/health"
+	"github.com/microtest/common/lifecycle"
 	"github.com/microtest/common/messaging"
+	"github.com/microtest/common/ratelimit"
 	"github.com/microtest/common/shared"
 	"github.com/microtest/common/telemetry"
 )
@@ -25,88 +34,434 @@ const (
 // Messaging client to publish messages to the event hub
 var producer *messaging.ProducerClient
 
+// Structured logger for the publisher
+var logger = telemetry.NewLogger(SERVICE_NAME)
+
+// Publisher settings, loaded from the configuration providers
+type Settings struct {
+	AppInsightsInstrumentationKey string        `config:"APPINSIGHTS_INSTRUMENTATIONKEY" required:"true" secret:"true"`
+	EventHubName                  string        `config:"EVENTHUB_NAME" required:"true"`
+	EventHubConnectionString      string        `config:"EVENTHUB_PUBLISHER_CONNECTION_STRING" required:"true" secret:"true"`
+	Port                          int           `config:"PORT" default:"8080"`
+	AdminPort                     int           `config:"ADMIN_PORT" default:"8081"`
+	ReadTimeout                   time.Duration `config:"HTTP_READ_TIMEOUT" default:"10s"`
+	WriteTimeout                  time.Duration `config:"HTTP_WRITE_TIMEOUT" default:"10s"`
+	RefreshInterval               time.Duration `config:"CONFIG_REFRESH_INTERVAL" default:"30s"`
+	SentinelKey                   string        `config:"CONFIG_SENTINEL_KEY"`
+	ShutdownTimeout               time.Duration `config:"SHUTDOWN_TIMEOUT" default:"20s"`
+	ShutdownDelay                 time.Duration `config:"SHUTDOWN_DELAY" default:"0s"`
+	Retry                         RetrySettings
+	RateLimit                     RateLimitSettings
+	Breaker                       BreakerSettings
+	Auth                          AuthSettings
+}
+
+// Authentication of /publish, keys and secrets can be rotated without a restart
+type AuthSettings struct {
+	Methods      []string      `config:"AUTH_METHODS" default:"apikey,hmac"`
+	APIKeys      string        `config:"API_KEYS" secret:"true"`
+	HMACSecrets  string        `config:"HMAC_SECRETS" secret:"true"`
+	ReplayWindow time.Duration `config:"HMAC_REPLAY_WINDOW" default:"5m"`
+}
+
+// Authenticators of /publish
+var (
+	apiKeyAuthenticator = auth.NewAPIKeyAuthenticator(nil)
+	hmacAuthenticator   *auth.HMACAuthenticator
+)
+
+// Applies the API keys and HMAC secrets of the settings, invalid credentials are rejected and the current ones kept
+func setCredentials(ctx context.Context, authSettings AuthSettings) error {
+	apiKeys, err := auth.ParseCredentials(authSettings.APIKeys)
+	if err != nil {
+		return fmt.Errorf("API_KEYS: %w", err)
+	}
+	hmacSecrets, err := auth.ParseCredentials(authSettings.HMACSecrets)
+	if err != nil {
+		return fmt.Errorf("HMAC_SECRETS: %w", err)
+	}
+
+	// Every key is masked on its own in logs and telemetry
+	for _, credentials := range []map[string][]string{apiKeys, hmacSecrets} {
+		for _, secrets := range credentials {
+			telemetry.RegisterSecret(secrets...)
+		}
+	}
+
+	apiKeyAuthenticator.SetKeys(apiKeys)
+	hmacAuthenticator.SetSecrets(hmacSecrets)
+	logger.Info(ctx, "Client credentials loaded", "KeyClients", len(apiKeys), "SigningClients", len(hmacSecrets))
+
+	// An enabled method without credentials rejects every request that uses it
+	for _, method := range authSettings.Methods {
+		switch strings.ToLower(method) {
+		case auth.APIKeyMethod:
+			if len(apiKeys) == 0 {
+				logger.Error(ctx, "API key authentication is enabled but API_KEYS is empty, every API key is rejected", "Methods", authSettings.Methods)
+			}
+		case auth.HMACMethod:
+			if len(hmacSecrets) == 0 {
+				logger.Error(ctx, "HMAC authentication is enabled but HMAC_SECRETS is empty, every signed request is rejected", "Methods", authSettings.Methods)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the authenticators of the methods, in order
+func authenticators(methods []string) ([]auth.Authenticator, error) {
+	var result []auth.Authenticator
+	for _, method := range methods {
+		switch strings.ToLower(method) {
+		case auth.APIKeyMethod:
+			result = append(result, apiKeyAuthenticator)
+		case auth.HMACMethod:
+			result = append(result, hmacAuthenticator)
+		case "none":
+		default:
+			return nil, fmt.Errorf("unknown authentication method %q", method)
+		}
+	}
+	return result, nil
+}
+
+// Circuit breaker of the event hub producer, it can be changed without a restart
+type BreakerSettings struct {
+	FailureThreshold int           `config:"PUBLISH_BREAKER_FAILURES" default:"5"`
+	SuccessThreshold int           `config:"PUBLISH_BREAKER_SUCCESSES" default:"1"`
+	OpenTimeout      time.Duration `config:"PUBLISH_BREAKER_OPEN_TIMEOUT" default:"30s"`
+	HalfOpenMaxCalls int           `config:"PUBLISH_BREAKER_HALF_OPEN_CALLS" default:"1"`
+}
+
+// Options returns the circuit breaker options of the settings
+func (s BreakerSettings) Options() breaker.Options {
+	return breaker.Options{
+		FailureThreshold: s.FailureThreshold,
+		SuccessThreshold: s.SuccessThreshold,
+		OpenTimeout:      s.OpenTimeout,
+		HalfOpenMaxCalls: s.HalfOpenMaxCalls,
+	}
+}
+
+// Circuit breaker of the sends to the event hub
+var eventHubBreaker *breaker.Breaker
+
+// Token bucket limits of /publish, a rate of 0 disables the limit. They can be changed without a restart.
+type RateLimitSettings struct {
+	GlobalRate        float64 `config:"RATE_LIMIT_GLOBAL_RATE" default:"0"`
+	GlobalBurst       int     `config:"RATE_LIMIT_GLOBAL_BURST" default:"0"`
+	APIKeyRate        float64 `config:"RATE_LIMIT_API_KEY_RATE" default:"0"`
+	APIKeyBurst       int     `config:"RATE_LIMIT_API_KEY_BURST" default:"0"`
+	ClientRate        float64 `config:"RATE_LIMIT_CLIENT_RATE" default:"0"`
+	ClientBurst       int     `config:"RATE_LIMIT_CLIENT_BURST" default:"0"`
+	IPRate            float64 `config:"RATE_LIMIT_IP_RATE" default:"0"`
+	IPBurst           int     `config:"RATE_LIMIT_IP_BURST" default:"0"`
+	TrustForwardedFor bool    `config:"RATE_LIMIT_TRUST_FORWARDED_FOR" default:"false"`
+}
+
+// Keys of the rate limit settings that are applied without a restart
+var rateLimitKeys = []string{
+	"RATE_LIMIT_GLOBAL_RATE", "RATE_LIMIT_GLOBAL_BURST",
+	"RATE_LIMIT_API_KEY_RATE", "RATE_LIMIT_API_KEY_BURST",
+	"RATE_LIMIT_CLIENT_RATE", "RATE_LIMIT_CLIENT_BURST",
+	"RATE_LIMIT_IP_RATE", "RATE_LIMIT_IP_BURST",
+}
+
+// Rate limiters of /publish
+var (
+	globalLimiter = ratelimit.NewLimiter(ratelimit.Limit{})
+	apiKeyLimiter = ratelimit.NewLimiter(ratelimit.Limit{})
+	clientLimiter = ratelimit.NewLimiter(ratelimit.Limit{})
+	ipLimiter     = ratelimit.NewLimiter(ratelimit.Limit{})
+)
+
+// Applies the rate limit settings to the limiters
+func setRateLimits(limits RateLimitSettings) {
+	globalLimiter.SetLimit(ratelimit.Limit{Rate: limits.GlobalRate, Burst: limits.GlobalBurst})
+	apiKeyLimiter.SetLimit(ratelimit.Limit{Rate: limits.APIKeyRate, Burst: limits.APIKeyBurst})
+	clientLimiter.SetLimit(ratelimit.Limit{Rate: limits.ClientRate, Burst: limits.ClientBurst})
+	ipLimiter.SetLimit(ratelimit.Limit{Rate: limits.IPRate, Burst: limits.IPBurst})
+}
+
+// Retry policy of the producer, it can be changed without a restart
+type RetrySettings struct {
+	MaxRetries int           `config:"PUBLISH_MAX_RETRIES" default:"0"`
+	Delay      time.Duration `config:"PUBLISH_RETRY_DELAY" default:"500ms"`
+}
+
+var settings Settings
+
 func main() {
+	// "publisher config dump" prints the effective configuration and exits
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(runConfigCommand(os.Args[2:]))
+	}
+
+	// Track any panic and flush telemetry before the process exits
+	defer telemetry.RecoverPanic()
+
+	// Cancelled on SIGTERM, when Kubernetes stops the pod
+	ctx := lifecycle.Start()
+
 	err := initializeApp()
 	if err != nil {
-		log.Println("Publisher::Error initializing app", err)
+		logger.Critical(context.Background(), "Error initializing app", "Error", err)
+		panic(err)
+	}
+
+	// Start the HTTP server, requests are authenticated with the methods of AUTH_METHODS
+	authenticate, err := authenticators(settings.Auth.Methods)
+	if err != nil {
+		logger.Critical(context.Background(), "Invalid authentication methods", "Error", err)
 		panic(err)
 	}
+	server := startHTTPServer(authenticate)
+
+	// The admin endpoints are served on their own port, which the Service does not expose
+	adminServer := startAdminServer()
 
-	// Start the HTTP server
-	startHTTPServer()
+	// Shutdown order: let the load balancer see readiness fail, stop accepting requests and
+	// wait for in-flight publishes, then close the producer. Telemetry is flushed last.
+	lifecycle.OnShutdown("readiness delay", func(ctx context.Context) error {
+		select {
+		case <-time.After(settings.ShutdownDelay):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	lifecycle.OnShutdown("http server", server.Shutdown)
+	lifecycle.OnShutdown("eventhub producer", func(ctx context.Context) error {
+		return producer.ProducerClose()
+	})
+	lifecycle.OnShutdown("admin server", adminServer.Shutdown)
 
 	// Graceful shutdown
-	// defer func() {
-	// 	// Close the EventHub client
-	// 	err := producer.Close()
+	<-ctx.Done()
+	if err := lifecycle.Shutdown(settings.ShutdownTimeout); err != nil {
+		os.Exit(1)
+	}
 }
 
-func initializeApp() error {
-	// Get the configuration settings from App Configuration
+// Initializes the configuration providers and loads the settings
+func loadConfig(ctx context.Context) error {
 	err := config.InitializeConfig()
 	if err != nil {
-		log.Println("Consumervnext::Error initializing config", err)
-		panic(err)
+		logger.Critical(ctx, "Error initializing config", "Error", err)
+		return err
+	}
+
+	// Keys namespaced for this service win over the shared ones
+	config.SetKeyPrefix("publisher:")
+	err = config.Bind(ctx, &settings)
+	if err != nil {
+		logger.Critical(ctx, "Error loading configuration", "Error", err)
+		return err
+	}
+	return nil
+}
+
+// Runs the config subcommand, returns the exit code
+func runConfigCommand(args []string) int {
+	if len(args) != 1 || args[0] != "dump" {
+		fmt.Fprintln(os.Stderr, "usage: publisher config dump")
+		return 2
+	}
+
+	// Logs go to stderr so the dump can be redirected
+	telemetry.SetLogOutput(os.Stderr)
+	err := loadConfig(context.Background())
+	if dumpErr := config.Dump(os.Stdout); dumpErr != nil {
+		fmt.Fprintln(os.Stderr, dumpErr)
+		return 1
 	}
-	appinsights_instrumentationkey, _ := config.GetVar("APPINSIGHTS_INSTRUMENTATIONKEY")
-	eventHubName, _ := config.GetVar("EVENTHUB_NAME")
-	eventHubConnectionString, _ := config.GetVar("EVENTHUB_PUBLISHER_CONNECTION_STRING")
-	log.Println("Publisher::AppInsightsInstrumentationKey::", appinsights_instrumentationkey)
-	log.Println("Publisher::EventHubName::", eventHubName)
-	log.Println("Publisher::EventHubConnectionString::", eventHubConnectionString)
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+func initializeApp() error {
+	// Get the configuration settings from the configuration providers
+	ctx := context.Background()
+	if err := loadConfig(ctx); err != nil {
+		return err
+	}
+	logger.Info(ctx, "Configuration loaded", config.LogFields(&settings)...)
 
 	// Initialize telemetry
-	err = telemetry.InitTelemetryKey(SERVICE_NAME, appinsights_instrumentationkey)
+	err := telemetry.InitTelemetryKey(SERVICE_NAME, settings.AppInsightsInstrumentationKey)
 	if err != nil {
-		log.Println("Consumervnext::Error initializing telemetry", err)
+		logger.Critical(ctx, "Error initializing telemetry", "Error", err)
 		panic(err)
 	}
 
 	// Initialize a new EventHub instance
-	producerInstance, err := messaging.ProducerInit(SERVICE_NAME, eventHubConnectionString, eventHubName)
+	producerInstance, err := messaging.ProducerInit(SERVICE_NAME, settings.EventHubConnectionString, settings.EventHubName)
 	if err != nil {
 		// Failed to initialize EventHub, log the error to App Insights
-		telemetry.TrackException(err, telemetry.Error, map[string]string{"Message": "Publisher::Failed to initialize EventHub", "Error": err.Error()})
+		logger.Critical(ctx, "Failed to initialize EventHub", "Error", err)
 		panic(err)
 	}
 
 	// Set the global producer instance
-	telemetry.TrackTrace("Publisher::Initialization complete", telemetry.Information, map[string]string{"EventHubName": eventHubName}, "")
+	producerInstance.SetRetryPolicy(messaging.RetryPolicy{MaxRetries: settings.Retry.MaxRetries, Delay: settings.Retry.Delay})
+	eventHubBreaker = breaker.New("eventhub", settings.Breaker.Options())
+	producerInstance.SetCircuitBreaker(eventHubBreaker)
 	producer = producerInstance
+	setRateLimits(settings.RateLimit)
+
+	// Clients authenticate with the API keys and HMAC secrets of the configuration
+	hmacAuthenticator = auth.NewHMACAuthenticator(nil, auth.HMACOptions{ReplayWindow: settings.Auth.ReplayWindow})
+	if err := setCredentials(ctx, settings.Auth); err != nil {
+		logger.Critical(ctx, "Invalid client credentials", "Error", err)
+		return err
+	}
+
+	// Readiness depends on the broker, the config store and telemetry are reported only
+	health.Register("eventhub", producer.Check)
+	health.RegisterOptional("config", config.Check)
+	health.RegisterOptional("telemetry", telemetry.Check)
+	health.RegisterOptional("eventhub-breaker", func(ctx context.Context) error {
+		if state := eventHubBreaker.State(); state != breaker.Closed {
+			return fmt.Errorf("circuit breaker %s", state)
+		}
+		return nil
+	})
+
+	// Apply configuration changes without a restart
+	config.SubscribeTelemetry()
+	config.Subscribe(func(change config.Change) {
+		var retry RetrySettings
+		if err := config.Bind(ctx, &retry); err != nil {
+			return
+		}
+		producer.SetRetryPolicy(messaging.RetryPolicy{MaxRetries: retry.MaxRetries, Delay: retry.Delay})
+	}, "PUBLISH_MAX_RETRIES", "PUBLISH_RETRY_DELAY")
+	config.Subscribe(func(change config.Change) {
+		var limits RateLimitSettings
+		if err := config.Bind(ctx, &limits); err != nil {
+			return
+		}
+		setRateLimits(limits)
+		logger.Info(ctx, "Rate limits changed", config.LogFields(&limits)...)
+	}, rateLimitKeys...)
+	config.Subscribe(func(change config.Change) {
+		var breakerSettings BreakerSettings
+		if err := config.Bind(ctx, &breakerSettings); err != nil {
+			return
+		}
+		eventHubBreaker.SetOptions(breakerSettings.Options())
+	}, "PUBLISH_BREAKER_FAILURES", "PUBLISH_BREAKER_SUCCESSES", "PUBLISH_BREAKER_OPEN_TIMEOUT", "PUBLISH_BREAKER_HALF_OPEN_CALLS")
+	config.Subscribe(func(change config.Change) {
+		var authSettings AuthSettings
+		if err := config.Bind(ctx, &authSettings); err != nil {
+			return
+		}
+		if err := setCredentials(ctx, authSettings); err != nil {
+			logger.Error(ctx, "Invalid client credentials, keeping the current ones", "Error", err)
+		}
+	}, "API_KEYS", "HMAC_SECRETS")
+	config.StartRefresh(ctx, config.RefreshOptions{Interval: settings.RefreshInterval, SentinelKey: settings.SentinelKey})
+
+	logger.Info(ctx, "Initialization complete", "EventHubName", settings.EventHubName)
 
 	return nil
 }
 
-// Initialize HTTP server and routes
-func startHTTPServer() {
+// Initialize HTTP server and routes, the server runs in the background until it is shut down
+func startHTTPServer(authenticate []auth.Authenticator) *http.Server {
 	// Create a new router
 	router := mux.NewRouter()
 
-	// Define REST API endpoint for publishing messages
-	router.HandleFunc("/publish", publishMessages).Methods("POST")
+	// Define REST API endpoint for publishing messages: limited per client IP, then authenticated,
+	// then limited per API key, per client and globally
+	limitIP := ratelimit.Middleware(
+		ratelimit.Rule{Name: "ip", Limiter: ipLimiter, Key: ratelimit.ClientIP(settings.RateLimit.TrustForwardedFor)},
+	)
+	limitClient := ratelimit.Middleware(
+		ratelimit.Rule{Name: "apikey", Limiter: apiKeyLimiter, Key: apiKeyID},
+		ratelimit.Rule{Name: "client", Limiter: clientLimiter, Key: clientID},
+		ratelimit.Rule{Name: "global", Limiter: globalLimiter, Key: ratelimit.GlobalKey},
+	)
+	publish := limitClient(http.HandlerFunc(publishMessages))
+	if len(authenticate) > 0 {
+		publish = auth.Middleware(authenticate...)(publish)
+	} else {
+		logger.Warning(context.Background(), "Authentication disabled, /publish accepts anonymous requests")
+	}
+	router.Handle("/publish", limitIP(publish)).Methods("POST")
+
+	// Liveness and readiness probes
+	router.Handle("/healthz", health.LivenessHandler()).Methods("GET")
+	router.Handle("/readyz", health.ReadinessHandler()).Methods("GET")
 
 	// Start HTTP server
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080" // Default port if not specified
-	}
+	port := strconv.Itoa(settings.Port)
 	server := &http.Server{
 		Addr:         ":" + port,
 		Handler:      router,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
+		ReadTimeout:  settings.ReadTimeout,
+		WriteTimeout: settings.WriteTimeout,
 	}
 
 	// Server started in the specified port, log to App Insights
-	telemetry.TrackTrace("Publisher::ServerStarted on port "+port, telemetry.Information, map[string]string{"port": port}, "")
+	logger.Info(context.Background(), "ServerStarted on port "+port, "port", port)
 
-	// Start the server
-	err := server.ListenAndServe()
-	if err != nil {
-		// Failed to start server, log the error to App Insights
-		telemetry.TrackException(err, telemetry.Error, map[string]string{"Message": "Publisher::Failed to start server", "Error": err.Error()})
-		panic(err)
+	// Start the server, the service is ready once it accepts requests
+	health.SetReady()
+	go func() {
+		defer telemetry.RecoverPanic()
+
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			// Failed to start server, log the error to App Insights and stop
+			logger.Critical(context.Background(), "Failed to start server", "Error", err)
+			lifecycle.Fail(err)
+		}
+	}()
+	return server
+}
+
+// Serves the admin endpoints on ADMIN_PORT in the background, the publisher keeps running if the server fails.
+// The port is not exposed by the Service, it is only reachable from within the cluster.
+func startAdminServer() *http.Server {
+	router := mux.NewRouter()
+
+	// Effective configuration, secrets are masked
+	router.Handle("/admin/config", config.Handler()).Methods("GET")
+
+	port := strconv.Itoa(settings.AdminPort)
+	server := &http.Server{
+		Addr:              ":" + port,
+		Handler:           router,
+		ReadHeaderTimeout: 10 * time.Second,
 	}
+
+	logger.Info(context.Background(), "Admin server started on port "+port, "port", port)
+	go func() {
+		defer telemetry.RecoverPanic()
+
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error(context.Background(), "Admin server stopped", "Error", err)
+		}
+	}()
+	return server
+}
+
+// Returns the key the request was authenticated with, so each key of a client has its own limit.
+// Without authentication, the X-API-Key header sent by the client.
+func apiKeyID(r *http.Request) string {
+	if identity, ok := auth.IdentityFrom(r.Context()); ok {
+		return identity.KeyID
+	}
+	return r.Header.Get(auth.APIKeyHeader)
+}
+
+// Returns the authenticated client, empty when authentication is disabled
+func clientID(r *http.Request) string {
+	identity, _ := auth.IdentityFrom(r.Context())
+	return identity.ClientID
 }
 
 // Publishes messages to the event hub
@@ -124,7 +479,13 @@ func publishMessages(w http.ResponseWriter, r *http.Request) {
 
 	// Get a new operation ID to track the end-to-end request and add it to the context
 	operationID := telemetry.TrackRequest(r.URL.Path, r.URL.String(), time.Since(startTime), strconv.Itoa(http.StatusOK), true, r.RemoteAddr, nil)
-	ctx := context.WithValue(context.Background(), shared.OperationIDKeyContextKey, operationID)
+	// The request context carries the authenticated client, added to the event metadata, and stops the retries
+	// when the client goes away
+	ctx := context.WithValue(r.Context(), shared.OperationIDKeyContextKey, operationID)
+	identity, _ := auth.IdentityFrom(ctx)
+
+	// Feature flags are evaluated for the customer and product category of the order
+	ctx = config.WithTargeting(ctx, event.OrderPayload.CustomerID, event.OrderPayload.ProductCategory)
 
 	// Generate a unique UUID for the event
 	event.EventID = uuid.New().String()
@@ -135,9 +496,29 @@ func publishMessages(w http.ResponseWriter, r *http.Request) {
 	// Publish the message to event hub
 	err = producer.PublishMessage(ctx, SERVICE_NAME, operationID, event)
 
+	// The event hub is failing, the client can retry once the breaker lets calls through again
+	var openErr *breaker.OpenError
+	if errors.As(err, &openErr) {
+		if openErr.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(openErr.RetryAfter.Seconds()))))
+		}
+		http.Error(w, "event hub unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
 	if err != nil {
 		// Failed to publish message, log the error to App Insights
-		telemetry.TrackTraceCtx(ctx, "Publisher::Failed to publish message: "+event.EventID+")", telemetry.Error, map[string]string{"Error": err.Error()})
+		logger.Error(ctx, "Failed to publish message", "EventID", event.EventID, "ClientID", identity.ClientID, "Error", err)
+		switch {
+		case errors.Is(err, azeventhubs.ErrEventDataTooLarge):
+			http.Error(w, "event too large", http.StatusRequestEntityTooLarge)
+		case errors.Is(err, context.Canceled):
+			// The client went away, nobody reads the response
+			http.Error(w, "request cancelled", http.StatusServiceUnavailable)
+		default:
+			http.Error(w, "failed to publish to the event hub", http.StatusBadGateway)
+		}
+		return
 	}
 
 	// Send HTTP response with status code 200 (OK)
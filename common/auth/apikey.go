@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Header carrying the API key
+const APIKeyHeader = "X-API-Key"
+
+// ParseCredentials reads client credentials written as <client>:<secret>,<client>:<secret>,...
+// A client can have several secrets, so a new one can be added before the old one is removed.
+func ParseCredentials(value string) (map[string][]string, error) {
+	credentials := map[string][]string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		clientID, secret, ok := strings.Cut(item, ":")
+		clientID, secret = strings.TrimSpace(clientID), strings.TrimSpace(secret)
+		if !ok || clientID == "" || secret == "" {
+			return nil, fmt.Errorf("invalid credential for client %q, expected <client>:<secret>", clientID)
+		}
+		credentials[clientID] = append(credentials[clientID], secret)
+	}
+	return credentials, nil
+}
+
+// Key of a client, only its hash is kept
+type apiKey struct {
+	clientID string
+	hash     [sha256.Size]byte
+}
+
+// APIKeyAuthenticator accepts requests whose X-API-Key header holds a key of a client.
+// Keys can be replaced at any time, e.g. when they are rotated in the configuration.
+type APIKeyAuthenticator struct {
+	mu   sync.RWMutex
+	keys []apiKey
+}
+
+// Creates an API key authenticator with the keys of each client
+func NewAPIKeyAuthenticator(keys map[string][]string) *APIKeyAuthenticator {
+	a := &APIKeyAuthenticator{}
+	a.SetKeys(keys)
+	return a
+}
+
+// Name of the method
+func (a *APIKeyAuthenticator) Name() string {
+	return APIKeyMethod
+}
+
+// SetKeys replaces the keys of every client, requests with a removed key are rejected from now on
+func (a *APIKeyAuthenticator) SetKeys(keys map[string][]string) {
+	var hashed []apiKey
+	for clientID, clientKeys := range keys {
+		for _, key := range clientKeys {
+			hashed = append(hashed, apiKey{clientID: clientID, hash: sha256.Sum256([]byte(key))})
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.keys = hashed
+}
+
+// Authenticate looks the key up among the keys of every client, comparing in constant time
+func (a *APIKeyAuthenticator) Authenticate(r *http.Request) (Identity, error) {
+	key := r.Header.Get(APIKeyHeader)
+	if key == "" {
+		return Identity{}, ErrNoCredentials
+	}
+	hash := sha256.Sum256([]byte(key))
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, candidate := range a.keys {
+		if subtle.ConstantTimeCompare(hash[:], candidate.hash[:]) == 1 {
+			return Identity{ClientID: candidate.clientID, Method: APIKeyMethod, KeyID: keyID(hash[:])}, nil
+		}
+	}
+	return Identity{}, errors.New("unknown API key")
+}
+
+// Short identifier of a key, derived from its hash
+func keyID(hash []byte) string {
+	return hex.EncodeToString(hash[:4])
+}
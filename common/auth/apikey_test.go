@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseCredentials(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    map[string][]string
+		wantErr bool
+	}{
+		{"empty", "", map[string][]string{}, false},
+		{"several clients", "web:k1, mobile:k2", map[string][]string{"web": {"k1"}, "mobile": {"k2"}}, false},
+		{"several keys of a client", "web:old,web:new,", map[string][]string{"web": {"old", "new"}}, false},
+		{"secret with a colon", "web:a:b", map[string][]string{"web": {"a:b"}}, false},
+		{"missing secret", "web:", nil, true},
+		{"missing client", ":k1", nil, true},
+		{"no separator", "web", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseCredentials(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseCredentials error = %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("ParseCredentials = %v, want %v", got, tt.want)
+			}
+			for clientID, secrets := range tt.want {
+				if len(got[clientID]) != len(secrets) {
+					t.Fatalf("secrets of %s = %v, want %v", clientID, got[clientID], secrets)
+				}
+				for i := range secrets {
+					if got[clientID][i] != secrets[i] {
+						t.Errorf("secret %d of %s = %q, want %q", i, clientID, got[clientID][i], secrets[i])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestAPIKeyAuthenticator(t *testing.T) {
+	authenticator := NewAPIKeyAuthenticator(map[string][]string{"web": {"old-key", "new-key"}, "mobile": {"mobile-key"}})
+
+	tests := []struct {
+		name         string
+		key          string
+		wantClientID string
+		wantErr      bool
+		wantNoCreds  bool
+	}{
+		{"first key of a client", "old-key", "web", false, false},
+		{"second key of a client", "new-key", "web", false, false},
+		{"other client", "mobile-key", "mobile", false, false},
+		{"no key", "", "", true, true},
+		{"unknown key", "guess", "", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/publish", nil)
+			if tt.key != "" {
+				request.Header.Set(APIKeyHeader, tt.key)
+			}
+			identity, err := authenticator.Authenticate(request)
+			if tt.wantErr {
+				if err == nil || errors.Is(err, ErrNoCredentials) != tt.wantNoCreds {
+					t.Errorf("Authenticate error = %v, want error with no credentials %t", err, tt.wantNoCreds)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Authenticate error = %v", err)
+			}
+			if identity.ClientID != tt.wantClientID || identity.Method != APIKeyMethod || identity.KeyID == "" {
+				t.Errorf("Identity = %+v, want client %q authenticated by API key", identity, tt.wantClientID)
+			}
+		})
+	}
+}
+
+func TestAPIKeyAuthenticatorSetKeys(t *testing.T) {
+	authenticator := NewAPIKeyAuthenticator(map[string][]string{"web": {"old-key"}})
+	request := httptest.NewRequest(http.MethodPost, "/publish", nil)
+	request.Header.Set(APIKeyHeader, "old-key")
+	first, err := authenticator.Authenticate(request)
+	if err != nil {
+		t.Fatalf("Authenticate error = %v", err)
+	}
+
+	// A rotated key is rejected, the new one has its own key ID
+	authenticator.SetKeys(map[string][]string{"web": {"new-key"}})
+	if _, err := authenticator.Authenticate(request); err == nil || errors.Is(err, ErrNoCredentials) {
+		t.Errorf("removed key: Authenticate error = %v, want unknown API key", err)
+	}
+	request.Header.Set(APIKeyHeader, "new-key")
+	second, err := authenticator.Authenticate(request)
+	if err != nil {
+		t.Fatalf("new key: Authenticate error = %v", err)
+	}
+	if first.KeyID == second.KeyID {
+		t.Errorf("both keys have the key ID %q", first.KeyID)
+	}
+}
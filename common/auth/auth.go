@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/microtest/common/shared"
+	"github.com/microtest/common/telemetry"
+)
+
+// Authentication methods
+const (
+	APIKeyMethod = "apikey"
+	HMACMethod   = "hmac"
+)
+
+// ErrNoCredentials is returned by an authenticator when the request has none of its credentials,
+// the next authenticator is then tried
+var ErrNoCredentials = errors.New("no credentials")
+
+// Logger for the auth package
+var logger = telemetry.NewLogger("Auth")
+
+// Identity of an authenticated client
+type Identity struct {
+	// Client the credentials belong to
+	ClientID string
+
+	// Method that authenticated the request, apikey or hmac
+	Method string
+
+	// Identifies which of the client's keys was used, without revealing it, to follow rotations
+	KeyID string
+}
+
+// Authenticator checks the credentials of a request
+type Authenticator interface {
+	// Name of the method
+	Name() string
+
+	// Authenticate returns the identity of the client, or ErrNoCredentials if the request has no credentials for this method
+	Authenticate(r *http.Request) (Identity, error)
+}
+
+// WithIdentity returns a context carrying the client identity
+func WithIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, shared.ClientIdentityKeyContextKey, identity)
+}
+
+// IdentityFrom returns the client identity of the context, false if the request was not authenticated
+func IdentityFrom(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(shared.ClientIdentityKeyContextKey).(Identity)
+	return identity, ok
+}
+
+// Middleware rejects with 401 Unauthorized the requests that no authenticator accepts.
+// Authenticators are tried in order, the first one that finds its credentials decides.
+// The identity of accepted requests is added to the request context.
+func Middleware(authenticators ...Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, authenticator := range authenticators {
+				identity, err := authenticator.Authenticate(r)
+				if errors.Is(err, ErrNoCredentials) {
+					continue
+				}
+				if err != nil {
+					logger.Warning(r.Context(), "Authentication failed", "Method", authenticator.Name(), "Path", r.URL.Path, "RemoteAddr", r.RemoteAddr, "Error", err)
+					http.Error(w, "unauthorized", http.StatusUnauthorized)
+					return
+				}
+				next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), identity)))
+				return
+			}
+
+			logger.Info(r.Context(), "Request without credentials", "Path", r.URL.Path, "RemoteAddr", r.RemoteAddr)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		})
+	}
+}
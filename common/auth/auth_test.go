@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/microtest/common/telemetry"
+)
+
+func TestMiddleware(t *testing.T) {
+	telemetry.SetLogOutput(io.Discard)
+	t.Cleanup(func() { telemetry.SetLogOutput(os.Stdout) })
+
+	handler := Middleware(
+		NewAPIKeyAuthenticator(map[string][]string{"web": {"web-key"}}),
+		newTestHMACAuthenticator(),
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, ok := IdentityFrom(r.Context())
+		if !ok {
+			t.Error("handler called without an identity")
+		}
+		w.Header().Set("X-Test-Client", identity.ClientID+"/"+identity.Method)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	withKey := func(key string) func() *http.Request {
+		return func() *http.Request {
+			request := httptest.NewRequest(http.MethodPost, "/publish", nil)
+			request.Header.Set(APIKeyHeader, key)
+			return request
+		}
+	}
+	tests := []struct {
+		name       string
+		request    func() *http.Request
+		wantStatus int
+		wantClient string
+	}{
+		{"API key", withKey("web-key"), http.StatusNoContent, "web/apikey"},
+		{"HMAC signature", func() *http.Request { return signedRequest("web", "new-secret", "{}", testNow) }, http.StatusNoContent, "web/hmac"},
+		{"invalid API key", withKey("guess"), http.StatusUnauthorized, ""},
+		{"invalid signature", func() *http.Request { return signedRequest("web", "new-secret", "{}", testNow.Add(time.Hour)) }, http.StatusUnauthorized, ""},
+		{"no credentials", func() *http.Request { return httptest.NewRequest(http.MethodPost, "/publish", nil) }, http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, tt.request())
+			if response.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", response.Code, tt.wantStatus)
+			}
+			if got := response.Header().Get("X-Test-Client"); got != tt.wantClient {
+				t.Errorf("client = %q, want %q", got, tt.wantClient)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers of a signed request
+const (
+	ClientIDHeader      = "X-Client-Id"
+	TimestampHeader     = "X-Timestamp"
+	ContentSHA256Header = "X-Content-SHA256"
+	SignatureHeader     = "X-Signature"
+)
+
+// Defaults of the HMAC options
+const (
+	DefaultReplayWindow = 5 * time.Minute
+	DefaultMaxBodyBytes = 1 << 20
+)
+
+// HMACOptions controls the checks of signed requests
+type HMACOptions struct {
+	// Maximum difference between the request timestamp and the server clock, in both directions.
+	// A signature is also accepted only once within the window.
+	ReplayWindow time.Duration
+
+	// Largest body that is read to check its digest
+	MaxBodyBytes int64
+}
+
+// HMACAuthenticator accepts requests signed with a secret of the client.
+// The client sends its ID, the Unix time in seconds, the hex SHA-256 digest of the body and the hex HMAC-SHA256 signature of
+//
+//	<method>\n<path and query>\n<timestamp>\n<body digest>
+//
+// Requests outside the replay window, or with a signature already seen, are rejected.
+type HMACAuthenticator struct {
+	options HMACOptions
+	now     func() time.Time
+
+	mu      sync.RWMutex
+	secrets map[string][]string
+
+	// Signatures accepted within the replay window, with the time they can be forgotten
+	seenMu    sync.Mutex
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+// Creates an HMAC authenticator with the secrets of each client
+func NewHMACAuthenticator(secrets map[string][]string, options HMACOptions) *HMACAuthenticator {
+	if options.ReplayWindow <= 0 {
+		options.ReplayWindow = DefaultReplayWindow
+	}
+	if options.MaxBodyBytes <= 0 {
+		options.MaxBodyBytes = DefaultMaxBodyBytes
+	}
+	return &HMACAuthenticator{options: options, now: time.Now, secrets: secrets, seen: map[string]time.Time{}}
+}
+
+// Name of the method
+func (a *HMACAuthenticator) Name() string {
+	return HMACMethod
+}
+
+// SetSecrets replaces the secrets of every client, e.g. when they are rotated in the configuration
+func (a *HMACAuthenticator) SetSecrets(secrets map[string][]string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.secrets = secrets
+}
+
+// Authenticate checks the timestamp, the body digest and the signature, the body stays readable by the handler
+func (a *HMACAuthenticator) Authenticate(r *http.Request) (Identity, error) {
+	signature := r.Header.Get(SignatureHeader)
+	if signature == "" {
+		return Identity{}, ErrNoCredentials
+	}
+	clientID := r.Header.Get(ClientIDHeader)
+	timestamp := r.Header.Get(TimestampHeader)
+	digest := strings.ToLower(r.Header.Get(ContentSHA256Header))
+	if clientID == "" || timestamp == "" || digest == "" {
+		return Identity{}, fmt.Errorf("signed request requires the %s, %s and %s headers", ClientIDHeader, TimestampHeader, ContentSHA256Header)
+	}
+
+	// The timestamp must be within the replay window
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return Identity{}, fmt.Errorf("invalid timestamp %q", timestamp)
+	}
+	now := a.now()
+	skew := now.Sub(time.Unix(seconds, 0))
+	if skew > a.options.ReplayWindow || skew < -a.options.ReplayWindow {
+		return Identity{}, fmt.Errorf("timestamp outside the replay window of %s", a.options.ReplayWindow)
+	}
+
+	// The body must match its digest
+	body, err := readBody(r, a.options.MaxBodyBytes)
+	if err != nil {
+		return Identity{}, err
+	}
+	bodyDigest := sha256.Sum256(body)
+	if !hmac.Equal([]byte(hex.EncodeToString(bodyDigest[:])), []byte(digest)) {
+		return Identity{}, errors.New("body does not match its digest")
+	}
+
+	// The signature must match one of the client's secrets
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return Identity{}, errors.New("signature is not hex encoded")
+	}
+	message := StringToSign(r.Method, r.URL.RequestURI(), timestamp, digest)
+	a.mu.RLock()
+	secrets := a.secrets[clientID]
+	a.mu.RUnlock()
+	for _, secret := range secrets {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(message))
+		sum := mac.Sum(nil)
+		if hmac.Equal(sum, expected) {
+			if !a.remember(hex.EncodeToString(expected), now) {
+				return Identity{}, errors.New("signature already used")
+			}
+			return Identity{ClientID: clientID, Method: HMACMethod, KeyID: keyID(hashOf(secret))}, nil
+		}
+	}
+	return Identity{}, fmt.Errorf("invalid signature for client %q", clientID)
+}
+
+// StringToSign returns the message signed by the client
+func StringToSign(method, requestURI, timestamp, bodyDigest string) string {
+	return strings.Join([]string{method, requestURI, timestamp, bodyDigest}, "\n")
+}
+
+// Records the signature, false if it was already seen within the replay window
+func (a *HMACAuthenticator) remember(signature string, now time.Time) bool {
+	a.seenMu.Lock()
+	defer a.seenMu.Unlock()
+
+	// Forget the expired signatures once a minute
+	if now.Sub(a.lastSweep) >= time.Minute {
+		a.lastSweep = now
+		for seen, expires := range a.seen {
+			if now.After(expires) {
+				delete(a.seen, seen)
+			}
+		}
+	}
+	if expires, ok := a.seen[signature]; ok && !now.After(expires) {
+		return false
+	}
+	// A timestamp can be up to a window in the future, so the signature is kept for two windows
+	a.seen[signature] = now.Add(2 * a.options.ReplayWindow)
+	return true
+}
+
+// Reads the body and puts it back for the handler
+func readBody(r *http.Request, maxBytes int64) ([]byte, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBytes+1))
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > maxBytes {
+		return nil, fmt.Errorf("body larger than %d bytes", maxBytes)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// SHA-256 of a secret
+func hashOf(secret string) []byte {
+	hash := sha256.Sum256([]byte(secret))
+	return hash[:]
+}
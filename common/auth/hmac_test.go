@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testNow = time.Unix(1700000000, 0)
+
+// Builds a request signed like a client would
+func signedRequest(clientID, secret, body string, timestamp time.Time) *http.Request {
+	request := httptest.NewRequest(http.MethodPost, "/publish?source=test", strings.NewReader(body))
+	digest := sha256.Sum256([]byte(body))
+	bodyDigest := hex.EncodeToString(digest[:])
+	seconds := strconv.FormatInt(timestamp.Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(StringToSign(request.Method, request.URL.RequestURI(), seconds, bodyDigest)))
+
+	request.Header.Set(ClientIDHeader, clientID)
+	request.Header.Set(TimestampHeader, seconds)
+	request.Header.Set(ContentSHA256Header, bodyDigest)
+	request.Header.Set(SignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	return request
+}
+
+func newTestHMACAuthenticator() *HMACAuthenticator {
+	authenticator := NewHMACAuthenticator(map[string][]string{"web": {"old-secret", "new-secret"}}, HMACOptions{ReplayWindow: time.Minute, MaxBodyBytes: 64})
+	authenticator.now = func() time.Time { return testNow }
+	return authenticator
+}
+
+func TestHMACAuthenticator(t *testing.T) {
+	tests := []struct {
+		name    string
+		request func() *http.Request
+		wantErr string
+	}{
+		{"valid signature", func() *http.Request { return signedRequest("web", "new-secret", `{"id":1}`, testNow) }, ""},
+		{"older secret of the client", func() *http.Request { return signedRequest("web", "old-secret", `{"id":2}`, testNow) }, ""},
+		{"timestamp within the window", func() *http.Request {
+			return signedRequest("web", "new-secret", `{"id":3}`, testNow.Add(-59*time.Second))
+		}, ""},
+		{"unsigned request", func() *http.Request { return httptest.NewRequest(http.MethodPost, "/publish", nil) }, ErrNoCredentials.Error()},
+		{"unknown client", func() *http.Request { return signedRequest("mobile", "new-secret", `{"id":4}`, testNow) }, "invalid signature"},
+		{"wrong secret", func() *http.Request { return signedRequest("web", "guess", `{"id":5}`, testNow) }, "invalid signature"},
+		{"expired timestamp", func() *http.Request {
+			return signedRequest("web", "new-secret", `{"id":6}`, testNow.Add(-2*time.Minute))
+		}, "replay window"},
+		{"future timestamp", func() *http.Request {
+			return signedRequest("web", "new-secret", `{"id":7}`, testNow.Add(2*time.Minute))
+		}, "replay window"},
+		{"body too large", func() *http.Request { return signedRequest("web", "new-secret", strings.Repeat("x", 65), testNow) }, "body larger"},
+		{
+			name: "body changed after signing",
+			request: func() *http.Request {
+				request := signedRequest("web", "new-secret", `{"id":8}`, testNow)
+				request.Body = io.NopCloser(strings.NewReader(`{"id":9}`))
+				return request
+			},
+			wantErr: "does not match its digest",
+		},
+		{
+			name: "missing headers",
+			request: func() *http.Request {
+				request := signedRequest("web", "new-secret", `{"id":10}`, testNow)
+				request.Header.Del(TimestampHeader)
+				return request
+			},
+			wantErr: "requires the",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authenticator := newTestHMACAuthenticator()
+			identity, err := authenticator.Authenticate(tt.request())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Authenticate error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Authenticate error = %v", err)
+			}
+			if identity.ClientID != "web" || identity.Method != HMACMethod || identity.KeyID == "" {
+				t.Errorf("Identity = %+v, want client web authenticated by HMAC", identity)
+			}
+		})
+	}
+}
+
+func TestHMACAuthenticatorRejectsReplays(t *testing.T) {
+	authenticator := newTestHMACAuthenticator()
+	first := signedRequest("web", "new-secret", `{"id":1}`, testNow)
+	replay := signedRequest("web", "new-secret", `{"id":1}`, testNow)
+
+	if _, err := authenticator.Authenticate(first); err != nil {
+		t.Fatalf("first request: Authenticate error = %v", err)
+	}
+	if _, err := authenticator.Authenticate(replay); err == nil || !strings.Contains(err.Error(), "already used") {
+		t.Errorf("replay: Authenticate error = %v, want signature already used", err)
+	}
+}
+
+func TestHMACAuthenticatorKeepsTheBody(t *testing.T) {
+	authenticator := newTestHMACAuthenticator()
+	request := signedRequest("web", "new-secret", `{"id":1}`, testNow)
+	if _, err := authenticator.Authenticate(request); err != nil {
+		t.Fatalf("Authenticate error = %v", err)
+	}
+	body, _ := io.ReadAll(request.Body)
+	if string(body) != `{"id":1}` {
+		t.Errorf("body read by the handler = %q, want the signed body", body)
+	}
+}
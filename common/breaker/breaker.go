@@ -0,0 +1,242 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/microtest/common/telemetry"
+)
+
+// State of a circuit breaker
+type State string
+
+const (
+	// Calls go through, consecutive failures are counted
+	Closed State = "closed"
+
+	// Calls fail fast with ErrOpen until the open timeout elapsed
+	Open State = "open"
+
+	// A limited number of trial calls go through, they decide whether the breaker closes or opens again
+	HalfOpen State = "half-open"
+)
+
+// Default options
+const (
+	DefaultFailureThreshold = 5
+	DefaultSuccessThreshold = 1
+	DefaultOpenTimeout      = 30 * time.Second
+	DefaultHalfOpenMaxCalls = 1
+)
+
+// ErrOpen is returned, wrapped in an *OpenError, by calls rejected while the breaker is open
+var ErrOpen = errors.New("circuit breaker is open")
+
+// Logger for the breaker package
+var logger = telemetry.NewLogger("CircuitBreaker")
+
+// OpenError is returned by a call rejected by the breaker
+type OpenError struct {
+	// Name of the breaker
+	Name string
+
+	// Time until the breaker lets a trial call through
+	RetryAfter time.Duration
+}
+
+func (e *OpenError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Name, ErrOpen.Error())
+}
+
+func (e *OpenError) Unwrap() error { return ErrOpen }
+
+// Options of a circuit breaker, zero values use the defaults
+type Options struct {
+	// Consecutive failures that open the breaker
+	FailureThreshold int
+
+	// Consecutive successful trial calls that close the breaker again
+	SuccessThreshold int
+
+	// How long the breaker stays open before it lets trial calls through
+	OpenTimeout time.Duration
+
+	// Trial calls allowed at the same time while half-open
+	HalfOpenMaxCalls int
+
+	// Decides whether an error counts as a failure of the dependency. By default every error does,
+	// except a cancelled context.
+	IsFailure func(err error) bool
+}
+
+// Breaker stops calling a failing dependency so callers fail fast instead of waiting for timeouts.
+// After FailureThreshold consecutive failures it opens, after OpenTimeout it lets trial calls through,
+// and it closes after SuccessThreshold successful trials or opens again on the first failed one.
+type Breaker struct {
+	name string
+
+	mu        sync.Mutex
+	options   Options
+	state     State
+	failures  int
+	successes int
+	trials    int
+	openedAt  time.Time
+	now       func() time.Time
+
+	// Incremented on every transition, so results of calls allowed before it are recognized
+	generation int
+}
+
+// Creates a closed breaker
+func New(name string, options Options) *Breaker {
+	return &Breaker{name: name, options: withDefaults(options), state: Closed, now: time.Now}
+}
+
+// Fills the options left empty
+func withDefaults(options Options) Options {
+	if options.FailureThreshold <= 0 {
+		options.FailureThreshold = DefaultFailureThreshold
+	}
+	if options.SuccessThreshold <= 0 {
+		options.SuccessThreshold = DefaultSuccessThreshold
+	}
+	if options.OpenTimeout <= 0 {
+		options.OpenTimeout = DefaultOpenTimeout
+	}
+	if options.HalfOpenMaxCalls <= 0 {
+		options.HalfOpenMaxCalls = DefaultHalfOpenMaxCalls
+	}
+	if options.IsFailure == nil {
+		options.IsFailure = func(err error) bool { return !errors.Is(err, context.Canceled) }
+	}
+	return options
+}
+
+// Name of the breaker
+func (b *Breaker) Name() string {
+	return b.name
+}
+
+// SetOptions changes the thresholds and timeouts, it can be called at any time.
+// The current state and counters are kept.
+func (b *Breaker) SetOptions(options Options) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.options = withDefaults(options)
+}
+
+// State returns the current state, an open breaker whose timeout elapsed is reported half-open
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == Open && b.now().Sub(b.openedAt) >= b.options.OpenTimeout {
+		return HalfOpen
+	}
+	return b.state
+}
+
+// Execute runs fn unless the breaker is open, and records its result
+func (b *Breaker) Execute(fn func() error) error {
+	done, err := b.Allow()
+	if err != nil {
+		return err
+	}
+	err = fn()
+	done(err)
+	return err
+}
+
+// Allow asks to make a call. It returns an *OpenError if the breaker rejects it,
+// otherwise done must be called with the result of the call.
+func (b *Breaker) Allow() (done func(err error), err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == Open {
+		remaining := b.options.OpenTimeout - b.now().Sub(b.openedAt)
+		if remaining > 0 {
+			return nil, &OpenError{Name: b.name, RetryAfter: remaining}
+		}
+		b.transition(HalfOpen, nil)
+	}
+
+	if b.state == HalfOpen {
+		if b.trials >= b.options.HalfOpenMaxCalls {
+			return nil, &OpenError{Name: b.name}
+		}
+		b.trials++
+	}
+
+	generation := b.generation
+	var once sync.Once
+	return func(err error) {
+		once.Do(func() { b.record(generation, err) })
+	}, nil
+}
+
+// Records the result of a call allowed in the generation
+func (b *Breaker) record(generation int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	failed := err != nil && b.options.IsFailure(err)
+
+	// The result of a call allowed before the last transition does not count,
+	// except a failure while half-open that shows the dependency is still failing
+	if generation != b.generation {
+		if failed && b.state == HalfOpen {
+			b.transition(Open, err)
+		}
+		return
+	}
+	if b.state == HalfOpen {
+		b.trials--
+	}
+
+	switch b.state {
+	case Closed:
+		if !failed {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.options.FailureThreshold {
+			b.transition(Open, err)
+		}
+	case HalfOpen:
+		if failed {
+			b.transition(Open, err)
+			return
+		}
+		b.successes++
+		if b.successes >= b.options.SuccessThreshold {
+			b.transition(Closed, nil)
+		}
+	}
+}
+
+// Moves to the state and reports the transition in the logs and as a metric. Called with the lock held.
+func (b *Breaker) transition(state State, err error) {
+	previous := b.state
+	b.state = state
+	b.failures = 0
+	b.successes = 0
+	b.trials = 0
+	b.generation++
+	if state == Open {
+		b.openedAt = b.now()
+	}
+
+	ctx := context.Background()
+	switch state {
+	case Open:
+		logger.Warning(ctx, "Circuit breaker opened", "Breaker", b.name, "From", string(previous), "OpenTimeout", b.options.OpenTimeout.String(), "Error", err)
+	default:
+		logger.Info(ctx, "Circuit breaker "+string(state), "Breaker", b.name, "From", string(previous))
+	}
+	telemetry.TrackMetric("CircuitBreakerTransition", 1, map[string]string{"Breaker": b.name, "From": string(previous), "To": string(state)})
+}
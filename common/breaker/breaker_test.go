@@ -0,0 +1,185 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/microtest/common/telemetry"
+)
+
+var errDependency = errors.New("dependency failed")
+
+// Creates a breaker whose clock is moved by the test, its transitions are captured by the returned recorder
+func newTestBreaker(t *testing.T, options Options) (*Breaker, *time.Time, *telemetry.Recorder) {
+	t.Helper()
+	telemetry.SetLogOutput(io.Discard)
+	recorder := telemetry.InitTelemetryRecorder("test")
+	t.Cleanup(func() {
+		telemetry.Shutdown(context.Background())
+		telemetry.SetLogOutput(os.Stdout)
+	})
+
+	now := time.Unix(1000, 0)
+	b := New("test", options)
+	b.now = func() time.Time { return now }
+	return b, &now, recorder
+}
+
+func TestBreakerTransitions(t *testing.T) {
+	type step struct {
+		advance   time.Duration
+		err       error
+		wantOpen  bool
+		wantState State
+	}
+	tests := []struct {
+		name    string
+		options Options
+		steps   []step
+	}{
+		{
+			name:    "opens after consecutive failures",
+			options: Options{FailureThreshold: 2, OpenTimeout: time.Second},
+			steps: []step{
+				{0, errDependency, false, Closed},
+				{0, errDependency, false, Open},
+				{0, nil, true, Open},
+			},
+		},
+		{
+			name:    "a success resets the failures",
+			options: Options{FailureThreshold: 2, OpenTimeout: time.Second},
+			steps: []step{
+				{0, errDependency, false, Closed},
+				{0, nil, false, Closed},
+				{0, errDependency, false, Closed},
+			},
+		},
+		{
+			name:    "cancelled calls are not failures",
+			options: Options{FailureThreshold: 1, OpenTimeout: time.Second},
+			steps: []step{
+				{0, context.Canceled, false, Closed},
+			},
+		},
+		{
+			name:    "closes after successful trials",
+			options: Options{FailureThreshold: 1, SuccessThreshold: 2, OpenTimeout: time.Second},
+			steps: []step{
+				{0, errDependency, false, Open},
+				{time.Second, nil, false, HalfOpen},
+				{0, nil, false, Closed},
+			},
+		},
+		{
+			name:    "a failed trial opens again",
+			options: Options{FailureThreshold: 1, OpenTimeout: time.Second},
+			steps: []step{
+				{0, errDependency, false, Open},
+				{time.Second, errDependency, false, Open},
+				{500 * time.Millisecond, nil, true, Open},
+			},
+		},
+		{
+			name:    "custom failures",
+			options: Options{FailureThreshold: 1, IsFailure: func(err error) bool { return errors.Is(err, errDependency) }},
+			steps: []step{
+				{0, errors.New("not found"), false, Closed},
+				{0, errDependency, false, Open},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, now, _ := newTestBreaker(t, tt.options)
+			for i, s := range tt.steps {
+				*now = now.Add(s.advance)
+				called := false
+				err := b.Execute(func() error {
+					called = true
+					return s.err
+				})
+
+				var openErr *OpenError
+				if open := errors.As(err, &openErr); open != s.wantOpen || called == s.wantOpen {
+					t.Errorf("step %d: Execute error = %v, called = %t, want rejected %t", i, err, called, s.wantOpen)
+				}
+				if state := b.State(); state != s.wantState {
+					t.Errorf("step %d: State = %s, want %s", i, state, s.wantState)
+				}
+			}
+		})
+	}
+}
+
+func TestBreakerOpenError(t *testing.T) {
+	b, now, _ := newTestBreaker(t, Options{FailureThreshold: 1, OpenTimeout: 10 * time.Second})
+	b.Execute(func() error { return errDependency })
+	*now = now.Add(4 * time.Second)
+
+	_, err := b.Allow()
+	var openErr *OpenError
+	if !errors.As(err, &openErr) || !errors.Is(err, ErrOpen) {
+		t.Fatalf("Allow error = %v, want an *OpenError wrapping ErrOpen", err)
+	}
+	if openErr.Name != "test" || openErr.RetryAfter != 6*time.Second {
+		t.Errorf("OpenError = %+v, want breaker test retrying after 6s", openErr)
+	}
+}
+
+func TestBreakerLimitsTrialCalls(t *testing.T) {
+	b, now, _ := newTestBreaker(t, Options{FailureThreshold: 1, OpenTimeout: time.Second, HalfOpenMaxCalls: 1})
+	b.Execute(func() error { return errDependency })
+	*now = now.Add(time.Second)
+
+	done, err := b.Allow()
+	if err != nil {
+		t.Fatalf("trial call rejected: %v", err)
+	}
+	if _, err := b.Allow(); !errors.Is(err, ErrOpen) {
+		t.Errorf("second trial call error = %v, want ErrOpen", err)
+	}
+
+	// Calling done twice only counts once
+	done(nil)
+	done(errDependency)
+	if state := b.State(); state != Closed {
+		t.Errorf("State = %s, want closed", state)
+	}
+}
+
+func TestBreakerIgnoresResultsOfAnEarlierState(t *testing.T) {
+	b, _, _ := newTestBreaker(t, Options{FailureThreshold: 1, OpenTimeout: time.Second})
+
+	// A call allowed while closed that succeeds after the breaker opened does not close it
+	slow, _ := b.Allow()
+	b.Execute(func() error { return errDependency })
+	slow(nil)
+	if state := b.State(); state != Open {
+		t.Errorf("State = %s, want open", state)
+	}
+}
+
+func TestBreakerReportsTransitions(t *testing.T) {
+	b, now, recorder := newTestBreaker(t, Options{FailureThreshold: 1, OpenTimeout: time.Second})
+	b.Execute(func() error { return errDependency })
+	*now = now.Add(time.Second)
+	b.Execute(func() error { return nil })
+
+	want := []struct{ from, to State }{{Closed, Open}, {Open, HalfOpen}, {HalfOpen, Closed}}
+	metrics := recorder.Filter(func(record telemetry.Record) bool {
+		return record.Kind == telemetry.KindMetric && record.Name == "CircuitBreakerTransition"
+	})
+	if len(metrics) != len(want) {
+		t.Fatalf("got %d transition metrics, want %d", len(metrics), len(want))
+	}
+	for i, transition := range want {
+		if metrics[i].Properties["From"] != string(transition.from) || metrics[i].Properties["To"] != string(transition.to) {
+			t.Errorf("transition %d = %v, want %s to %s", i, metrics[i].Properties, transition.from, transition.to)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azappconfig"
+)
+
+// AppConfigProvider reads settings from Azure App Configuration
+type AppConfigProvider struct {
+	client *azappconfig.Client
+	label  string
+}
+
+// Creates an App Configuration provider from a connection string.
+// With a label (dev, staging, prod, ...), the labelled value of a key wins over the unlabelled one.
+func NewAppConfigProvider(connectionString, label string) (*AppConfigProvider, error) {
+	client, err := azappconfig.NewClientFromConnectionString(connectionString, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &AppConfigProvider{client: client, label: label}, nil
+}
+
+// Name of the provider
+func (p *AppConfigProvider) Name() string {
+	return "appconfig"
+}
+
+// Get returns the labelled setting for the key, falling back to the unlabelled one.
+// A key that does not exist in the store is not an error.
+func (p *AppConfigProvider) Get(ctx context.Context, key string) (Setting, bool, error) {
+	if p.label != "" {
+		setting, found, err := p.getSetting(ctx, key, &p.label)
+		if err != nil || found {
+			return setting, found, err
+		}
+	}
+	return p.getSetting(ctx, key, nil)
+}
+
+// Gets a single setting with the given label, nil means no label
+func (p *AppConfigProvider) getSetting(ctx context.Context, key string, label *string) (Setting, bool, error) {
+	resp, err := p.client.GetSetting(ctx, key, &azappconfig.GetSettingOptions{Label: label})
+	if err != nil {
+		var respErr *azcore.ResponseError
+		if errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound {
+			return Setting{}, false, nil
+		}
+		return Setting{}, false, err
+	}
+
+	return newSetting(resp.Setting, p.Name()), true, nil
+}
+
+// Converts an App Configuration setting
+func newSetting(setting azappconfig.Setting, source string) Setting {
+	result := Setting{Source: source}
+	if setting.Key != nil {
+		result.Key = *setting.Key
+	}
+	if setting.Value != nil {
+		result.Value = *setting.Value
+	}
+	if setting.Label != nil {
+		result.Label = *setting.Label
+	}
+	if setting.ContentType != nil {
+		result.ContentType = *setting.ContentType
+	}
+	return result
+}
@@ -0,0 +1,118 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azappconfig"
+)
+
+// App Configuration store serving settings by key and label, an empty label is the unlabelled value
+type fakeAppConfigStore struct {
+	mu       sync.Mutex
+	settings map[[2]string]string
+	failing  bool
+	requests []string
+}
+
+func (s *fakeAppConfigStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/kv/")
+	label := r.URL.Query().Get("label")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, key+"|"+label)
+	if s.failing {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	value, ok := s.settings[[2]string{key, label}]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.microsoft.appconfig.kv+json")
+	w.Header().Set("Sync-Token", "test=1;sn=1")
+	w.Header().Set("Last-Modified", "Mon, 01 Jan 2024 00:00:00 GMT")
+	body := map[string]interface{}{"key": key, "value": value}
+	if label != "" {
+		body["label"] = label
+	}
+	json.NewEncoder(w).Encode(body)
+}
+
+// Creates a provider reading the fake store with the label, without retries
+func newTestAppConfigProvider(t *testing.T, store *fakeAppConfigStore, label string) *AppConfigProvider {
+	t.Helper()
+	server := httptest.NewServer(store)
+	t.Cleanup(server.Close)
+
+	connectionString := "Endpoint=" + server.URL + ";Id=test;Secret=c2VjcmV0"
+	client, err := azappconfig.NewClientFromConnectionString(connectionString, &azappconfig.ClientOptions{
+		ClientOptions: azcore.ClientOptions{Retry: policy.RetryOptions{MaxRetries: -1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &AppConfigProvider{client: client, label: label}
+}
+
+func TestAppConfigProviderLabelFallback(t *testing.T) {
+	store := &fakeAppConfigStore{settings: map[[2]string]string{
+		{"NAME", ""}:     "orders",
+		{"NAME", "prod"}: "orders-prod",
+		{"PORT", ""}:     "8080",
+		{"MODE", "prod"}: "fast",
+	}}
+	tests := []struct {
+		name      string
+		label     string
+		key       string
+		wantValue string
+		wantLabel string
+		wantFound bool
+	}{
+		{"labelled value wins", "prod", "NAME", "orders-prod", "prod", true},
+		{"unlabelled value without a labelled one", "prod", "PORT", "8080", "", true},
+		{"only labelled value", "prod", "MODE", "fast", "prod", true},
+		{"other label falls back to the unlabelled value", "staging", "NAME", "orders", "", true},
+		{"no label reads the unlabelled value", "", "NAME", "orders", "", true},
+		{"labelled value ignored without a label", "", "MODE", "", "", false},
+		{"missing key is not an error", "prod", "MISSING", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := newTestAppConfigProvider(t, store, tt.label)
+			setting, found, err := provider.Get(context.Background(), tt.key)
+			if err != nil || found != tt.wantFound {
+				t.Fatalf("Get = %+v, %t, %v, want found %t", setting, found, err, tt.wantFound)
+			}
+			if setting.Value != tt.wantValue || setting.Label != tt.wantLabel {
+				t.Errorf("Get = %q with label %q, want %q with label %q", setting.Value, setting.Label, tt.wantValue, tt.wantLabel)
+			}
+			if found && setting.Source != "appconfig" {
+				t.Errorf("Source = %q, want appconfig", setting.Source)
+			}
+		})
+	}
+}
+
+func TestAppConfigProviderErrors(t *testing.T) {
+	store := &fakeAppConfigStore{failing: true}
+	provider := newTestAppConfigProvider(t, store, "prod")
+	if _, found, err := provider.Get(context.Background(), "NAME"); err == nil || found {
+		t.Errorf("Get = %t, %v, want an error", found, err)
+	}
+
+	// A failure of the labelled lookup is returned, the unlabelled value is not read instead
+	if len(store.requests) != 1 || store.requests[0] != "NAME|prod" {
+		t.Errorf("requests %v, want only the labelled lookup", store.requests)
+	}
+}
@@ -0,0 +1,196 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/microtest/common/telemetry"
+)
+
+// BindError lists every key that is missing or has an invalid value
+type BindError struct {
+	Problems []string
+}
+
+func (e *BindError) Error() string {
+	return fmt.Sprintf("invalid configuration (%d problem(s)): %s", len(e.Problems), strings.Join(e.Problems, "; "))
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Bind fills the fields of the struct pointed to by target from the configuration providers.
+// Fields are described with tags:
+//
+//	config:"KEY"       key to look up, fields without it are skipped (nested structs are bound recursively)
+//	default:"value"    value used when no provider has the key
+//	required:"true"    the key must have a non empty value
+//	secret:"true"      the value is masked in logs and telemetry
+//
+// Supported types are string, bool, ints, uints, floats, time.Duration and []string (comma separated).
+// Every problem is collected and returned in a single *BindError.
+func Bind(ctx context.Context, target interface{}) error {
+	value := reflect.ValueOf(target)
+	if value.Kind() != reflect.Pointer || value.Elem().Kind() != reflect.Struct {
+		return errors.New("config: Bind target must be a pointer to a struct")
+	}
+
+	bindErr := &BindError{}
+	bindStruct(ctx, value.Elem(), bindErr)
+	if len(bindErr.Problems) > 0 {
+		logger.Error(ctx, "Invalid configuration", "Error", bindErr)
+		return bindErr
+	}
+	return nil
+}
+
+// Binds every tagged field of the struct
+func bindStruct(ctx context.Context, value reflect.Value, bindErr *BindError) {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		key, ok := field.Tag.Lookup("config")
+		if !ok {
+			if field.Type.Kind() == reflect.Struct && field.Type != durationType {
+				bindStruct(ctx, value.Field(i), bindErr)
+			}
+			continue
+		}
+
+		// Secrets are marked before the lookup, so they are never written to the configuration snapshot
+		if field.Tag.Get("secret") == "true" {
+			markSecret(key)
+		}
+
+		// Look up the key, a key that is not found is not a problem by itself
+		raw, found := field.Tag.Lookup("default")
+		setting, err := GetSetting(ctx, key)
+		switch {
+		case err == nil:
+			raw, found = setting.Value, true
+		case !errors.Is(err, ErrKeyNotFound):
+			bindErr.Problems = append(bindErr.Problems, fmt.Sprintf("%s: %s", key, err.Error()))
+			continue
+		case found:
+			recordDefault(key, raw)
+		}
+
+		if raw == "" {
+			if field.Tag.Get("required") == "true" {
+				bindErr.Problems = append(bindErr.Problems, fmt.Sprintf("%s: required", key))
+			}
+			if !found {
+				continue
+			}
+		}
+
+		if field.Tag.Get("secret") == "true" {
+			telemetry.RegisterSecret(raw)
+		}
+		if err := setField(value.Field(i), raw); err != nil {
+			bindErr.Problems = append(bindErr.Problems, fmt.Sprintf("%s: invalid value: %s", key, err.Error()))
+		}
+	}
+}
+
+// Parses the raw value into the field
+func setField(field reflect.Value, raw string) error {
+	raw = strings.TrimSpace(raw)
+
+	// An empty value sets the zero value
+	if raw == "" {
+		field.Set(reflect.Zero(field.Type()))
+		return nil
+	}
+
+	if field.Type() == durationType {
+		duration, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(duration))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Bool:
+		v, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		field.SetBool(v)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v, err := strconv.ParseInt(raw, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(v)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v, err := strconv.ParseUint(raw, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(v)
+	case reflect.Float32, reflect.Float64:
+		v, err := strconv.ParseFloat(raw, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetFloat(v)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", field.Type())
+		}
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items).Convert(field.Type()))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+// LogFields returns the bound values of the struct as key/value pairs for the logger, secrets are masked
+func LogFields(target interface{}) []interface{} {
+	value := reflect.Indirect(reflect.ValueOf(target))
+	if value.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var fields []interface{}
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		key, ok := field.Tag.Lookup("config")
+		if !ok {
+			if field.Type.Kind() == reflect.Struct && field.Type != durationType {
+				fields = append(fields, LogFields(value.Field(i).Interface())...)
+			}
+			continue
+		}
+
+		var v interface{} = value.Field(i).Interface()
+		if field.Tag.Get("secret") == "true" {
+			v = telemetry.RedactedMask
+		} else if d, ok := v.(time.Duration); ok {
+			v = d.String()
+		}
+		fields = append(fields, key, v)
+	}
+	return fields
+}
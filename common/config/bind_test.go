@@ -0,0 +1,165 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/microtest/common/telemetry"
+)
+
+// Provider that serves the settings of a map
+type mapProvider map[string]string
+
+func (p mapProvider) Name() string { return "Test" }
+
+func (p mapProvider) Get(ctx context.Context, key string) (Setting, bool, error) {
+	value, ok := p[key]
+	return Setting{Key: key, Value: value, Source: p.Name()}, ok, nil
+}
+
+// Serves the settings for the duration of the test
+func useSettings(t *testing.T, settings map[string]string) {
+	t.Helper()
+	telemetry.SetLogOutput(io.Discard)
+	SetProviders(mapProvider(settings))
+	t.Cleanup(func() {
+		activeProviders.Store(nil)
+		telemetry.SetLogOutput(os.Stdout)
+	})
+}
+
+type testRetry struct {
+	Attempts int           `config:"RETRY_ATTEMPTS" default:"3"`
+	Delay    time.Duration `config:"RETRY_DELAY" default:"1s"`
+}
+
+type testSettings struct {
+	Name     string   `config:"NAME" required:"true"`
+	Port     int      `config:"PORT" default:"8080"`
+	Enabled  bool     `config:"ENABLED" default:"false"`
+	Ratio    float64  `config:"RATIO" default:"0.5"`
+	Workers  uint8    `config:"WORKERS" default:"4"`
+	Hosts    []string `config:"HOSTS"`
+	Password string   `config:"PASSWORD" secret:"true"`
+	Retry    testRetry
+	ignored  string
+}
+
+func TestBind(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings map[string]string
+		want     testSettings
+		problems []string
+	}{
+		{
+			name:     "defaults",
+			settings: map[string]string{"NAME": "publisher"},
+			want:     testSettings{Name: "publisher", Port: 8080, Ratio: 0.5, Workers: 4, Retry: testRetry{Attempts: 3, Delay: time.Second}},
+		},
+		{
+			name: "values from the provider",
+			settings: map[string]string{
+				"NAME": "consumer", "PORT": "9090", "ENABLED": "true", "RATIO": "0.25", "WORKERS": "8",
+				"HOSTS": " a, b ,,c ", "PASSWORD": "s3cret", "RETRY_ATTEMPTS": "5", "RETRY_DELAY": "250ms",
+			},
+			want: testSettings{
+				Name: "consumer", Port: 9090, Enabled: true, Ratio: 0.25, Workers: 8,
+				Hosts: []string{"a", "b", "c"}, Password: "s3cret", Retry: testRetry{Attempts: 5, Delay: 250 * time.Millisecond},
+			},
+		},
+		{
+			name:     "empty value sets the zero value",
+			settings: map[string]string{"NAME": "publisher", "PORT": ""},
+			want:     testSettings{Name: "publisher", Ratio: 0.5, Workers: 4, Retry: testRetry{Attempts: 3, Delay: time.Second}},
+		},
+		{
+			name:     "missing required key",
+			settings: map[string]string{},
+			problems: []string{"NAME: required"},
+		},
+		{
+			name:     "every invalid value is reported",
+			settings: map[string]string{"NAME": "publisher", "PORT": "http", "ENABLED": "maybe", "WORKERS": "300", "RETRY_DELAY": "soon"},
+			problems: []string{"PORT: invalid value", "ENABLED: invalid value", "WORKERS: invalid value", "RETRY_DELAY: invalid value"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useSettings(t, tt.settings)
+
+			var got testSettings
+			err := Bind(context.Background(), &got)
+			if len(tt.problems) == 0 {
+				if err != nil {
+					t.Fatalf("Bind error = %v", err)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("Bind = %+v, want %+v", got, tt.want)
+				}
+				return
+			}
+
+			var bindErr *BindError
+			if !errors.As(err, &bindErr) {
+				t.Fatalf("Bind error = %v, want a *BindError", err)
+			}
+			if len(bindErr.Problems) != len(tt.problems) {
+				t.Fatalf("got problems %q, want %q", bindErr.Problems, tt.problems)
+			}
+			for i, problem := range tt.problems {
+				if !strings.HasPrefix(bindErr.Problems[i], problem) {
+					t.Errorf("problem %d = %q, want prefix %q", i, bindErr.Problems[i], problem)
+				}
+			}
+		})
+	}
+}
+
+func TestBindRejectsInvalidTargets(t *testing.T) {
+	useSettings(t, nil)
+	var settings testSettings
+	tests := []struct {
+		name   string
+		target interface{}
+	}{
+		{"struct value", settings},
+		{"pointer to a non struct", new(string)},
+		{"nil", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Bind(context.Background(), tt.target); err == nil {
+				t.Error("Bind succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestLogFieldsMasksSecrets(t *testing.T) {
+	settings := testSettings{Name: "publisher", Port: 8080, Password: "s3cret", Retry: testRetry{Attempts: 3, Delay: time.Second}}
+	fields := LogFields(&settings)
+
+	got := map[string]interface{}{}
+	for i := 0; i+1 < len(fields); i += 2 {
+		got[fields[i].(string)] = fields[i+1]
+	}
+	want := map[string]interface{}{
+		"NAME":           "publisher",
+		"PORT":           8080,
+		"PASSWORD":       telemetry.RedactedMask,
+		"RETRY_ATTEMPTS": 3,
+		"RETRY_DELAY":    "1s",
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%s = %v, want %v", key, got[key], value)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/microtest/common/breaker"
+)
+
+// Default timeout of a single lookup in a remote store, and how long its settings are cached
+const (
+	DefaultLookupTimeout = 5 * time.Second
+	DefaultCacheTTL      = 5 * time.Minute
+)
+
+// Context key that makes lookups skip the cache
+type bypassCacheKey struct{}
+
+// Returns a context whose lookups always go to the remote store, used by refresh so changes are seen
+func withoutCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, bypassCacheKey{}, true)
+}
+
+// CachingOptions controls how a remote provider is cached
+type CachingOptions struct {
+	// Maximum duration of a lookup in the remote store
+	Timeout time.Duration
+
+	// How long a setting is served from memory before it is looked up again
+	TTL time.Duration
+
+	// File that keeps the last-known-good settings, used when the remote store cannot be reached.
+	// Secrets are left out and Key Vault references are kept unresolved. No snapshot is kept when empty.
+	SnapshotPath string
+
+	// Stops looking up the remote store while it is failing, lookups then fall back to the last value seen at once.
+	// No breaker when nil.
+	Breaker *breaker.Breaker
+}
+
+// CachingProvider wraps a remote provider with a lookup timeout, an in-memory cache and a last-known-good snapshot on disk.
+// When the remote store fails, the last value seen is returned instead, from memory or from the snapshot.
+type CachingProvider struct {
+	inner   Provider
+	options CachingOptions
+
+	mu       sync.Mutex
+	cache    map[string]cacheEntry
+	snapshot map[string]snapshotEntry
+	offline  bool
+	lastErr  error
+}
+
+// Cached result of a lookup, a key that was not found is cached too
+type cacheEntry struct {
+	setting Setting
+	found   bool
+	expires time.Time
+}
+
+// Result of a lookup as written in the snapshot file
+type snapshotEntry struct {
+	Setting Setting `json:"setting"`
+	Found   bool    `json:"found"`
+}
+
+// Creates a caching provider, the snapshot is loaded when the file exists
+func NewCachingProvider(inner Provider, options CachingOptions) *CachingProvider {
+	if options.Timeout <= 0 {
+		options.Timeout = DefaultLookupTimeout
+	}
+	if options.TTL <= 0 {
+		options.TTL = DefaultCacheTTL
+	}
+
+	p := &CachingProvider{inner: inner, options: options, cache: map[string]cacheEntry{}, snapshot: map[string]snapshotEntry{}}
+	if options.SnapshotPath != "" {
+		data, err := os.ReadFile(options.SnapshotPath)
+		switch {
+		case err == nil:
+			if err := json.Unmarshal(data, &p.snapshot); err != nil {
+				logger.Warning(context.Background(), "Ignoring invalid configuration snapshot", "Path", options.SnapshotPath, "Error", err)
+			}
+		case !errors.Is(err, os.ErrNotExist):
+			logger.Warning(context.Background(), "Failed to read configuration snapshot", "Path", options.SnapshotPath, "Error", err)
+		}
+	}
+	return p
+}
+
+// Name of the wrapped provider
+func (p *CachingProvider) Name() string {
+	return p.inner.Name()
+}
+
+// Get returns the cached setting while it is fresh, otherwise looks it up in the remote store with a timeout.
+// If the remote store fails, the last value seen is returned and a warning is logged once until the store is back.
+func (p *CachingProvider) Get(ctx context.Context, key string) (Setting, bool, error) {
+	bypass, _ := ctx.Value(bypassCacheKey{}).(bool)
+
+	p.mu.Lock()
+	entry, cached := p.cache[key]
+	p.mu.Unlock()
+	if cached && !bypass && time.Now().Before(entry.expires) {
+		return entry.setting, entry.found, nil
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, p.options.Timeout)
+	defer cancel()
+	var setting Setting
+	var found bool
+	err := p.execute(func() (err error) {
+		setting, found, err = p.inner.Get(lookupCtx, key)
+		return err
+	})
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastErr = err
+	if err != nil {
+		return p.fallback(ctx, key, err)
+	}
+
+	if p.offline {
+		p.offline = false
+		logger.Info(ctx, "Remote configuration store reachable again", "Provider", p.Name())
+	}
+	p.cache[key] = cacheEntry{setting: setting, found: found, expires: time.Now().Add(p.options.TTL)}
+	p.saveSnapshot(ctx, key, snapshotEntry{Setting: setting, Found: found})
+	return setting, found, nil
+}
+
+// Runs a lookup in the remote store through the circuit breaker, if there is one
+func (p *CachingProvider) execute(fn func() error) error {
+	if p.options.Breaker == nil {
+		return fn()
+	}
+	return p.options.Breaker.Execute(fn)
+}
+
+// Returns the last value seen for the key after a failed lookup, or the error if there is none. Called with the lock held.
+func (p *CachingProvider) fallback(ctx context.Context, key string, err error) (Setting, bool, error) {
+	setting, found, ok := Setting{}, false, false
+	if entry, cached := p.cache[key]; cached {
+		setting, found, ok = entry.setting, entry.found, true
+	} else if entry, saved := p.snapshot[key]; saved {
+		setting, found, ok = entry.Setting, entry.Found, true
+	}
+	if !ok {
+		return Setting{}, false, err
+	}
+
+	if !p.offline {
+		p.offline = true
+		logger.Warning(ctx, "Remote configuration store unreachable, using last-known-good values", "Provider", p.Name(), "Snapshot", p.options.SnapshotPath, "Error", err)
+	}
+	return setting, found, nil
+}
+
+// Writes the snapshot when the entry changed, a secret key is removed from it instead. Called with the lock held.
+// Settings are saved as the remote store returns them, so Key Vault references are saved but not their secret.
+func (p *CachingProvider) saveSnapshot(ctx context.Context, key string, entry snapshotEntry) {
+	if p.options.SnapshotPath == "" {
+		return
+	}
+	previous, saved := p.snapshot[key]
+	if isSecretKey(key) {
+		if !saved {
+			return
+		}
+		delete(p.snapshot, key)
+	} else {
+		if saved && previous == entry {
+			return
+		}
+		p.snapshot[key] = entry
+	}
+
+	data, err := json.MarshalIndent(p.snapshot, "", "  ")
+	if err == nil {
+		// Write to a temporary file first so a crash never leaves a truncated snapshot
+		tmp := p.options.SnapshotPath + ".tmp"
+		if err = os.MkdirAll(filepath.Dir(p.options.SnapshotPath), 0o700); err == nil {
+			if err = os.WriteFile(tmp, data, 0o600); err == nil {
+				err = os.Rename(tmp, p.options.SnapshotPath)
+			}
+		}
+	}
+	if err != nil {
+		logger.Warning(ctx, "Failed to write configuration snapshot", "Path", p.options.SnapshotPath, "Error", err)
+	}
+}
+
+// Err returns the error of the last lookup in the remote store, nil if it succeeded
+func (p *CachingProvider) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastErr
+}
+
+// Invalidate drops the cached settings, the next lookups go to the remote store
+func (p *CachingProvider) Invalidate() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, entry := range p.cache {
+		entry.expires = time.Time{}
+		p.cache[key] = entry
+	}
+}
+
+// Refresh reloads the wrapped provider when it supports it
+func (p *CachingProvider) Refresh(ctx context.Context) (bool, error) {
+	if refresher, ok := p.inner.(Refresher); ok {
+		return refresher.Refresh(ctx)
+	}
+	return false, nil
+}
@@ -0,0 +1,219 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/microtest/common/telemetry"
+)
+
+// Remote store whose settings, failures and latency change during the test
+type fakeRemoteStore struct {
+	mu       sync.Mutex
+	settings map[string]string
+	err      error
+	delay    time.Duration
+	lookups  int
+}
+
+func (s *fakeRemoteStore) Name() string { return "Remote" }
+
+func (s *fakeRemoteStore) Get(ctx context.Context, key string) (Setting, bool, error) {
+	s.mu.Lock()
+	s.lookups++
+	value, ok := s.settings[key]
+	err, delay := s.err, s.delay
+	s.mu.Unlock()
+
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+		return Setting{}, false, ctx.Err()
+	}
+	if err != nil {
+		return Setting{}, false, err
+	}
+	return Setting{Key: key, Value: value, Source: s.Name()}, ok, nil
+}
+
+func (s *fakeRemoteStore) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+func (s *fakeRemoteStore) lookupCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lookups
+}
+
+// Logs nothing for the duration of the test
+func discardLogs(t *testing.T) {
+	telemetry.SetLogOutput(io.Discard)
+	t.Cleanup(func() { telemetry.SetLogOutput(os.Stdout) })
+}
+
+func TestCachingProviderTTL(t *testing.T) {
+	discardLogs(t)
+	ctx := context.Background()
+	store := &fakeRemoteStore{settings: map[string]string{"NAME": "orders"}}
+	provider := NewCachingProvider(store, CachingOptions{TTL: 50 * time.Millisecond})
+
+	for i := 0; i < 3; i++ {
+		if setting, found, err := provider.Get(ctx, "NAME"); err != nil || !found || setting.Value != "orders" {
+			t.Fatalf("Get = %+v, %t, %v, want orders", setting, found, err)
+		}
+		provider.Get(ctx, "MISSING")
+	}
+	if got := store.lookupCount(); got != 2 {
+		t.Errorf("store looked up %d times, want 2 while the settings are cached", got)
+	}
+
+	// Refresh reads go to the store
+	store.settings["NAME"] = "payments"
+	if setting, _, _ := provider.Get(withoutCache(ctx), "NAME"); setting.Value != "payments" {
+		t.Errorf("Get without cache = %q, want the value in the store", setting.Value)
+	}
+
+	store.settings["NAME"] = "shipping"
+	provider.Invalidate()
+	if setting, _, _ := provider.Get(ctx, "NAME"); setting.Value != "shipping" {
+		t.Errorf("Get after Invalidate = %q, want the value in the store", setting.Value)
+	}
+
+	store.settings["NAME"] = "billing"
+	time.Sleep(60 * time.Millisecond)
+	if setting, _, _ := provider.Get(ctx, "NAME"); setting.Value != "billing" {
+		t.Errorf("Get after the TTL = %q, want the value in the store", setting.Value)
+	}
+}
+
+func TestCachingProviderTimeout(t *testing.T) {
+	discardLogs(t)
+	store := &fakeRemoteStore{settings: map[string]string{"NAME": "orders"}, delay: time.Second}
+	provider := NewCachingProvider(store, CachingOptions{Timeout: 20 * time.Millisecond})
+
+	start := time.Now()
+	_, _, err := provider.Get(context.Background(), "NAME")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Get = %v, want the lookup timed out", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Get took %v, want it stopped at the timeout", elapsed)
+	}
+	if provider.Err() == nil {
+		t.Error("Err = nil after a lookup timed out")
+	}
+}
+
+func TestCachingProviderLastKnownGood(t *testing.T) {
+	discardLogs(t)
+	ctx := context.Background()
+	store := &fakeRemoteStore{settings: map[string]string{"NAME": "orders"}}
+	provider := NewCachingProvider(store, CachingOptions{})
+	provider.Get(ctx, "NAME")
+
+	outage := errors.New("store unreachable")
+	store.fail(outage)
+	if setting, found, err := provider.Get(withoutCache(ctx), "NAME"); err != nil || !found || setting.Value != "orders" {
+		t.Errorf("Get during an outage = %+v, %t, %v, want the last value seen", setting, found, err)
+	}
+	if _, _, err := provider.Get(ctx, "NEVER_SEEN"); !errors.Is(err, outage) {
+		t.Errorf("Get of a key never seen = %v, want the store error", err)
+	}
+	if err := provider.Err(); !errors.Is(err, outage) {
+		t.Errorf("Err = %v, want the store error", err)
+	}
+
+	store.fail(nil)
+	provider.Get(withoutCache(ctx), "NAME")
+	if err := provider.Err(); err != nil {
+		t.Errorf("Err = %v once the store is back, want nil", err)
+	}
+}
+
+func TestCachingProviderSnapshot(t *testing.T) {
+	discardLogs(t)
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "snapshot", "config.json")
+	reference := "@Microsoft.KeyVault(SecretUri=https://vault.vault.azure.net/secrets/db)"
+	store := &fakeRemoteStore{settings: map[string]string{
+		"NAME":           "orders",
+		"HMAC_SECRETS":   "hmac-value",
+		"PUBLISHER_KEYS": "key-value",
+		"DATABASE_URL":   reference,
+	}}
+	markSecret("PUBLISHER_KEYS")
+	t.Cleanup(func() {
+		effectiveMu.Lock()
+		defer effectiveMu.Unlock()
+		delete(secretKeys, "PUBLISHER_KEYS")
+	})
+
+	provider := NewCachingProvider(store, CachingOptions{SnapshotPath: path})
+	for key := range store.settings {
+		provider.Get(ctx, key)
+	}
+	provider.Get(ctx, "MISSING")
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"hmac-value", "key-value", "HMAC_SECRETS", "PUBLISHER_KEYS"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("snapshot contains %q, want secrets left out:\n%s", secret, data)
+		}
+	}
+
+	// A new instance that cannot reach the store starts from the snapshot
+	store.fail(errors.New("store unreachable"))
+	restarted := NewCachingProvider(store, CachingOptions{SnapshotPath: path})
+	tests := []struct {
+		key       string
+		wantValue string
+		wantFound bool
+		wantErr   bool
+	}{
+		{"NAME", "orders", true, false},
+		{"DATABASE_URL", reference, true, false},
+		{"MISSING", "", false, false},
+		{"HMAC_SECRETS", "", false, true},
+		{"PUBLISHER_KEYS", "", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			setting, found, err := restarted.Get(ctx, tt.key)
+			if (err != nil) != tt.wantErr || found != tt.wantFound || setting.Value != tt.wantValue {
+				t.Errorf("Get = %+v, %t, %v, want %q, %t, error %t", setting, found, err, tt.wantValue, tt.wantFound, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCachingProviderRemovesSecretsFromOldSnapshot(t *testing.T) {
+	discardLogs(t)
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"HMAC_SECRETS": {"setting": {"key": "HMAC_SECRETS", "value": "hmac-value"}, "found": true}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	store := &fakeRemoteStore{settings: map[string]string{"HMAC_SECRETS": "hmac-value"}}
+	provider := NewCachingProvider(store, CachingOptions{SnapshotPath: path})
+	provider.Get(context.Background(), "HMAC_SECRETS")
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "hmac-value") {
+		t.Errorf("snapshot = %s, want the secret removed", data)
+	}
+}
@@ -3,52 +3,250 @@ package config
 import (
 	"context"
 	"errors"
-	"log"
+	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/microtest/common/breaker"
 	"github.com/microtest/common/telemetry"
-
-	"github.com/Azure/azure-sdk-for-go/sdk/data/azappconfig"
 )
 
-var client *azappconfig.Client
+// Providers used when CONFIG_PROVIDERS is not set, in order of precedence
+const defaultProviders = "env,file,appconfig"
+
+// Chain of providers used by GetVar. It is replaced by InitializeConfig while the refresh goroutine
+// and request handlers read it, so it is only accessed through currentProviders and the setters below.
+var activeProviders atomic.Pointer[Chain]
+
+// Serializes the setters, which build the new chain from the current one
+var providersMu sync.Mutex
 
-// Initialize the App Configuration client
+// Environment profile selected by CONFIG_LABEL, guarded by effectiveMu
+var profile string
+
+// Logger for the config package
+var logger = telemetry.NewLogger("Config")
+
+// Initialize the configuration providers.
+// CONFIG_PROVIDERS sets the providers and their precedence (default env,file,appconfig):
+// env reads environment variables, file reads CONFIG_FILE (JSON or YAML) and appconfig reads
+// Azure App Configuration using APPCONFIGURATION_CONNECTION_STRING.
+// A provider that is not listed explicitly is skipped when its setting is missing.
+// App Configuration lookups time out after CONFIG_LOOKUP_TIMEOUT, are cached for CONFIG_CACHE_TTL and
+// fall back to the last-known-good values kept in CONFIG_SNAPSHOT_FILE when the store cannot be reached.
+// CONFIG_LABEL selects the environment profile (dev, staging, prod, ...): the App Configuration label
+// and the profile file next to CONFIG_FILE.
 func InitializeConfig() error {
-	connectionString := os.Getenv("APPCONFIGURATION_CONNECTION_STRING")
-	if connectionString == "" {
-		log.Println("Error: APPCONFIGURATION_CONNECTION_STRING environment variable is not set")
-		err := errors.New("app configuration environment variable is not set")
-		telemetry.TrackException(err, telemetry.Error, map[string]string{"Error": err.Error(), "Message": "APPCONFIGURATION_CONNECTION_STRING environment variable is not set"})
-		return err
+	ctx := context.Background()
+	label := os.Getenv("CONFIG_LABEL")
+	names, explicit := os.LookupEnv("CONFIG_PROVIDERS")
+	if !explicit {
+		names = defaultProviders
 	}
 
-	var err error
-	client, err = azappconfig.NewClientFromConnectionString(connectionString, nil)
+	var chain []Provider
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch name {
+		case "":
+			continue
+		case "env":
+			chain = append(chain, NewEnvProvider(""))
+		case "file":
+			path := os.Getenv("CONFIG_FILE")
+			if path == "" {
+				if explicit {
+					err := errors.New("file configuration provider requires CONFIG_FILE")
+					logger.Error(ctx, "CONFIG_FILE environment variable is not set", "Error", err)
+					return err
+				}
+				continue
+			}
+			provider, err := NewFileProvider(path, label)
+			if err != nil {
+				logger.Error(ctx, "Failed to read configuration file", "Path", path, "Error", err)
+				return err
+			}
+			chain = append(chain, provider)
+		case "appconfig":
+			connectionString := os.Getenv("APPCONFIGURATION_CONNECTION_STRING")
+			if connectionString == "" {
+				if explicit {
+					err := errors.New("app configuration environment variable is not set")
+					logger.Error(ctx, "APPCONFIGURATION_CONNECTION_STRING environment variable is not set", "Error", err)
+					return err
+				}
+				logger.Warning(ctx, "APPCONFIGURATION_CONNECTION_STRING is not set, App Configuration is not used")
+				continue
+			}
+			provider, err := NewAppConfigProvider(connectionString, label)
+			if err != nil {
+				logger.Error(ctx, "Failed to create new App Configuration client", "Error", err)
+				return err
+			}
+			options, err := cachingOptionsFromEnv()
+			if err != nil {
+				logger.Error(ctx, "Invalid configuration cache settings", "Error", err)
+				return err
+			}
+			chain = append(chain, NewCachingProvider(provider, options))
+		default:
+			err := fmt.Errorf("unknown configuration provider %q", name)
+			logger.Error(ctx, "Unknown configuration provider", "Provider", name, "Error", err)
+			return err
+		}
+	}
+
+	// Key Vault references are resolved with the resolver selected by SECRET_RESOLVER
+	resolver, err := secretResolverFromEnv()
 	if err != nil {
-		log.Println("Error: Failed to create new App Configuration client")
-		telemetry.TrackException(err, telemetry.Error, map[string]string{"Error": err.Error(), "Message": "Failed to create new App Configuration client"})
+		logger.Error(ctx, "Failed to create secret resolver", "Error", err)
 		return err
 	}
+	SetSecretResolver(resolver)
 
+	SetProviders(chain...)
+	effectiveMu.Lock()
+	profile = label
+	effectiveMu.Unlock()
+	logger.Info(ctx, "Configuration profile selected", "Label", label)
 	return nil
 }
 
+// Reads CONFIG_LOOKUP_TIMEOUT, CONFIG_CACHE_TTL, CONFIG_SNAPSHOT_FILE and the circuit breaker options
+// CONFIG_BREAKER_FAILURES and CONFIG_BREAKER_OPEN_TIMEOUT
+func cachingOptionsFromEnv() (CachingOptions, error) {
+	options := CachingOptions{SnapshotPath: os.Getenv("CONFIG_SNAPSHOT_FILE")}
+	var breakerOptions breaker.Options
+	durations := map[string]*time.Duration{
+		"CONFIG_LOOKUP_TIMEOUT":       &options.Timeout,
+		"CONFIG_CACHE_TTL":            &options.TTL,
+		"CONFIG_BREAKER_OPEN_TIMEOUT": &breakerOptions.OpenTimeout,
+	}
+	for name, target := range durations {
+		if value := os.Getenv(name); value != "" {
+			duration, err := time.ParseDuration(value)
+			if err != nil {
+				return options, fmt.Errorf("invalid %s: %w", name, err)
+			}
+			*target = duration
+		}
+	}
+	if value := os.Getenv("CONFIG_BREAKER_FAILURES"); value != "" {
+		failures, err := strconv.Atoi(value)
+		if err != nil {
+			return options, fmt.Errorf("invalid CONFIG_BREAKER_FAILURES: %w", err)
+		}
+		breakerOptions.FailureThreshold = failures
+	}
+	options.Breaker = breaker.New("appconfig", breakerOptions)
+	return options, nil
+}
+
+// Returns the chain of providers used by GetVar, nil when the configuration is not initialized
+func currentProviders() *Chain {
+	return activeProviders.Load()
+}
+
+// SetProviders replaces the providers used by GetVar, in order of precedence
+func SetProviders(chain ...Provider) {
+	providersMu.Lock()
+	next := NewChain(chain...)
+	if current := currentProviders(); current != nil {
+		next.SetPrefix(current.prefix)
+	}
+	activeProviders.Store(next)
+	providersMu.Unlock()
+
+	names := make([]string, 0, len(chain))
+	for _, provider := range chain {
+		names = append(names, provider.Name())
+	}
+	logger.Info(context.Background(), "Configuration providers initialized", "Providers", strings.Join(names, ","))
+}
+
+// SetKeyPrefix namespaces the keys of a service (e.g. "publisher:"), the prefixed key wins over the plain one in each provider
+func SetKeyPrefix(prefix string) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+
+	// The current chain may be in use, a copy gets the prefix
+	next := NewChain()
+	if current := currentProviders(); current != nil {
+		next = NewChain(current.providers...)
+	}
+	next.SetPrefix(prefix)
+	activeProviders.Store(next)
+}
+
 // GetVar retrieves a configuration setting by key
 func GetVar(key string) (string, error) {
-	if client == nil {
-		err := errors.New("app configuration client not initialized")
-		telemetry.TrackException(err, telemetry.Error, map[string]string{"Error": err.Error(), "Message": "Failed to create new event hub instance"})
+	return GetVarCtx(context.TODO(), key)
+}
+
+// GetVarCtx retrieves a configuration setting by key from the first provider that has it
+func GetVarCtx(ctx context.Context, key string) (string, error) {
+	setting, err := GetSetting(ctx, key)
+	if err != nil {
 		return "", err
 	}
+	return setting.Value, nil
+}
 
-	// Get the setting value from App Configuration
-	resp, err := client.GetSetting(context.TODO(), key, nil)
+// GetSetting retrieves a configuration setting by key, together with the provider it came from
+func GetSetting(ctx context.Context, key string) (Setting, error) {
+	if currentProviders() == nil {
+		err := errors.New("configuration not initialized")
+		logger.Error(ctx, "Configuration not initialized", "Key", key, "Error", err)
+		return Setting{}, err
+	}
+
+	setting, found, err := lookup(ctx, key)
 	if err != nil {
-		log.Printf("Error: Failed to get configuration setting %s\n", key)
-		telemetry.TrackException(err, telemetry.Error, map[string]string{"Error": err.Error(), "Message": "Failed to get configuration setting"})
-		return "", err
+		logger.Error(ctx, "Failed to get configuration setting", "Key", key, "Error", err)
+		return Setting{}, err
+	}
+	if !found {
+		return Setting{}, fmt.Errorf("%w: %s", ErrKeyNotFound, key)
 	}
 
-	return *resp.Value, nil
+	return setting, nil
+}
+
+// Looks up the key in the providers and resolves Key Vault references
+func lookup(ctx context.Context, key string) (Setting, bool, error) {
+	chain := currentProviders()
+	if chain == nil {
+		return Setting{}, false, errors.New("configuration not initialized")
+	}
+	setting, found, err := chain.Get(ctx, key)
+	if err != nil || !found {
+		return setting, found, err
+	}
+	setting, err = resolveSetting(ctx, setting)
+	if err != nil {
+		return setting, false, err
+	}
+	recordLoaded(key, setting)
+	return setting, true, nil
+}
+
+// Check reports whether the configuration is initialized and every remote store is reachable
+func Check(ctx context.Context) error {
+	chain := currentProviders()
+	if chain == nil {
+		return errors.New("configuration not initialized")
+	}
+	for _, provider := range chain.Providers() {
+		if caching, ok := provider.(*CachingProvider); ok {
+			if err := caching.Err(); err != nil {
+				return fmt.Errorf("%s: %w", provider.Name(), err)
+			}
+		}
+	}
+	return nil
 }
@@ -0,0 +1,164 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/microtest/common/telemetry"
+)
+
+// Source reported for settings that were not found and use the default of their field
+const DefaultSource = "default"
+
+// EffectiveSetting is a configuration value as loaded by the service
+type EffectiveSetting struct {
+	Key string `json:"key"`
+
+	// Key found in the provider when it differs, e.g. with the service prefix
+	SourceKey string    `json:"sourceKey,omitempty"`
+	Value     string    `json:"value"`
+	Source    string    `json:"source"`
+	Label     string    `json:"label,omitempty"`
+	SecretURI string    `json:"secretUri,omitempty"`
+	Secret    bool      `json:"secret"`
+	LoadedAt  time.Time `json:"loadedAt"`
+}
+
+// EffectiveConfig is the configuration loaded by the service, secrets are masked
+type EffectiveConfig struct {
+	Profile     string             `json:"profile,omitempty"`
+	KeyPrefix   string             `json:"keyPrefix,omitempty"`
+	Providers   []string           `json:"providers"`
+	LastRefresh *time.Time         `json:"lastRefresh,omitempty"`
+	Settings    []EffectiveSetting `json:"settings"`
+}
+
+var (
+	effectiveMu sync.Mutex
+	loaded      = map[string]EffectiveSetting{}
+	secretKeys  = map[string]bool{}
+)
+
+// Records a setting read from the providers
+func recordLoaded(key string, setting Setting) {
+	effective := EffectiveSetting{
+		Key:       key,
+		Value:     setting.Value,
+		Source:    setting.Source,
+		Label:     setting.Label,
+		SecretURI: setting.SecretURI,
+		LoadedAt:  time.Now(),
+	}
+	if setting.Key != key {
+		effective.SourceKey = setting.Key
+	}
+
+	effectiveMu.Lock()
+	defer effectiveMu.Unlock()
+	loaded[key] = effective
+}
+
+// Records a setting that uses the default of its field
+func recordDefault(key, value string) {
+	effectiveMu.Lock()
+	defer effectiveMu.Unlock()
+	loaded[key] = EffectiveSetting{Key: key, Value: value, Source: DefaultSource, LoadedAt: time.Now()}
+}
+
+// Marks the key as secret, its value is always masked
+func markSecret(key string) {
+	effectiveMu.Lock()
+	defer effectiveMu.Unlock()
+	secretKeys[key] = true
+}
+
+// Checks if the key holds a secret, a secret field or a sensitive key, with or without the key prefix
+func isSecretKey(key string) bool {
+	if chain := currentProviders(); chain != nil && chain.prefix != "" {
+		key = strings.TrimPrefix(key, chain.prefix)
+	}
+	effectiveMu.Lock()
+	defer effectiveMu.Unlock()
+	return secretKeys[key] || telemetry.IsSensitiveField(key)
+}
+
+// Effective returns every setting the service loaded, sorted by key.
+// Secrets (secret fields, Key Vault references and sensitive keys) are masked.
+func Effective() EffectiveConfig {
+	result := EffectiveConfig{Providers: []string{}, Settings: []EffectiveSetting{}}
+	if chain := currentProviders(); chain != nil {
+		result.KeyPrefix = chain.prefix
+		for _, provider := range chain.Providers() {
+			result.Providers = append(result.Providers, provider.Name())
+		}
+	}
+	if last := LastRefresh(); !last.IsZero() {
+		result.LastRefresh = &last
+	}
+
+	effectiveMu.Lock()
+	defer effectiveMu.Unlock()
+	result.Profile = profile
+	for key, setting := range loaded {
+		setting.Secret = secretKeys[key] || setting.SecretURI != "" || telemetry.IsSensitiveField(key)
+		if setting.Secret {
+			setting.Value = telemetry.RedactedMask
+		} else {
+			setting.Value = telemetry.Redact(setting.Value)
+		}
+		result.Settings = append(result.Settings, setting)
+	}
+	sort.Slice(result.Settings, func(i, j int) bool { return result.Settings[i].Key < result.Settings[j].Key })
+	return result
+}
+
+// Handler serves the effective configuration as JSON
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(Effective()); err != nil {
+			logger.Error(r.Context(), "Failed to write effective configuration", "Error", err)
+		}
+	})
+}
+
+// Dump writes the effective configuration as a table
+func Dump(w io.Writer) error {
+	effective := Effective()
+	lastRefresh := "never"
+	if effective.LastRefresh != nil {
+		lastRefresh = effective.LastRefresh.Format(time.RFC3339)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Profile:\t%s\n", effective.Profile)
+	fmt.Fprintf(tw, "Key prefix:\t%s\n", effective.KeyPrefix)
+	fmt.Fprintf(tw, "Providers:\t%s\n", strings.Join(effective.Providers, ","))
+	fmt.Fprintf(tw, "Last refresh:\t%s\n\n", lastRefresh)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tVALUE\tSOURCE\tLABEL\tLOADED")
+	for _, setting := range effective.Settings {
+		source := setting.Source
+		if setting.SourceKey != "" {
+			source += " (" + setting.SourceKey + ")"
+		}
+		if setting.SecretURI != "" {
+			source += " -> " + setting.SecretURI
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", setting.Key, setting.Value, source, setting.Label, setting.LoadedAt.Format(time.RFC3339))
+	}
+	return tw.Flush()
+}
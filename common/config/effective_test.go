@@ -0,0 +1,140 @@
+package config
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/microtest/common/telemetry"
+)
+
+// Forgets the loaded settings, secret keys and profile at the end of the test
+func resetEffective(t *testing.T) {
+	t.Cleanup(func() {
+		effectiveMu.Lock()
+		defer effectiveMu.Unlock()
+		loaded = map[string]EffectiveSetting{}
+		secretKeys = map[string]bool{}
+		profile = ""
+	})
+}
+
+// Loads the settings of the test the way a service does
+func loadTestSettings(t *testing.T) {
+	t.Helper()
+	useSettings(t, map[string]string{
+		"NAME":                     "orders",
+		"publisher:PORT":           "9090",
+		"HMAC_SECRETS":             "hmac-value",
+		"PUBLISHER_KEYS":           "key-value",
+		"EVENTHUB_ENDPOINT":        "Endpoint=sb://orders.servicebus.windows.net/;SharedAccessKey=sas-value",
+		"APPCONFIGURATION_TIMEOUT": "5s",
+	})
+	SetKeyPrefix("publisher:")
+	resetEffective(t)
+	markSecret("PUBLISHER_KEYS")
+	for _, key := range []string{"NAME", "PORT", "HMAC_SECRETS", "PUBLISHER_KEYS", "EVENTHUB_ENDPOINT", "APPCONFIGURATION_TIMEOUT"} {
+		if _, err := GetVar(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recordLoaded("DATABASE_URL", Setting{Key: "DATABASE_URL", Value: "db-password", Source: "Test", SecretURI: "https://vault.vault.azure.net/secrets/db"})
+	recordDefault("RETRY_ATTEMPTS", "3")
+}
+
+func TestEffectiveMasksSecrets(t *testing.T) {
+	loadTestSettings(t)
+	settings := map[string]EffectiveSetting{}
+	for _, setting := range Effective().Settings {
+		settings[setting.Key] = setting
+	}
+
+	tests := []struct {
+		name       string
+		key        string
+		wantValue  string
+		wantSecret bool
+	}{
+		{"plain setting", "NAME", "orders", false},
+		{"default", "RETRY_ATTEMPTS", "3", false},
+		{"sensitive key", "HMAC_SECRETS", telemetry.RedactedMask, true},
+		{"secret field", "PUBLISHER_KEYS", telemetry.RedactedMask, true},
+		{"Key Vault reference", "DATABASE_URL", telemetry.RedactedMask, true},
+		{"secret inside the value", "EVENTHUB_ENDPOINT", "Endpoint=sb://orders.servicebus.windows.net/;SharedAccessKey=" + telemetry.RedactedMask, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setting, ok := settings[tt.key]
+			if !ok {
+				t.Fatalf("%s not in the effective configuration", tt.key)
+			}
+			if setting.Value != tt.wantValue || setting.Secret != tt.wantSecret {
+				t.Errorf("%s = %q, secret %t, want %q, secret %t", tt.key, setting.Value, setting.Secret, tt.wantValue, tt.wantSecret)
+			}
+		})
+	}
+
+	if port := settings["PORT"]; port.Value != "9090" || port.SourceKey != "publisher:PORT" {
+		t.Errorf("PORT = %+v, want 9090 from publisher:PORT", port)
+	}
+	if source := settings["RETRY_ATTEMPTS"].Source; source != DefaultSource {
+		t.Errorf("RETRY_ATTEMPTS source = %q, want %q", source, DefaultSource)
+	}
+}
+
+func TestIsSecretKey(t *testing.T) {
+	useSettings(t, nil)
+	SetKeyPrefix("publisher:")
+	resetEffective(t)
+	markSecret("PUBLISHER_KEYS")
+
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"PUBLISHER_KEYS", true},
+		{"publisher:PUBLISHER_KEYS", true},
+		{"consumer:PUBLISHER_KEYS", false},
+		{"HMAC_SECRETS", true},
+		{"publisher:APPINSIGHTS_INSTRUMENTATIONKEY", true},
+		{"NAME", false},
+		{"publisher:NAME", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := isSecretKey(tt.key); got != tt.want {
+				t.Errorf("isSecretKey(%q) = %t, want %t", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDump(t *testing.T) {
+	loadTestSettings(t)
+	watchMu.Lock()
+	lastRefresh = time.Time{}
+	watchMu.Unlock()
+	var buf bytes.Buffer
+	if err := Dump(&buf); err != nil {
+		t.Fatal(err)
+	}
+	output := buf.String()
+
+	for _, want := range []string{
+		"Key prefix:    publisher:",
+		"Providers:     Test",
+		"Last refresh:  never",
+		"Test (publisher:PORT)",
+		"Test -> https://vault.vault.azure.net/secrets/db",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Dump output misses %q:\n%s", want, output)
+		}
+	}
+	for _, secret := range []string{"hmac-value", "key-value", "db-password", "sas-value"} {
+		if strings.Contains(output, secret) {
+			t.Errorf("Dump output contains the secret %q:\n%s", secret, output)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package config
+
+import (
+	"context"
+	"os"
+	"strings"
+)
+
+// EnvProvider reads settings from environment variables
+type EnvProvider struct {
+	prefix string
+}
+
+// Creates an environment provider, the prefix (can be empty) is added to every variable name
+func NewEnvProvider(prefix string) *EnvProvider {
+	return &EnvProvider{prefix: prefix}
+}
+
+// Name of the provider
+func (p *EnvProvider) Name() string {
+	return "env"
+}
+
+// Get looks up the key as is, and then as an environment variable name (upper case, separators replaced by '_')
+func (p *EnvProvider) Get(ctx context.Context, key string) (Setting, bool, error) {
+	for _, name := range []string{p.prefix + key, envName(p.prefix + key)} {
+		if value, ok := os.LookupEnv(name); ok {
+			return Setting{Key: key, Value: value, Source: p.Name()}, true, nil
+		}
+	}
+	return Setting{}, false, nil
+}
+
+// Converts a configuration key (e.g. publisher:Retry.Count) into an environment variable name (PUBLISHER_RETRY_COUNT)
+func envName(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		}
+		return '_'
+	}, key)
+}
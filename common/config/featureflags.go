@@ -0,0 +1,198 @@
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/microtest/common/shared"
+)
+
+// Prefix of the keys that hold feature flags, as in App Configuration feature management
+const FeatureFlagPrefix = ".appconfig.featureflag/"
+
+// Names of the supported feature filters
+const (
+	PercentageFilter = "Microsoft.Percentage"
+	TargetingFilter  = "Microsoft.Targeting"
+)
+
+// TargetingContext identifies who a feature flag is evaluated for: the user is the customer ID, the groups are product categories
+type TargetingContext struct {
+	UserID string
+	Groups []string
+
+	// Keeps percentage rollouts stable without a user, IsEnabled sets it to the operation ID of the context
+	OperationID string
+}
+
+// FeatureFlag is a feature flag in the App Configuration format
+type FeatureFlag struct {
+	ID          string `json:"id"`
+	Description string `json:"description,omitempty"`
+	Enabled     bool   `json:"enabled"`
+	Conditions  struct {
+		RequirementType string          `json:"requirement_type,omitempty"`
+		ClientFilters   []FeatureFilter `json:"client_filters,omitempty"`
+	} `json:"conditions"`
+}
+
+// FeatureFilter narrows down who a flag is enabled for
+type FeatureFilter struct {
+	Name       string          `json:"name"`
+	Parameters json.RawMessage `json:"parameters,omitempty"`
+}
+
+// Parameters of the targeting filter
+type targetingParameters struct {
+	Audience struct {
+		Users  []string `json:"Users"`
+		Groups []struct {
+			Name              string  `json:"Name"`
+			RolloutPercentage float64 `json:"RolloutPercentage"`
+		} `json:"Groups"`
+		DefaultRolloutPercentage float64 `json:"DefaultRolloutPercentage"`
+		Exclusion                struct {
+			Users  []string `json:"Users"`
+			Groups []string `json:"Groups"`
+		} `json:"Exclusion"`
+	} `json:"Audience"`
+}
+
+// WithTargeting returns a context used to evaluate feature flags for a customer and its groups (e.g. product categories)
+func WithTargeting(ctx context.Context, userID string, groups ...string) context.Context {
+	return context.WithValue(ctx, shared.TargetingKeyContextKey, TargetingContext{UserID: userID, Groups: groups})
+}
+
+// IsEnabled evaluates the feature flag stored under .appconfig.featureflag/<flag> for the targeting context in ctx.
+// A flag that is missing or cannot be read is disabled.
+func IsEnabled(ctx context.Context, flag string) bool {
+	setting, err := GetSetting(ctx, FeatureFlagPrefix+flag)
+	if err != nil {
+		if !errors.Is(err, ErrKeyNotFound) {
+			logger.Warning(ctx, "Failed to read feature flag", "Flag", flag, "Error", err)
+		}
+		return false
+	}
+
+	featureFlag, err := ParseFeatureFlag(setting.Value)
+	if err != nil {
+		logger.Warning(ctx, "Invalid feature flag", "Flag", flag, "Error", err)
+		return false
+	}
+	if featureFlag.ID == "" {
+		featureFlag.ID = flag
+	}
+
+	targeting, _ := ctx.Value(shared.TargetingKeyContextKey).(TargetingContext)
+	if targeting.OperationID == "" {
+		targeting.OperationID, _ = ctx.Value(shared.OperationIDKeyContextKey).(string)
+	}
+	return featureFlag.Evaluate(targeting)
+}
+
+// ParseFeatureFlag reads a flag in the App Configuration JSON format, a plain true or false is also accepted
+func ParseFeatureFlag(value string) (FeatureFlag, error) {
+	var flag FeatureFlag
+	if enabled, err := strconv.ParseBool(strings.TrimSpace(value)); err == nil {
+		flag.Enabled = enabled
+		return flag, nil
+	}
+	err := json.Unmarshal([]byte(value), &flag)
+	return flag, err
+}
+
+// Evaluate checks if the flag is enabled for the targeting context.
+// A flag without filters is only controlled by Enabled, otherwise any filter (or all of them with requirement_type All) must pass.
+func (f FeatureFlag) Evaluate(targeting TargetingContext) bool {
+	if !f.Enabled {
+		return false
+	}
+	filters := f.Conditions.ClientFilters
+	if len(filters) == 0 {
+		return true
+	}
+
+	requireAll := strings.EqualFold(f.Conditions.RequirementType, "All")
+	for _, filter := range filters {
+		passed := f.evaluateFilter(filter, targeting)
+		if requireAll && !passed {
+			return false
+		}
+		if !requireAll && passed {
+			return true
+		}
+	}
+	return requireAll
+}
+
+// Evaluates a single filter, unknown filters never pass
+func (f FeatureFlag) evaluateFilter(filter FeatureFilter, targeting TargetingContext) bool {
+	switch filter.Name {
+	case PercentageFilter, "Percentage":
+		var parameters struct {
+			Value float64 `json:"Value"`
+		}
+		if err := json.Unmarshal(filter.Parameters, &parameters); err != nil {
+			return false
+		}
+		// Stable per customer when there is one, otherwise per operation
+		key := targeting.UserID
+		if key == "" {
+			key = targeting.OperationID
+		}
+		return rolloutScore(key+"\n"+f.ID) < parameters.Value
+
+	case TargetingFilter, "Targeting":
+		var parameters targetingParameters
+		if err := json.Unmarshal(filter.Parameters, &parameters); err != nil {
+			return false
+		}
+		audience := parameters.Audience
+
+		// Exclusions win over everything else
+		if contains(audience.Exclusion.Users, targeting.UserID) {
+			return false
+		}
+		for _, group := range targeting.Groups {
+			if contains(audience.Exclusion.Groups, group) {
+				return false
+			}
+		}
+
+		if contains(audience.Users, targeting.UserID) {
+			return true
+		}
+		for _, group := range audience.Groups {
+			if contains(targeting.Groups, group.Name) && rolloutScore(targeting.UserID+"\n"+f.ID+"\n"+group.Name) < group.RolloutPercentage {
+				return true
+			}
+		}
+		return rolloutScore(targeting.UserID+"\n"+f.ID) < audience.DefaultRolloutPercentage
+	}
+	return false
+}
+
+// Maps a targeting key to a stable percentage in [0, 100)
+func rolloutScore(key string) float64 {
+	hash := sha256.Sum256([]byte(key))
+	return float64(binary.LittleEndian.Uint32(hash[:4])) / (math.MaxUint32 + 1.0) * 100
+}
+
+// Case-insensitive membership test, an empty value never matches
+func contains(values []string, value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
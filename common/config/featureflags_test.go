@@ -0,0 +1,212 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/microtest/common/shared"
+)
+
+// Feature flag JSON with the given filters
+func testFlag(enabled bool, requirementType string, filters ...string) string {
+	joined := ""
+	for i, filter := range filters {
+		if i > 0 {
+			joined += ","
+		}
+		joined += filter
+	}
+	return fmt.Sprintf(`{"id":"NewHandler","enabled":%t,"conditions":{"requirement_type":%q,"client_filters":[%s]}}`, enabled, requirementType, joined)
+}
+
+func percentageFilter(value float64) string {
+	return fmt.Sprintf(`{"name":"Microsoft.Percentage","parameters":{"Value":%v}}`, value)
+}
+
+const targetingFilter = `{"name":"Microsoft.Targeting","parameters":{"Audience":{
+	"Users":["c-1","c-excluded"],
+	"Groups":[{"Name":"Books","RolloutPercentage":100},{"Name":"Games","RolloutPercentage":0}],
+	"DefaultRolloutPercentage":0,
+	"Exclusion":{"Users":["c-excluded"],"Groups":["Toys"]}}}}`
+
+func TestRolloutScore(t *testing.T) {
+	const keys = 10000
+	below := map[float64]int{}
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("c-%d\nNewHandler", i)
+		score := rolloutScore(key)
+		if score < 0 || score >= 100 {
+			t.Fatalf("rolloutScore(%q) = %v, want a percentage in [0, 100)", key, score)
+		}
+		if again := rolloutScore(key); again != score {
+			t.Fatalf("rolloutScore(%q) changed from %v to %v", key, score, again)
+		}
+		for _, percentage := range []float64{0, 25, 50, 100} {
+			if score < percentage {
+				below[percentage]++
+			}
+		}
+	}
+
+	// The scores are spread evenly, so a rollout reaches about its percentage of the customers
+	tests := []struct {
+		percentage float64
+		min, max   int
+	}{
+		{0, 0, 0},
+		{25, 2300, 2700},
+		{50, 4800, 5200},
+		{100, keys, keys},
+	}
+	for _, tt := range tests {
+		if got := below[tt.percentage]; got < tt.min || got > tt.max {
+			t.Errorf("%d keys below %v%%, want %d to %d", got, tt.percentage, tt.min, tt.max)
+		}
+	}
+}
+
+func TestParseFeatureFlag(t *testing.T) {
+	tests := []struct {
+		name        string
+		value       string
+		wantEnabled bool
+		wantErr     bool
+	}{
+		{"plain true", " true ", true, false},
+		{"plain false", "false", false, false},
+		{"feature management JSON", testFlag(true, "", percentageFilter(50)), true, false},
+		{"invalid", "{enabled", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flag, err := ParseFeatureFlag(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseFeatureFlag error = %v, want error %t", err, tt.wantErr)
+			}
+			if flag.Enabled != tt.wantEnabled {
+				t.Errorf("Enabled = %t, want %t", flag.Enabled, tt.wantEnabled)
+			}
+		})
+	}
+}
+
+func TestFeatureFlagEvaluate(t *testing.T) {
+	customer := TargetingContext{UserID: "c-2", Groups: []string{"Electronics"}}
+	tests := []struct {
+		name      string
+		flag      string
+		targeting TargetingContext
+		want      bool
+	}{
+		{"disabled", testFlag(false, ""), customer, false},
+		{"disabled with a filter that passes", testFlag(false, "", percentageFilter(100)), customer, false},
+		{"enabled without filters", testFlag(true, ""), customer, true},
+		{"percentage 0 is never on", testFlag(true, "", percentageFilter(0)), customer, false},
+		{"percentage 100 is always on", testFlag(true, "", percentageFilter(100)), customer, true},
+		{"percentage without customer nor operation", testFlag(true, "", percentageFilter(100)), TargetingContext{}, true},
+		{"targeted user", testFlag(true, "", targetingFilter), TargetingContext{UserID: "c-1"}, true},
+		{"user ids are case insensitive", testFlag(true, "", targetingFilter), TargetingContext{UserID: "C-1"}, true},
+		{"excluded user listed as a user", testFlag(true, "", targetingFilter), TargetingContext{UserID: "c-excluded"}, false},
+		{"excluded group wins over the user", testFlag(true, "", targetingFilter), TargetingContext{UserID: "c-1", Groups: []string{"Toys"}}, false},
+		{"group rolled out to everyone", testFlag(true, "", targetingFilter), TargetingContext{UserID: "c-2", Groups: []string{"Books"}}, true},
+		{"group rolled out to nobody", testFlag(true, "", targetingFilter), TargetingContext{UserID: "c-2", Groups: []string{"Games"}}, false},
+		{"neither targeted nor in the default rollout", testFlag(true, "", targetingFilter), customer, false},
+		{"any filter passes", testFlag(true, "Any", targetingFilter, percentageFilter(100)), customer, true},
+		{"all filters must pass", testFlag(true, "All", targetingFilter, percentageFilter(100)), customer, false},
+		{"all filters pass", testFlag(true, "All", targetingFilter, percentageFilter(100)), TargetingContext{UserID: "c-1"}, true},
+		{"unknown filter", testFlag(true, "", `{"name":"Microsoft.TimeWindow"}`), customer, false},
+		{"invalid parameters", testFlag(true, "", `{"name":"Microsoft.Percentage","parameters":{"Value":"half"}}`), customer, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flag, err := ParseFeatureFlag(tt.flag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := flag.Evaluate(tt.targeting); got != tt.want {
+				t.Errorf("Evaluate = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFeatureFlagPercentageIsStablePerKey(t *testing.T) {
+	flag, err := ParseFeatureFlag(testFlag(true, "", percentageFilter(50)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A customer gets the same answer every time, customers on both sides of the rollout exist
+	enabled := 0
+	for i := 0; i < 100; i++ {
+		targeting := TargetingContext{UserID: fmt.Sprintf("c-%d", i), OperationID: fmt.Sprintf("op-%d", i)}
+		first := flag.Evaluate(targeting)
+		for j := 0; j < 5; j++ {
+			targeting.OperationID = fmt.Sprintf("op-%d-%d", i, j)
+			if flag.Evaluate(targeting) != first {
+				t.Fatalf("customer %s got another answer for another operation", targeting.UserID)
+			}
+		}
+		if first {
+			enabled++
+		}
+	}
+	if enabled == 0 || enabled == 100 {
+		t.Errorf("%d customers enabled out of 100, want a split", enabled)
+	}
+
+	// The score depends on the flag, so the same customers do not get every rollout first
+	other := flag
+	other.ID = "OtherHandler"
+	differ := false
+	for i := 0; i < 100 && !differ; i++ {
+		targeting := TargetingContext{UserID: fmt.Sprintf("c-%d", i)}
+		differ = flag.Evaluate(targeting) != other.Evaluate(targeting)
+	}
+	if !differ {
+		t.Error("two flags at 50% are enabled for the same customers")
+	}
+}
+
+func TestIsEnabled(t *testing.T) {
+	useSettings(t, map[string]string{
+		FeatureFlagPrefix + "On":         "true",
+		FeatureFlagPrefix + "Targeted":   testFlag(true, "", targetingFilter),
+		FeatureFlagPrefix + "Percentage": testFlag(true, "", percentageFilter(50)),
+		FeatureFlagPrefix + "Invalid":    "{enabled",
+	})
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		flag string
+		want bool
+	}{
+		{"missing flag", ctx, "Missing", false},
+		{"invalid flag", ctx, "Invalid", false},
+		{"plain flag", ctx, "On", true},
+		{"targeted customer", WithTargeting(ctx, "c-1", "Electronics"), "Targeted", true},
+		{"other customer", WithTargeting(ctx, "c-2", "Electronics"), "Targeted", false},
+		{"no targeting", ctx, "Targeted", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsEnabled(tt.ctx, tt.flag); got != tt.want {
+				t.Errorf("IsEnabled(%q) = %t, want %t", tt.flag, got, tt.want)
+			}
+		})
+	}
+
+	// Without a customer, the percentage is decided once per operation
+	for i := 0; i < 20; i++ {
+		operationCtx := context.WithValue(ctx, shared.OperationIDKeyContextKey, fmt.Sprintf("op-%d", i))
+		want := rolloutScore(fmt.Sprintf("op-%d\nNewHandler", i)) < 50
+		for j := 0; j < 3; j++ {
+			if got := IsEnabled(operationCtx, "Percentage"); got != want {
+				t.Fatalf("operation %d: IsEnabled = %t, want %t", i, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Separator used to flatten nested file sections into keys, as in App Configuration (e.g. publisher:PORT)
+const keySeparator = ":"
+
+// FileProvider reads settings from a JSON or YAML file, nested sections are flattened into keys joined with ':'.
+// With a label, the profile file next to it (e.g. config.prod.yaml for config.yaml) overrides its values.
+type FileProvider struct {
+	path     string
+	label    string
+	mu       sync.RWMutex
+	settings map[string]Setting
+	modTimes [2]time.Time
+}
+
+// Creates a file provider, the format is taken from the extension (.json, .yaml or .yml).
+// The label (dev, staging, prod, ...) can be empty, the profile file is optional.
+func NewFileProvider(path, label string) (*FileProvider, error) {
+	p := &FileProvider{path: path, label: label}
+	if _, err := p.Refresh(context.Background()); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Name of the provider
+func (p *FileProvider) Name() string {
+	return "file"
+}
+
+// Path of the file
+func (p *FileProvider) Path() string {
+	return p.path
+}
+
+// Path of the profile file for the label, empty without a label
+func (p *FileProvider) profilePath() string {
+	if p.label == "" {
+		return ""
+	}
+	ext := filepath.Ext(p.path)
+	return strings.TrimSuffix(p.path, ext) + "." + p.label + ext
+}
+
+// Get returns the setting for the key if the file has it
+func (p *FileProvider) Get(ctx context.Context, key string) (Setting, bool, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	setting, ok := p.settings[key]
+	return setting, ok, nil
+}
+
+// Refresh reads the files again if one of them was modified, and reports whether they were
+func (p *FileProvider) Refresh(ctx context.Context) (bool, error) {
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return false, err
+	}
+	modTimes := [2]time.Time{info.ModTime()}
+	profile := p.profilePath()
+	if profile != "" {
+		if info, err := os.Stat(profile); err == nil {
+			modTimes[1] = info.ModTime()
+		}
+	}
+
+	p.mu.RLock()
+	modified := p.settings == nil || modTimes != p.modTimes
+	p.mu.RUnlock()
+	if !modified {
+		return false, nil
+	}
+
+	// Read the base file, then the profile file on top of it
+	settings := make(map[string]Setting)
+	values, err := readSettingsFile(p.path)
+	if err != nil {
+		return false, err
+	}
+	for key, value := range values {
+		settings[key] = Setting{Key: key, Value: value, Source: p.Name()}
+	}
+	if !modTimes[1].IsZero() {
+		values, err := readSettingsFile(profile)
+		if err != nil {
+			return false, err
+		}
+		for key, value := range values {
+			settings[key] = Setting{Key: key, Value: value, Source: p.Name(), Label: p.label}
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.settings = settings
+	p.modTimes = modTimes
+	return true, nil
+}
+
+// Reads and flattens a settings file
+func readSettingsFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var document map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(data, &document)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &document)
+	default:
+		return nil, fmt.Errorf("unsupported configuration file format %q", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse configuration file %s: %w", path, err)
+	}
+
+	settings := make(map[string]string)
+	flatten("", document, settings)
+	return settings, nil
+}
+
+// Flattens nested sections into a single level map
+func flatten(prefix string, value interface{}, settings map[string]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		// Feature flags are kept whole, in the App Configuration JSON format
+		if strings.HasPrefix(prefix, FeatureFlagPrefix) {
+			data, err := json.Marshal(v)
+			if err == nil {
+				settings[prefix] = string(data)
+			}
+			return
+		}
+		for key, child := range v {
+			if prefix != "" {
+				key = prefix + keySeparator + key
+			}
+			flatten(key, child, settings)
+		}
+	case nil:
+		settings[prefix] = ""
+	case string:
+		settings[prefix] = v
+	default:
+		// Lists and scalars are kept in their JSON form, e.g. 10, true or ["a","b"]
+		data, err := json.Marshal(v)
+		if err != nil {
+			data = []byte(fmt.Sprint(v))
+		}
+		settings[prefix] = string(data)
+	}
+}
@@ -0,0 +1,130 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Writes the file in the directory and returns its path
+func writeConfigFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFileProvider(t *testing.T) {
+	dir := t.TempDir()
+	yamlPath := writeConfigFile(t, dir, "config.yaml", `
+PORT: 8080
+NAME: orders
+HOSTS: [a, b]
+EMPTY:
+publisher:
+  PORT: 9090
+  Retry:
+    Count: 3
+.appconfig.featureflag/NewHandler:
+  id: NewHandler
+  enabled: true
+`)
+	writeConfigFile(t, dir, "config.prod.yaml", "NAME: orders-prod\npublisher:\n  Retry:\n    Count: 5\n")
+	jsonPath := writeConfigFile(t, dir, "config.json", `{"PORT": 8080, "publisher": {"PORT": "9090"}}`)
+
+	tests := []struct {
+		name      string
+		path      string
+		label     string
+		key       string
+		wantValue string
+		wantLabel string
+		wantFound bool
+	}{
+		{"scalar kept in JSON form", yamlPath, "", "PORT", "8080", "", true},
+		{"list kept in JSON form", yamlPath, "", "HOSTS", `["a","b"]`, "", true},
+		{"empty value", yamlPath, "", "EMPTY", "", "", true},
+		{"nested sections joined with ':'", yamlPath, "", "publisher:Retry:Count", "3", "", true},
+		{"feature flag kept whole", yamlPath, "", ".appconfig.featureflag/NewHandler", `{"enabled":true,"id":"NewHandler"}`, "", true},
+		{"missing key", yamlPath, "", "MISSING", "", "", false},
+		{"profile file overrides the base file", yamlPath, "prod", "NAME", "orders-prod", "prod", true},
+		{"profile file overrides nested keys", yamlPath, "prod", "publisher:Retry:Count", "5", "prod", true},
+		{"base file without the key in the profile", yamlPath, "prod", "PORT", "8080", "", true},
+		{"missing profile file is ignored", yamlPath, "staging", "NAME", "orders", "", true},
+		{"JSON file", jsonPath, "", "publisher:PORT", "9090", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider, err := NewFileProvider(tt.path, tt.label)
+			if err != nil {
+				t.Fatalf("NewFileProvider error = %v", err)
+			}
+			setting, found, err := provider.Get(context.Background(), tt.key)
+			if err != nil || found != tt.wantFound {
+				t.Fatalf("Get = %+v, %t, %v, want found %t", setting, found, err, tt.wantFound)
+			}
+			if setting.Value != tt.wantValue || setting.Label != tt.wantLabel {
+				t.Errorf("Get = %q with label %q, want %q with label %q", setting.Value, setting.Label, tt.wantValue, tt.wantLabel)
+			}
+		})
+	}
+}
+
+func TestNewFileProviderErrors(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		path string
+	}{
+		{"missing file", filepath.Join(dir, "missing.yaml")},
+		{"unsupported format", writeConfigFile(t, dir, "config.ini", "PORT=8080")},
+		{"invalid content", writeConfigFile(t, dir, "invalid.json", "{PORT")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewFileProvider(tt.path, ""); err == nil {
+				t.Error("NewFileProvider succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestFileProviderRefresh(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := writeConfigFile(t, dir, "config.yaml", "NAME: orders\n")
+	provider, err := NewFileProvider(path, "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if changed, err := provider.Refresh(ctx); changed || err != nil {
+		t.Fatalf("Refresh of unmodified files = %t, %v, want no change", changed, err)
+	}
+
+	// A profile file created later is picked up
+	profilePath := writeConfigFile(t, dir, "config.prod.yaml", "NAME: orders-prod\n")
+	later := time.Now().Add(time.Second)
+	os.Chtimes(profilePath, later, later)
+	if changed, err := provider.Refresh(ctx); !changed || err != nil {
+		t.Fatalf("Refresh after the profile file was created = %t, %v, want a change", changed, err)
+	}
+	if setting, _, _ := provider.Get(ctx, "NAME"); setting.Value != "orders-prod" {
+		t.Errorf("NAME = %q, want the value of the profile file", setting.Value)
+	}
+
+	// A file that cannot be parsed keeps the previous settings
+	writeConfigFile(t, dir, "config.yaml", "NAME: [")
+	later = later.Add(time.Second)
+	os.Chtimes(path, later, later)
+	if _, err := provider.Refresh(ctx); err == nil {
+		t.Error("Refresh of an invalid file succeeded")
+	}
+	if setting, _, _ := provider.Get(ctx, "NAME"); setting.Value != "orders-prod" {
+		t.Errorf("NAME = %q after a failed refresh, want the previous value", setting.Value)
+	}
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrKeyNotFound is returned when no provider has a value for the key
+var ErrKeyNotFound = errors.New("configuration key not found")
+
+// Setting is a configuration value together with the provider it came from
+type Setting struct {
+	Key         string
+	Value       string
+	Source      string
+	Label       string
+	ContentType string
+
+	// URI of the Key Vault secret when the setting is a reference, the value is then the resolved secret
+	SecretURI string
+}
+
+// Provider is a source of configuration settings (environment, file, App Configuration, ...)
+type Provider interface {
+	// Name of the provider, reported as the source of its settings
+	Name() string
+
+	// Get returns the setting for the key, and false if the provider does not have it
+	Get(ctx context.Context, key string) (Setting, bool, error)
+}
+
+// Refresher is implemented by providers that keep a copy of their settings and can reload it
+type Refresher interface {
+	// Refresh reloads the settings, and reports whether they changed
+	Refresh(ctx context.Context) (bool, error)
+}
+
+// Chain looks up keys in several providers, the first one that has the key wins.
+// With a key prefix (e.g. "publisher:"), each provider is asked for the prefixed key before the plain one.
+type Chain struct {
+	providers []Provider
+	prefix    string
+}
+
+// Creates a chain with the providers in order of precedence
+func NewChain(providers ...Provider) *Chain {
+	return &Chain{providers: providers}
+}
+
+// Name of the chain
+func (c *Chain) Name() string {
+	return "chain"
+}
+
+// SetPrefix sets the prefix used to namespace keys per service
+func (c *Chain) SetPrefix(prefix string) {
+	c.prefix = prefix
+}
+
+// Providers returns the providers in order of precedence
+func (c *Chain) Providers() []Provider {
+	return c.providers
+}
+
+// Get returns the setting from the first provider that has the key, the returned setting has the key that was found.
+// A failing provider does not stop the lookup, its error is only returned if no other provider has the key.
+func (c *Chain) Get(ctx context.Context, key string) (Setting, bool, error) {
+	candidates := []string{key}
+	if c.prefix != "" && !strings.HasPrefix(key, c.prefix) {
+		candidates = []string{c.prefix + key, key}
+	}
+
+	var errs []error
+	for _, provider := range c.providers {
+		for _, candidate := range candidates {
+			setting, found, err := provider.Get(ctx, candidate)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", provider.Name(), err))
+				break
+			}
+			if found {
+				return setting, true, nil
+			}
+		}
+	}
+
+	return Setting{}, false, errors.Join(errs...)
+}
+
+// Refresh reloads every provider that supports it, and reports whether any of them changed
+func (c *Chain) Refresh(ctx context.Context) (bool, error) {
+	changed := false
+	var errs []error
+	for _, provider := range c.providers {
+		refresher, ok := provider.(Refresher)
+		if !ok {
+			continue
+		}
+		providerChanged, err := refresher.Refresh(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", provider.Name(), err))
+		}
+		changed = changed || providerChanged
+	}
+	return changed, errors.Join(errs...)
+}
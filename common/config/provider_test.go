@@ -0,0 +1,204 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/microtest/common/telemetry"
+)
+
+// Provider that fails every lookup
+type failingProvider struct{}
+
+func (failingProvider) Name() string { return "Failing" }
+
+func (failingProvider) Get(ctx context.Context, key string) (Setting, bool, error) {
+	return Setting{}, false, errors.New("store unreachable")
+}
+
+// Clears the providers and the environment the configuration reads, for the duration of the test
+func useCleanConfig(t *testing.T) {
+	t.Helper()
+	telemetry.SetLogOutput(io.Discard)
+	for _, name := range []string{"CONFIG_PROVIDERS", "CONFIG_FILE", "CONFIG_LABEL", "APPCONFIGURATION_CONNECTION_STRING", "SECRET_RESOLVER"} {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+	t.Cleanup(func() {
+		activeProviders.Store(nil)
+		telemetry.SetLogOutput(os.Stdout)
+	})
+}
+
+// Forgets the subscriptions and watched keys at the end of the test
+func resetWatches(t *testing.T) {
+	t.Cleanup(func() {
+		watchMu.Lock()
+		defer watchMu.Unlock()
+		subscriptions = nil
+		watched = map[string]string{}
+		sentinelValue = ""
+	})
+}
+
+func TestChainGet(t *testing.T) {
+	first := mapProvider{"PORT": "8080", "publisher:PORT": "9090"}
+	second := mapProvider{"PORT": "7070", "NAME": "orders", "consumer:NAME": "other"}
+	tests := []struct {
+		name      string
+		chain     *Chain
+		prefix    string
+		key       string
+		wantValue string
+		wantKey   string
+		wantFound bool
+		wantErr   bool
+	}{
+		{"first provider wins", NewChain(first, second), "", "PORT", "8080", "PORT", true, false},
+		{"later provider has the key", NewChain(first, second), "", "NAME", "orders", "NAME", true, false},
+		{"missing key", NewChain(first, second), "", "MISSING", "", "", false, false},
+		{"prefixed key wins in a provider", NewChain(first, second), "publisher:", "PORT", "9090", "publisher:PORT", true, false},
+		{"prefixed key of another service ignored", NewChain(first, second), "publisher:", "NAME", "orders", "NAME", true, false},
+		{"prefixed key asked directly", NewChain(first, second), "publisher:", "publisher:PORT", "9090", "publisher:PORT", true, false},
+		{"failing provider skipped", NewChain(failingProvider{}, second), "", "NAME", "orders", "NAME", true, false},
+		{"failing provider reported when no other has the key", NewChain(failingProvider{}, second), "", "MISSING", "", "", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.chain.SetPrefix(tt.prefix)
+			setting, found, err := tt.chain.Get(context.Background(), tt.key)
+			if (err != nil) != tt.wantErr || found != tt.wantFound {
+				t.Fatalf("Get = %+v, %t, %v, want found %t, error %t", setting, found, err, tt.wantFound, tt.wantErr)
+			}
+			if setting.Value != tt.wantValue || setting.Key != tt.wantKey {
+				t.Errorf("Get = %q from key %q, want %q from key %q", setting.Value, setting.Key, tt.wantValue, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestEnvProvider(t *testing.T) {
+	t.Setenv("PUBLISHER_RETRY_COUNT", "5")
+	t.Setenv("app.Mode", "fast")
+	provider := NewEnvProvider("")
+	tests := []struct {
+		key       string
+		wantValue string
+		wantFound bool
+	}{
+		{"PUBLISHER_RETRY_COUNT", "5", true},
+		{"publisher:Retry.Count", "5", true},
+		{"app.Mode", "fast", true},
+		{"publisher:Retry.Delay", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			setting, found, err := provider.Get(context.Background(), tt.key)
+			if err != nil || found != tt.wantFound || setting.Value != tt.wantValue {
+				t.Errorf("Get = %+v, %t, %v, want %q, %t", setting, found, err, tt.wantValue, tt.wantFound)
+			}
+			if found && (setting.Key != tt.key || setting.Source != "env") {
+				t.Errorf("setting %+v, want key %q from env", setting, tt.key)
+			}
+		})
+	}
+}
+
+func TestInitializeConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte("PORT: 9090\nNAME: from-file\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name          string
+		env           map[string]string
+		wantProviders string
+		wantErr       bool
+	}{
+		{"default skips providers without settings", nil, "env", false},
+		{"default with a file", map[string]string{"CONFIG_FILE": file}, "env,file", false},
+		{"file first", map[string]string{"CONFIG_PROVIDERS": "file, env", "CONFIG_FILE": file}, "file,env", false},
+		{"explicit file without CONFIG_FILE", map[string]string{"CONFIG_PROVIDERS": "env,file"}, "", true},
+		{"explicit appconfig without connection string", map[string]string{"CONFIG_PROVIDERS": "appconfig"}, "", true},
+		{"unknown provider", map[string]string{"CONFIG_PROVIDERS": "env,vault"}, "", true},
+		{"missing file", map[string]string{"CONFIG_FILE": file + ".missing"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useCleanConfig(t)
+			t.Setenv("NAME", "from-env")
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			err := InitializeConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("InitializeConfig error = %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			var names []string
+			for _, provider := range currentProviders().Providers() {
+				names = append(names, provider.Name())
+			}
+			if got := strings.Join(names, ","); got != tt.wantProviders {
+				t.Errorf("providers = %s, want %s", got, tt.wantProviders)
+			}
+
+			// The first provider that has the key wins
+			want := "from-" + names[0]
+			if got, err := GetVar("NAME"); err != nil || got != want {
+				t.Errorf("GetVar(NAME) = %q, %v, want %q", got, err, want)
+			}
+		})
+	}
+}
+
+func TestProvidersReplacedWhileRefreshing(t *testing.T) {
+	useSettings(t, map[string]string{"NAME": "a"})
+	resetWatches(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The refresh goroutine, subscribers and request handlers read the providers while they are replaced
+	changes := Watch("NAME")
+	StartRefresh(ctx, RefreshOptions{Interval: time.Millisecond})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ctx.Err() == nil {
+			GetVar("NAME")
+			Effective()
+			Check(ctx)
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		value := "a"
+		if i%2 == 1 {
+			value = "b"
+		}
+		SetProviders(mapProvider{"NAME": value})
+		SetKeyPrefix("publisher:")
+	}
+	cancel()
+	<-done
+
+	// The refresh goroutine may have stopped before reading the last providers
+	Refresh(context.Background(), "")
+	if currentProviders().prefix != "publisher:" {
+		t.Errorf("prefix = %q, want it kept across SetProviders", currentProviders().prefix)
+	}
+	select {
+	case <-changes:
+	default:
+		t.Error("no change notified while the providers were replaced")
+	}
+}
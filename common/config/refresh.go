@@ -0,0 +1,259 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/microtest/common/telemetry"
+)
+
+// Change describes a setting whose value changed during a refresh
+type Change struct {
+	Key      string
+	OldValue string
+	NewValue string
+}
+
+// RefreshOptions controls how the configuration is polled for changes
+type RefreshOptions struct {
+	// Time between two polls
+	Interval time.Duration
+
+	// When set, watched keys are only read again after the sentinel key changes (or a provider reports a change),
+	// so a poll costs a single lookup. Update the sentinel after changing other settings.
+	SentinelKey string
+}
+
+// Subscription to changes of a set of keys
+type subscription struct {
+	keys     map[string]bool
+	callback func(Change)
+}
+
+// watchMu guards the state below and is never held during a lookup, lookups can reach App Configuration.
+// refreshMu serializes the refreshes, so their changes are applied in order.
+var (
+	watchMu       sync.Mutex
+	subscriptions []subscription
+	watched       = map[string]string{}
+	sentinelValue string
+	lastRefresh   time.Time
+
+	refreshMu sync.Mutex
+)
+
+// Subscribe calls the callback every time one of the keys changes.
+// Callbacks run on the refresh goroutine and must not block.
+func Subscribe(callback func(Change), keys ...string) {
+	ctx := context.Background()
+
+	sub := subscription{keys: map[string]bool{}, callback: callback}
+	var unwatched []string
+	watchMu.Lock()
+	for _, key := range keys {
+		sub.keys[key] = true
+		if _, ok := watched[key]; !ok {
+			unwatched = append(unwatched, key)
+		}
+	}
+	subscriptions = append(subscriptions, sub)
+	watchMu.Unlock()
+
+	// The initial values are read outside the lock
+	values := make(map[string]string, len(unwatched))
+	for _, key := range unwatched {
+		values[key], _ = currentValue(ctx, key)
+	}
+
+	watchMu.Lock()
+	defer watchMu.Unlock()
+	for key, value := range values {
+		if _, ok := watched[key]; !ok {
+			watched[key] = value
+		}
+	}
+}
+
+// Watch returns a channel that receives the changes of the keys, changes are dropped if the channel is full
+func Watch(keys ...string) <-chan Change {
+	changes := make(chan Change, 16)
+	Subscribe(func(change Change) {
+		select {
+		case changes <- change:
+		default:
+			logger.Warning(context.Background(), "Configuration change dropped, watcher is not reading", "Key", change.Key)
+		}
+	}, keys...)
+	return changes
+}
+
+// StartRefresh polls the configuration in the background until the context is done
+func StartRefresh(ctx context.Context, options RefreshOptions) {
+	if options.Interval <= 0 {
+		return
+	}
+
+	if options.SentinelKey != "" {
+		value, _ := currentValue(withoutCache(ctx), options.SentinelKey)
+		watchMu.Lock()
+		sentinelValue = value
+		watchMu.Unlock()
+	}
+
+	go func() {
+		defer telemetry.RecoverPanic()
+
+		ticker := time.NewTicker(options.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := Refresh(ctx, options.SentinelKey); err != nil {
+					logger.Warning(ctx, "Configuration refresh failed", "Error", err)
+				}
+			}
+		}
+	}()
+	logger.Info(ctx, "Configuration refresh started", "Interval", options.Interval.String(), "SentinelKey", options.SentinelKey)
+}
+
+// Refresh reloads the providers and notifies the subscribers of every watched key that changed.
+// With a sentinel key, watched keys are only read again when the sentinel or a provider changed.
+func Refresh(ctx context.Context, sentinelKey string) error {
+	chain := currentProviders()
+	if chain == nil {
+		return errors.New("configuration not initialized")
+	}
+	refreshMu.Lock()
+	defer refreshMu.Unlock()
+
+	providersChanged, err := chain.Refresh(ctx)
+
+	// Polling reads go to the stores, never to the cache
+	pollCtx := withoutCache(ctx)
+
+	watchMu.Lock()
+	lastRefresh = time.Now()
+	previousSentinel := sentinelValue
+	watchMu.Unlock()
+
+	if sentinelKey != "" {
+		value, ok := currentValue(pollCtx, sentinelKey)
+		if !ok || (value == previousSentinel && !providersChanged) {
+			return err
+		}
+		watchMu.Lock()
+		sentinelValue = value
+		watchMu.Unlock()
+
+		// Settings changed together with the sentinel, drop every cached value
+		for _, provider := range chain.Providers() {
+			if caching, ok := provider.(*CachingProvider); ok {
+				caching.Invalidate()
+			}
+		}
+	}
+
+	// Look the watched keys up outside the lock, keys that cannot be read keep their last value
+	watchMu.Lock()
+	keys := make([]string, 0, len(watched))
+	for key := range watched {
+		keys = append(keys, key)
+	}
+	watchMu.Unlock()
+	values := make(map[string]string, len(keys))
+	for _, key := range keys {
+		if value, ok := currentValue(pollCtx, key); ok {
+			values[key] = value
+		}
+	}
+
+	var changes []Change
+	watchMu.Lock()
+	for key, newValue := range values {
+		if oldValue := watched[key]; newValue != oldValue {
+			watched[key] = newValue
+			changes = append(changes, Change{Key: key, OldValue: oldValue, NewValue: newValue})
+		}
+	}
+	subs := append([]subscription(nil), subscriptions...)
+	watchMu.Unlock()
+
+	// Notify outside the lock so callbacks can read the configuration
+	for _, change := range changes {
+		logger.Info(ctx, "Configuration changed", "Key", change.Key, "Value", telemetry.RedactField(change.Key, change.NewValue))
+		for _, sub := range subs {
+			if sub.keys[change.Key] {
+				sub.callback(change)
+			}
+		}
+	}
+	return err
+}
+
+// LastRefresh returns when the configuration was last polled, zero if it never was
+func LastRefresh() time.Time {
+	watchMu.Lock()
+	defer watchMu.Unlock()
+	return lastRefresh
+}
+
+// SubscribeTelemetry applies LOG_LEVEL, TELEMETRY_SAMPLING_RATE and TELEMETRY_SAMPLING_MAX_PER_SECOND now and every time they change
+func SubscribeTelemetry() {
+	ctx := context.Background()
+	handlers := map[string]func(value string) error{
+		"LOG_LEVEL": func(value string) error {
+			level, err := telemetry.ParseLevel(value)
+			if err == nil {
+				telemetry.SetLogLevel(level)
+			}
+			return err
+		},
+		"TELEMETRY_SAMPLING_RATE": func(value string) error {
+			rate, err := strconv.ParseFloat(value, 64)
+			if err == nil {
+				telemetry.SetSamplingRate(rate)
+			}
+			return err
+		},
+		"TELEMETRY_SAMPLING_MAX_PER_SECOND": func(value string) error {
+			maxPerSecond, err := strconv.Atoi(value)
+			if err == nil {
+				telemetry.SetSamplingMaxPerSecond(maxPerSecond)
+			}
+			return err
+		},
+	}
+
+	apply := func(key, value string) {
+		if value == "" {
+			return
+		}
+		if err := handlers[key](value); err != nil {
+			logger.Warning(ctx, "Invalid telemetry setting", "Key", key, "Value", value, "Error", err)
+		}
+	}
+	for key := range handlers {
+		if value, ok := currentValue(ctx, key); ok {
+			apply(key, value)
+		}
+		Subscribe(func(change Change) { apply(change.Key, change.NewValue) }, key)
+	}
+}
+
+// Returns the current value of the key, empty if it is not set, and false if it cannot be read
+func currentValue(ctx context.Context, key string) (string, bool) {
+	setting, found, err := lookup(ctx, key)
+	if err != nil {
+		return "", false
+	}
+	if !found {
+		return "", true
+	}
+	return setting.Value, true
+}
@@ -0,0 +1,153 @@
+package config
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/microsoft/ApplicationInsights-Go/appinsights/contracts"
+	"github.com/microtest/common/telemetry"
+)
+
+func TestRefreshNotifiesSubscribers(t *testing.T) {
+	ctx := context.Background()
+	settings := map[string]string{"NAME": "orders", "PORT": "8080"}
+	useSettings(t, settings)
+	resetWatches(t)
+
+	var names, ports []Change
+	Subscribe(func(change Change) { names = append(names, change) }, "NAME")
+	Subscribe(func(change Change) { ports = append(ports, change) }, "PORT")
+	changes := Watch("NAME", "PORT")
+
+	if err := Refresh(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 || len(ports) != 0 || len(changes) != 0 {
+		t.Fatalf("changes notified without a change: %v, %v, %d", names, ports, len(changes))
+	}
+
+	settings["NAME"] = "payments"
+	delete(settings, "PORT")
+	if err := Refresh(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+	if want := []Change{{Key: "NAME", OldValue: "orders", NewValue: "payments"}}; !reflect.DeepEqual(names, want) {
+		t.Errorf("NAME changes = %v, want %v", names, want)
+	}
+	if want := []Change{{Key: "PORT", OldValue: "8080", NewValue: ""}}; !reflect.DeepEqual(ports, want) {
+		t.Errorf("PORT changes = %v, want %v", ports, want)
+	}
+	if len(changes) != 2 {
+		t.Errorf("watcher received %d changes, want 2", len(changes))
+	}
+	if LastRefresh().IsZero() {
+		t.Error("LastRefresh not set after Refresh")
+	}
+}
+
+func TestRefreshKeepsValuesThatCannotBeRead(t *testing.T) {
+	ctx := context.Background()
+	useSettings(t, map[string]string{"NAME": "orders"})
+	resetWatches(t)
+	changes := Watch("NAME")
+
+	SetProviders(failingProvider{})
+	Refresh(ctx, "")
+	if len(changes) != 0 {
+		t.Errorf("change notified for a key that cannot be read: %+v", <-changes)
+	}
+
+	// Once the store is back the value is compared with the last one read
+	SetProviders(mapProvider{"NAME": "orders"})
+	Refresh(ctx, "")
+	if len(changes) != 0 {
+		t.Errorf("change notified for an unchanged key: %+v", <-changes)
+	}
+}
+
+func TestRefreshWithSentinel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	settings := map[string]string{"NAME": "orders", "SENTINEL": "1"}
+	useSettings(t, settings)
+	resetWatches(t)
+	changes := Watch("NAME")
+	StartRefresh(ctx, RefreshOptions{Interval: time.Hour, SentinelKey: "SENTINEL"})
+
+	// Watched keys are not read again until the sentinel changes
+	settings["NAME"] = "payments"
+	Refresh(ctx, "SENTINEL")
+	if len(changes) != 0 {
+		t.Fatalf("change notified before the sentinel changed: %+v", <-changes)
+	}
+
+	settings["SENTINEL"] = "2"
+	Refresh(ctx, "SENTINEL")
+	select {
+	case change := <-changes:
+		if change.NewValue != "payments" {
+			t.Errorf("change = %+v, want NAME changed to payments", change)
+		}
+	default:
+		t.Error("no change notified after the sentinel changed")
+	}
+}
+
+func TestRefreshWithSentinelReadsChangedProviders(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := writeConfigFile(t, dir, "config.yaml", "NAME: orders\nSENTINEL: 1\n")
+	provider, err := NewFileProvider(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	useSettings(t, nil)
+	SetProviders(provider)
+	resetWatches(t)
+	changes := Watch("NAME")
+	Refresh(ctx, "SENTINEL")
+
+	// A modified file is a change even when the sentinel was not updated
+	writeConfigFile(t, dir, "config.yaml", "NAME: payments\nSENTINEL: 1\n")
+	later := time.Now().Add(time.Second)
+	os.Chtimes(path, later, later)
+	Refresh(ctx, "SENTINEL")
+	select {
+	case change := <-changes:
+		if change.NewValue != "payments" {
+			t.Errorf("change = %+v, want NAME changed to payments", change)
+		}
+	default:
+		t.Error("no change notified after the file changed")
+	}
+}
+
+func TestSubscribeTelemetry(t *testing.T) {
+	ctx := context.Background()
+	settings := map[string]string{"LOG_LEVEL": "Warning"}
+	useSettings(t, settings)
+	resetWatches(t)
+	level := telemetry.GetLogLevel()
+	t.Cleanup(func() { telemetry.SetLogLevel(level) })
+
+	SubscribeTelemetry()
+	if got := telemetry.GetLogLevel(); got != contracts.Warning {
+		t.Errorf("log level = %v, want the configured Warning", got)
+	}
+
+	settings["LOG_LEVEL"] = "Error"
+	Refresh(ctx, "")
+	if got := telemetry.GetLogLevel(); got != contracts.Error {
+		t.Errorf("log level = %v after LOG_LEVEL changed, want Error", got)
+	}
+
+	// An invalid level keeps the current one
+	settings["LOG_LEVEL"] = "Loud"
+	Refresh(ctx, "")
+	if got := telemetry.GetLogLevel(); got != contracts.Error {
+		t.Errorf("log level = %v after an invalid LOG_LEVEL, want Error kept", got)
+	}
+}
@@ -0,0 +1,199 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/microtest/common/telemetry"
+)
+
+// Content type of App Configuration settings that reference a Key Vault secret
+const KeyVaultReferenceContentType = "application/vnd.microsoft.appconfig.keyvaultref+json"
+
+// Prefix and suffix of a Key Vault reference written as a plain value (in a file or an environment variable),
+// e.g. @Microsoft.KeyVault(SecretUri=https://myvault.vault.azure.net/secrets/mysecret)
+const (
+	keyVaultReferencePrefix = "@Microsoft.KeyVault(SecretUri="
+	keyVaultReferenceSuffix = ")"
+)
+
+// ErrNoSecretResolver is returned when a setting references a secret but no resolver is configured
+var ErrNoSecretResolver = errors.New("setting references a Key Vault secret but no secret resolver is configured")
+
+// SecretResolver returns the value of a Key Vault secret from its URI
+type SecretResolver interface {
+	Resolve(ctx context.Context, uri string) (string, error)
+}
+
+// Resolver used for Key Vault references, nil until one is configured
+var secretResolver SecretResolver
+
+// SetSecretResolver sets the resolver used for Key Vault references
+func SetSecretResolver(resolver SecretResolver) {
+	secretResolver = resolver
+}
+
+// Returns the secret URI if the setting is a Key Vault reference
+func keyVaultReference(setting Setting) (string, bool, error) {
+	if strings.HasPrefix(strings.ToLower(setting.ContentType), KeyVaultReferenceContentType) {
+		var reference struct {
+			URI string `json:"uri"`
+		}
+		if err := json.Unmarshal([]byte(setting.Value), &reference); err != nil {
+			return "", true, fmt.Errorf("invalid Key Vault reference: %w", err)
+		}
+		return reference.URI, true, nil
+	}
+
+	value := strings.TrimSpace(setting.Value)
+	if strings.HasPrefix(value, keyVaultReferencePrefix) && strings.HasSuffix(value, keyVaultReferenceSuffix) {
+		return strings.TrimSuffix(strings.TrimPrefix(value, keyVaultReferencePrefix), keyVaultReferenceSuffix), true, nil
+	}
+	return "", false, nil
+}
+
+// Replaces the value of a Key Vault reference with the secret, other settings are returned as they are
+func resolveSetting(ctx context.Context, setting Setting) (Setting, error) {
+	uri, isReference, err := keyVaultReference(setting)
+	if !isReference || err != nil {
+		return setting, err
+	}
+	if secretResolver == nil {
+		return setting, ErrNoSecretResolver
+	}
+
+	value, err := secretResolver.Resolve(ctx, uri)
+	if err != nil {
+		return setting, fmt.Errorf("failed to resolve secret %s: %w", uri, err)
+	}
+
+	// The secret is never written to logs or telemetry
+	telemetry.RegisterSecret(value)
+	setting.Value = value
+	setting.SecretURI = uri
+	return setting, nil
+}
+
+// Returns the name of the secret in a Key Vault secret URI (https://<vault>.vault.azure.net/secrets/<name>[/<version>])
+func secretName(uri string) (string, error) {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	parts := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "secrets" || parts[1] == "" {
+		return "", fmt.Errorf("invalid Key Vault secret URI %q", uri)
+	}
+	return parts[1], nil
+}
+
+// EnvSecretResolver reads secrets from environment variables named SECRET_<NAME> (e.g. SECRET_EVENTHUB_CONNECTION for eventhub-connection)
+type EnvSecretResolver struct{}
+
+// Resolve reads the environment variable of the secret
+func (EnvSecretResolver) Resolve(ctx context.Context, uri string) (string, error) {
+	name, err := secretName(uri)
+	if err != nil {
+		return "", err
+	}
+	variable := "SECRET_" + envName(name)
+	value, ok := os.LookupEnv(variable)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", variable)
+	}
+	return value, nil
+}
+
+// FileSecretResolver reads secrets from files named after the secret in a directory, as mounted by Kubernetes
+type FileSecretResolver struct {
+	Dir string
+}
+
+// Resolve reads the file of the secret, surrounding white space is removed
+func (r FileSecretResolver) Resolve(ctx context.Context, uri string) (string, error) {
+	name, err := secretName(uri)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(filepath.Join(r.Dir, name))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// CachingSecretResolver keeps resolved secrets for a time to live, so a secret is not fetched for every lookup
+type CachingSecretResolver struct {
+	inner SecretResolver
+	ttl   time.Duration
+	mu    sync.Mutex
+	cache map[string]cachedSecret
+}
+
+// Secret value and when it must be fetched again
+type cachedSecret struct {
+	value   string
+	expires time.Time
+}
+
+// Creates a resolver that caches the secrets resolved by inner for ttl
+func NewCachingSecretResolver(inner SecretResolver, ttl time.Duration) *CachingSecretResolver {
+	return &CachingSecretResolver{inner: inner, ttl: ttl, cache: map[string]cachedSecret{}}
+}
+
+// Resolve returns the cached secret, or resolves it again once it expired
+func (r *CachingSecretResolver) Resolve(ctx context.Context, uri string) (string, error) {
+	r.mu.Lock()
+	cached, ok := r.cache[uri]
+	r.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.value, nil
+	}
+
+	value, err := r.inner.Resolve(ctx, uri)
+	if err != nil {
+		return "", err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cache[uri] = cachedSecret{value: value, expires: time.Now().Add(r.ttl)}
+	return value, nil
+}
+
+// Creates the resolver selected by SECRET_RESOLVER (env or file, with SECRETS_DIR), cached for SECRET_CACHE_TTL (default 5m)
+func secretResolverFromEnv() (SecretResolver, error) {
+	var resolver SecretResolver
+	switch name := strings.ToLower(os.Getenv("SECRET_RESOLVER")); name {
+	case "":
+		return nil, nil
+	case "env":
+		resolver = EnvSecretResolver{}
+	case "file":
+		dir := os.Getenv("SECRETS_DIR")
+		if dir == "" {
+			return nil, errors.New("file secret resolver requires SECRETS_DIR")
+		}
+		resolver = FileSecretResolver{Dir: dir}
+	default:
+		return nil, fmt.Errorf("unknown secret resolver %q", name)
+	}
+
+	ttl := 5 * time.Minute
+	if value := os.Getenv("SECRET_CACHE_TTL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SECRET_CACHE_TTL: %w", err)
+		}
+		ttl = parsed
+	}
+	return NewCachingSecretResolver(resolver, ttl), nil
+}
@@ -0,0 +1,267 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/microtest/common/telemetry"
+)
+
+// State of the service, readiness only succeeds while it is ready
+type State string
+
+const (
+	Starting State = "starting"
+	Ready    State = "ready"
+	Draining State = "draining"
+)
+
+// Status of a check or of a whole probe
+const (
+	StatusOK       = "ok"
+	StatusFailing  = "failing"
+	StatusDegraded = "degraded"
+)
+
+// Maximum duration of a single check
+const DefaultCheckTimeout = 2 * time.Second
+
+// Check reports a problem with a dependency, nil means healthy
+type Check func(ctx context.Context) error
+
+// Kind of probe a check belongs to
+type kind int
+
+const (
+	liveness kind = iota
+	readiness
+	optional
+)
+
+// Registered check
+type registration struct {
+	check Check
+	kind  kind
+}
+
+// Result of a check as reported by the endpoints
+type CheckResult struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Report is the response of /healthz and /readyz
+type Report struct {
+	Status string                 `json:"status"`
+	State  State                  `json:"state"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+var (
+	mu           sync.RWMutex
+	checks       = map[string]registration{}
+	state        = Starting
+	checkTimeout = DefaultCheckTimeout
+)
+
+// Logger for the health package
+var logger = telemetry.NewLogger("Health")
+
+// Register adds a readiness check, the service is not ready while it fails (broker, checkpoint store, ...)
+func Register(name string, check Check) {
+	register(name, check, readiness)
+}
+
+// RegisterOptional adds a readiness check that is reported but never makes the service unready (e.g. a store with a fallback)
+func RegisterOptional(name string, check Check) {
+	register(name, check, optional)
+}
+
+// RegisterLiveness adds a liveness check, the process is restarted while it fails. Only use it for problems a restart fixes.
+func RegisterLiveness(name string, check Check) {
+	register(name, check, liveness)
+}
+
+func register(name string, check Check, k kind) {
+	mu.Lock()
+	defer mu.Unlock()
+	checks[name] = registration{check: check, kind: k}
+}
+
+// SetCheckTimeout sets the maximum duration of a single check
+func SetCheckTimeout(timeout time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+	checkTimeout = timeout
+}
+
+// SetReady marks the end of the startup, readiness now depends on the checks
+func SetReady() {
+	setState(Ready)
+}
+
+// SetDraining makes readiness fail so no new work is sent while the service stops
+func SetDraining() {
+	setState(Draining)
+}
+
+// GetState returns the state of the service
+func GetState() State {
+	mu.RLock()
+	defer mu.RUnlock()
+	return state
+}
+
+func setState(newState State) {
+	mu.Lock()
+	previous := state
+	state = newState
+	mu.Unlock()
+	if previous != newState {
+		logger.Info(context.Background(), "Service state changed", "From", string(previous), "To", string(newState))
+	}
+}
+
+// Liveness runs the liveness checks
+func Liveness(ctx context.Context) Report {
+	report := run(ctx, liveness)
+	if report.Status == StatusDegraded {
+		report.Status = StatusOK
+	}
+	return report
+}
+
+// Readiness runs the readiness checks, it fails while the service is starting or draining
+func Readiness(ctx context.Context) Report {
+	report := run(ctx, readiness, optional)
+	if report.State != Ready {
+		report.Status = StatusFailing
+	}
+	return report
+}
+
+// Runs the checks of the kinds concurrently
+func run(ctx context.Context, kinds ...kind) Report {
+	mu.RLock()
+	selected := map[string]registration{}
+	for name, reg := range checks {
+		for _, k := range kinds {
+			if reg.kind == k {
+				selected[name] = reg
+			}
+		}
+	}
+	report := Report{Status: StatusOK, State: state, Checks: map[string]CheckResult{}}
+	timeout := checkTimeout
+	mu.RUnlock()
+
+	var wg sync.WaitGroup
+	var resultsMu sync.Mutex
+	for name, reg := range selected {
+		wg.Add(1)
+		go func(name string, reg registration) {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			start := time.Now()
+			err := runCheck(checkCtx, reg.check)
+			result := CheckResult{Status: StatusOK, Duration: time.Since(start).String()}
+			if err != nil {
+				result.Status = StatusFailing
+				result.Error = telemetry.Redact(err.Error())
+			}
+
+			resultsMu.Lock()
+			defer resultsMu.Unlock()
+			report.Checks[name] = result
+			if err != nil {
+				if reg.kind == optional {
+					if report.Status == StatusOK {
+						report.Status = StatusDegraded
+					}
+				} else {
+					report.Status = StatusFailing
+				}
+			}
+		}(name, reg)
+	}
+	wg.Wait()
+	return report
+}
+
+// Runs a check, a check that does not return in time or panics fails
+func runCheck(ctx context.Context, check Check) (err error) {
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- panicError{r}
+			}
+		}()
+		done <- check(ctx)
+	}()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return err
+}
+
+// Error of a check that panicked
+type panicError struct {
+	value interface{}
+}
+
+func (e panicError) Error() string {
+	return fmt.Sprintf("check panicked: %v", e.value)
+}
+
+// LivenessHandler serves /healthz
+func LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, r, Liveness(r.Context()))
+	})
+}
+
+// ReadinessHandler serves /readyz
+func ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, r, Readiness(r.Context()))
+	})
+}
+
+// Writes the report as JSON, 503 when it fails
+func writeReport(w http.ResponseWriter, r *http.Request, report Report) {
+	status := http.StatusOK
+	if report.Status == StatusFailing {
+		status = http.StatusServiceUnavailable
+
+		// Failing checks are logged in a stable order, starting and draining are expected
+		var failing []string
+		for name, result := range report.Checks {
+			if result.Status == StatusFailing {
+				failing = append(failing, name)
+			}
+		}
+		if len(failing) > 0 {
+			sort.Strings(failing)
+			logger.Warning(r.Context(), "Health probe failing", "Path", r.URL.Path, "State", string(report.State), "FailingChecks", failing)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		logger.Error(r.Context(), "Failed to write health report", "Error", err)
+	}
+}
@@ -0,0 +1,188 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/microtest/common/telemetry"
+)
+
+// Starts the test without checks, in the Starting state
+func resetHealth(t *testing.T) {
+	t.Helper()
+	telemetry.SetLogOutput(io.Discard)
+	reset := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		checks = map[string]registration{}
+		state = Starting
+		checkTimeout = DefaultCheckTimeout
+	}
+	reset()
+	t.Cleanup(func() {
+		reset()
+		telemetry.SetLogOutput(os.Stdout)
+	})
+}
+
+func passing(ctx context.Context) error { return nil }
+
+func failing(ctx context.Context) error { return errors.New("unreachable") }
+
+func TestStateTransitions(t *testing.T) {
+	resetHealth(t)
+	Register("broker", passing)
+	ctx := context.Background()
+
+	tests := []struct {
+		name          string
+		transition    func()
+		wantState     State
+		wantReadiness string
+	}{
+		{"starting", func() {}, Starting, StatusFailing},
+		{"ready", SetReady, Ready, StatusOK},
+		{"draining", SetDraining, Draining, StatusFailing},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.transition()
+			if got := GetState(); got != tt.wantState {
+				t.Fatalf("GetState = %s, want %s", got, tt.wantState)
+			}
+			report := Readiness(ctx)
+			if report.Status != tt.wantReadiness || report.State != tt.wantState {
+				t.Errorf("Readiness = %s in state %s, want %s", report.Status, report.State, tt.wantReadiness)
+			}
+
+			// The process is alive whatever its state
+			if report := Liveness(ctx); report.Status != StatusOK {
+				t.Errorf("Liveness = %s, want %s", report.Status, StatusOK)
+			}
+		})
+	}
+}
+
+func TestCheckKinds(t *testing.T) {
+	tests := []struct {
+		name          string
+		register      func()
+		wantReadiness string
+		wantLiveness  string
+	}{
+		{"no checks", func() {}, StatusOK, StatusOK},
+		{"passing checks", func() {
+			Register("broker", passing)
+			RegisterOptional("config", passing)
+			RegisterLiveness("loop", passing)
+		}, StatusOK, StatusOK},
+		{"failing readiness check", func() { Register("broker", failing) }, StatusFailing, StatusOK},
+		{"failing optional check degrades readiness", func() {
+			Register("broker", passing)
+			RegisterOptional("config", failing)
+		}, StatusDegraded, StatusOK},
+		{"failing readiness check wins over a degraded one", func() {
+			Register("broker", failing)
+			RegisterOptional("config", failing)
+		}, StatusFailing, StatusOK},
+		{"failing liveness check", func() { RegisterLiveness("loop", failing) }, StatusOK, StatusFailing},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetHealth(t)
+			tt.register()
+			SetReady()
+			ctx := context.Background()
+
+			readinessReport := Readiness(ctx)
+			if readinessReport.Status != tt.wantReadiness {
+				t.Errorf("Readiness = %s, want %s", readinessReport.Status, tt.wantReadiness)
+			}
+			livenessReport := Liveness(ctx)
+			if livenessReport.Status != tt.wantLiveness {
+				t.Errorf("Liveness = %s, want %s", livenessReport.Status, tt.wantLiveness)
+			}
+
+			// Each probe only runs its own checks
+			for name := range readinessReport.Checks {
+				if checks[name].kind == liveness {
+					t.Errorf("liveness check %s run by readiness", name)
+				}
+			}
+			for name := range livenessReport.Checks {
+				if checks[name].kind != liveness {
+					t.Errorf("check %s run by liveness", name)
+				}
+			}
+		})
+	}
+}
+
+func TestChecksThatHangOrPanicFail(t *testing.T) {
+	resetHealth(t)
+	SetCheckTimeout(20 * time.Millisecond)
+	Register("hangs", func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	})
+	Register("panics", func(ctx context.Context) error { panic("nil client") })
+	SetReady()
+
+	start := time.Now()
+	report := Readiness(context.Background())
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Readiness took %v, want the check abandoned after its timeout", elapsed)
+	}
+	if report.Status != StatusFailing {
+		t.Errorf("Readiness = %s, want %s", report.Status, StatusFailing)
+	}
+	for _, name := range []string{"hangs", "panics"} {
+		if result := report.Checks[name]; result.Status != StatusFailing || result.Error == "" {
+			t.Errorf("%s = %+v, want a failure with its error", name, result)
+		}
+	}
+}
+
+func TestHandlers(t *testing.T) {
+	resetHealth(t)
+	Register("broker", func(ctx context.Context) error {
+		return errors.New("dial Endpoint=sb://test/;SharedAccessKey=abc123 failed")
+	})
+	SetReady()
+
+	tests := []struct {
+		name       string
+		handler    http.Handler
+		wantStatus int
+	}{
+		{"liveness", LivenessHandler(), http.StatusOK},
+		{"readiness", ReadinessHandler(), http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tt.handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+tt.name, nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if w.Header().Get("Cache-Control") != "no-store" {
+				t.Error("probe response can be cached")
+			}
+
+			var report Report
+			if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+				t.Fatal(err)
+			}
+			if result, ok := report.Checks["broker"]; ok && result.Error != "dial Endpoint=sb://test/;SharedAccessKey=***** failed" {
+				t.Errorf("check error = %q, want the access key masked", result.Error)
+			}
+		})
+	}
+}
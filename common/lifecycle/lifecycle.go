@@ -0,0 +1,190 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/microtest/common/health"
+	"github.com/microtest/common/telemetry"
+)
+
+// Hook is a shutdown step, it must return before the context is done
+type Hook func(ctx context.Context) error
+
+// Named shutdown step
+type step struct {
+	name string
+	hook Hook
+}
+
+var (
+	mu      sync.Mutex
+	steps   []step
+	ctx     context.Context
+	cancel  context.CancelFunc
+	failure error
+)
+
+// In-flight work, drained is closed when the count goes back to zero
+var (
+	inFlightMu sync.Mutex
+	inFlight   int
+	drained    chan struct{}
+)
+
+// Logger for the lifecycle package
+var logger = telemetry.NewLogger("Lifecycle")
+
+// Start returns a context that is cancelled when the process receives SIGTERM or SIGINT, or when Stop or Fail is called.
+// Long running work (HTTP servers, event receivers) stops when it is done, then Shutdown runs the hooks.
+func Start() context.Context {
+	mu.Lock()
+	defer mu.Unlock()
+	if ctx == nil {
+		ctx, cancel = signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	}
+	return ctx
+}
+
+// Done returns a channel that is closed when the service starts stopping
+func Done() <-chan struct{} {
+	return Start().Done()
+}
+
+// Stop starts stopping the service as if it received SIGTERM
+func Stop() {
+	Start()
+	cancel()
+}
+
+// Fail stops the service after an unrecoverable error, Shutdown then returns the error
+func Fail(err error) {
+	mu.Lock()
+	if failure == nil {
+		failure = err
+	}
+	mu.Unlock()
+	logger.Critical(context.Background(), "Stopping after unrecoverable error", "Error", err)
+	Stop()
+}
+
+// OnShutdown adds a step to the shutdown, steps run one after the other in the order they are added
+func OnShutdown(name string, hook Hook) {
+	mu.Lock()
+	defer mu.Unlock()
+	steps = append(steps, step{name: name, hook: hook})
+}
+
+// Track counts a unit of in-flight work, call the returned function when it is done.
+// Work can be tracked while Drain waits, Drain then also waits for it.
+func Track() func() {
+	inFlightMu.Lock()
+	if inFlight == 0 {
+		drained = make(chan struct{})
+	}
+	inFlight++
+	inFlightMu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			inFlightMu.Lock()
+			defer inFlightMu.Unlock()
+			inFlight--
+			if inFlight == 0 {
+				close(drained)
+			}
+		})
+	}
+}
+
+// Drain waits until all tracked work is done, or the context is done
+func Drain(ctx context.Context) error {
+	for {
+		inFlightMu.Lock()
+		if inFlight == 0 {
+			inFlightMu.Unlock()
+			return nil
+		}
+		done := drained
+		count := inFlight
+		inFlightMu.Unlock()
+
+		select {
+		case <-done:
+			// Check again, work may have started since
+		case <-ctx.Done():
+			return fmt.Errorf("%d unit(s) of in-flight work not drained: %w", count, ctx.Err())
+		}
+	}
+}
+
+// Shutdown makes readiness fail, runs the shutdown steps within the timeout and flushes telemetry.
+// A step that fails or times out does not stop the next ones, every error is returned together with the failure passed to Fail.
+func Shutdown(timeout time.Duration) error {
+	health.SetDraining()
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), timeout)
+	defer shutdownCancel()
+
+	mu.Lock()
+	pending := append([]step(nil), steps...)
+	errs := []error{failure}
+	mu.Unlock()
+
+	logger.Info(shutdownCtx, "Shutdown started", "Timeout", timeout.String(), "Steps", len(pending))
+	for _, s := range pending {
+		start := time.Now()
+		err := runStep(shutdownCtx, s)
+		if err != nil {
+			logger.Error(shutdownCtx, "Shutdown step failed", "Step", s.name, "Duration", time.Since(start).String(), "Error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", s.name, err))
+			continue
+		}
+		logger.Info(shutdownCtx, "Shutdown step complete", "Step", s.name, "Duration", time.Since(start).String())
+	}
+
+	// Telemetry is flushed last so the shutdown itself is reported, with its own deadline if the steps used all the time
+	flushCtx := shutdownCtx
+	if deadline, _ := shutdownCtx.Deadline(); time.Until(deadline) < telemetry.PanicFlushTimeout {
+		var flushCancel context.CancelFunc
+		flushCtx, flushCancel = context.WithTimeout(context.Background(), telemetry.PanicFlushTimeout)
+		defer flushCancel()
+	}
+	logger.Info(flushCtx, "Shutdown complete")
+	if dropped, err := telemetry.Shutdown(flushCtx); err != nil {
+		logger.Warning(flushCtx, "Telemetry not flushed", "Dropped", dropped, "Error", err)
+		errs = append(errs, fmt.Errorf("telemetry: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// Runs a step, a step that does not return once the deadline passed is abandoned
+func runStep(ctx context.Context, s step) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("panic: %v", r)
+			}
+		}()
+		done <- s.hook(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,174 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/microtest/common/health"
+	"github.com/microtest/common/telemetry"
+)
+
+// Starts the test without shutdown steps, failure nor stop signal
+func resetLifecycle(t *testing.T) {
+	t.Helper()
+	telemetry.SetLogOutput(io.Discard)
+	reset := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if cancel != nil {
+			cancel()
+		}
+		steps, failure, ctx, cancel = nil, nil, nil, nil
+	}
+	reset()
+	t.Cleanup(func() {
+		reset()
+		health.SetReady()
+		telemetry.SetLogOutput(os.Stdout)
+	})
+}
+
+func TestShutdownRunsStepsInOrder(t *testing.T) {
+	resetLifecycle(t)
+	var mu sync.Mutex
+	var ran []string
+	record := func(name string, err error) Hook {
+		return func(ctx context.Context) error {
+			mu.Lock()
+			defer mu.Unlock()
+			ran = append(ran, name)
+			return err
+		}
+	}
+	OnShutdown("http", record("http", nil))
+	OnShutdown("receiver", record("receiver", errors.New("close failed")))
+	OnShutdown("panics", func(ctx context.Context) error { panic("nil client") })
+	OnShutdown("checkpoints", record("checkpoints", nil))
+
+	err := Shutdown(time.Second)
+	if got := strings.Join(ran, ","); got != "http,receiver,checkpoints" {
+		t.Errorf("steps ran %s, want http,receiver,checkpoints", got)
+	}
+
+	// Failed steps do not stop the next ones and are all reported
+	if err == nil || !strings.Contains(err.Error(), "receiver: close failed") || !strings.Contains(err.Error(), "panics: panic: nil client") {
+		t.Errorf("Shutdown error = %v, want the errors of the receiver and panics steps", err)
+	}
+	if state := health.GetState(); state != health.Draining {
+		t.Errorf("health state = %s, want %s", state, health.Draining)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	resetLifecycle(t)
+	release := make(chan struct{})
+	defer close(release)
+	nextRan := false
+	OnShutdown("hangs", func(ctx context.Context) error {
+		<-release
+		return nil
+	})
+	OnShutdown("next", func(ctx context.Context) error {
+		nextRan = true
+		return nil
+	})
+
+	start := time.Now()
+	err := Shutdown(50 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Shutdown took %v, want the hanging step abandoned at the deadline", elapsed)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "hangs:") {
+		t.Errorf("Shutdown error = %v, want the hanging step past the deadline", err)
+	}
+	if nextRan {
+		t.Error("step run after the deadline passed")
+	}
+}
+
+func TestShutdownFlushesTelemetryLast(t *testing.T) {
+	resetLifecycle(t)
+	recorder := telemetry.InitTelemetryRecorder("test")
+	OnShutdown("http", func(ctx context.Context) error {
+		telemetry.TrackMetric("RequestsDrained", 1, nil)
+		return nil
+	})
+
+	if err := Shutdown(time.Second); err != nil {
+		t.Fatalf("Shutdown error = %v", err)
+	}
+
+	// Telemetry of the steps and of the shutdown itself is sent, nothing once it was flushed
+	if metrics := recorder.Metrics(); len(metrics) != 1 {
+		t.Errorf("got %d metrics, want the one tracked by the step", len(metrics))
+	}
+	records := recorder.Records()
+	if len(records) == 0 {
+		t.Fatal("no telemetry recorded")
+	}
+	if last := records[len(records)-1]; !strings.Contains(last.Message, "Shutdown complete") {
+		t.Errorf("last record = %q, want the end of the shutdown", last.Message)
+	}
+	telemetry.TrackMetric("AfterShutdown", 1, nil)
+	if metrics := recorder.Metrics(); len(metrics) != 1 {
+		t.Error("telemetry recorded after it was flushed")
+	}
+}
+
+func TestFailStopsTheService(t *testing.T) {
+	resetLifecycle(t)
+	ctx := Start()
+	failure := errors.New("checkpoint store unreachable")
+	Fail(failure)
+	Fail(errors.New("second failure"))
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("context not cancelled by Fail")
+	}
+	err := Shutdown(time.Second)
+	if !errors.Is(err, failure) || strings.Contains(err.Error(), "second failure") {
+		t.Errorf("Shutdown error = %v, want the first failure", err)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	first := Track()
+	second := Track()
+
+	// Not drained before the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := Drain(ctx); err == nil || !strings.Contains(err.Error(), "2 unit(s)") {
+		t.Errorf("Drain error = %v, want 2 units not drained", err)
+	}
+
+	// Work tracked while Drain waits is waited for too
+	drainErr := make(chan error, 1)
+	go func() { drainErr <- Drain(context.Background()) }()
+	first()
+	first()
+	late := Track()
+	second()
+	select {
+	case err := <-drainErr:
+		t.Fatalf("Drain returned %v while work was in flight", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	late()
+	select {
+	case err := <-drainErr:
+		if err != nil {
+			t.Errorf("Drain error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Drain did not return once the work was done")
+	}
+}
@@ -0,0 +1,219 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs"
+)
+
+// Checkpoint policies, the checkpoint never moves past an event that was not acknowledged
+const (
+	// After every received batch
+	CheckpointPerBatch = "batch"
+
+	// After every N acknowledged events
+	CheckpointEveryN = "count"
+
+	// When the interval elapsed since the last checkpoint
+	CheckpointOnInterval = "interval"
+
+	// After every acknowledged event
+	CheckpointOnAck = "ack"
+)
+
+// Default maximum time to write a checkpoint
+const DefaultCheckpointTimeout = 10 * time.Second
+
+// CheckpointPolicy decides when a partition writes its checkpoint
+type CheckpointPolicy struct {
+	// batch (default), count, interval or ack
+	Mode string
+
+	// Number of acknowledged events between two checkpoints, for count
+	Count int
+
+	// Minimum time between two checkpoints, for interval
+	Interval time.Duration
+
+	// Maximum time to write a checkpoint
+	Timeout time.Duration
+}
+
+// Validate checks the policy has the settings its mode needs
+func (p CheckpointPolicy) Validate() error {
+	switch p.Mode {
+	case "", CheckpointPerBatch, CheckpointOnAck:
+		return nil
+	case CheckpointEveryN:
+		if p.Count <= 0 {
+			return errors.New("count checkpoint policy requires a positive count")
+		}
+		return nil
+	case CheckpointOnInterval:
+		if p.Interval <= 0 {
+			return errors.New("interval checkpoint policy requires a positive interval")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown checkpoint policy %q", p.Mode)
+}
+
+// CheckpointUpdater writes the checkpoint of a partition, implemented by *azeventhubs.ProcessorPartitionClient
+type CheckpointUpdater interface {
+	UpdateCheckpoint(ctx context.Context, latestEvent *azeventhubs.ReceivedEventData, options *azeventhubs.UpdateCheckpointOptions) error
+}
+
+// Event received and not yet part of a checkpoint
+type pendingEvent struct {
+	event *azeventhubs.ReceivedEventData
+	acked bool
+}
+
+// Checkpointer writes the checkpoint of a partition following a policy, for at-least-once delivery.
+// Received events are tracked in order and acknowledged once they are processed, in any order.
+// The checkpoint only moves up to the last event before the first one that is not acknowledged,
+// so an event that is not acknowledged when the partition stops is received again after a restart.
+// Every tracked event must eventually be acknowledged, including the ones that failed once they are
+// logged or dead-lettered, otherwise the checkpoint stops moving and pending events accumulate.
+type Checkpointer struct {
+	client CheckpointUpdater
+	policy CheckpointPolicy
+
+	// Serializes checkpoint writes so they are never written out of order
+	writeMu sync.Mutex
+
+	mu              sync.Mutex
+	pending         []*pendingEvent
+	bySequence      map[int64]*pendingEvent
+	completed       *azeventhubs.ReceivedEventData
+	sinceCheckpoint int
+	lastCheckpoint  time.Time
+}
+
+// Creates a checkpointer for a partition client
+func NewCheckpointer(client CheckpointUpdater, policy CheckpointPolicy) *Checkpointer {
+	if policy.Mode == "" {
+		policy.Mode = CheckpointPerBatch
+	}
+	if policy.Timeout <= 0 {
+		policy.Timeout = DefaultCheckpointTimeout
+	}
+	return &Checkpointer{client: client, policy: policy, bySequence: map[int64]*pendingEvent{}, lastCheckpoint: time.Now()}
+}
+
+// Track registers received events in the order they were received, before they are acknowledged
+func (c *Checkpointer) Track(events []*azeventhubs.ReceivedEventData) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, event := range events {
+		pending := &pendingEvent{event: event}
+		c.pending = append(c.pending, pending)
+		c.bySequence[event.SequenceNumber] = pending
+	}
+}
+
+// Ack marks an event as processed, and writes the checkpoint if the policy says so
+func (c *Checkpointer) Ack(ctx context.Context, event *azeventhubs.ReceivedEventData) error {
+	c.mu.Lock()
+	pending, ok := c.bySequence[event.SequenceNumber]
+	if !ok {
+		c.mu.Unlock()
+		return fmt.Errorf("event %d was not tracked", event.SequenceNumber)
+	}
+	pending.acked = true
+	c.advance()
+
+	due := false
+	switch c.policy.Mode {
+	case CheckpointOnAck:
+		due = c.completed != nil
+	case CheckpointEveryN:
+		due = c.sinceCheckpoint >= c.policy.Count
+	case CheckpointOnInterval:
+		due = c.completed != nil && time.Since(c.lastCheckpoint) >= c.policy.Interval
+	}
+	c.mu.Unlock()
+
+	if !due {
+		return nil
+	}
+	return c.checkpoint(ctx)
+}
+
+// BatchDone is called after every receive, including empty ones.
+// It writes the checkpoint for the batch policy, and for the interval policy when no event arrived in time.
+func (c *Checkpointer) BatchDone(ctx context.Context) error {
+	c.mu.Lock()
+	due := false
+	switch c.policy.Mode {
+	case CheckpointPerBatch:
+		due = c.completed != nil
+	case CheckpointOnInterval:
+		due = c.completed != nil && time.Since(c.lastCheckpoint) >= c.policy.Interval
+	}
+	c.mu.Unlock()
+
+	if !due {
+		return nil
+	}
+	return c.checkpoint(ctx)
+}
+
+// Flush writes the checkpoint of the acknowledged events whatever the policy, call it before the partition is closed
+func (c *Checkpointer) Flush(ctx context.Context) error {
+	return c.checkpoint(ctx)
+}
+
+// Pending returns the number of tracked events that are not part of a checkpoint yet
+func (c *Checkpointer) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending)
+}
+
+// Moves the acknowledged events at the front out of pending. Called with the lock held.
+func (c *Checkpointer) advance() {
+	for len(c.pending) > 0 && c.pending[0].acked {
+		c.completed = c.pending[0].event
+		delete(c.bySequence, c.completed.SequenceNumber)
+		c.pending[0] = nil
+		c.pending = c.pending[1:]
+		c.sinceCheckpoint++
+	}
+}
+
+// Writes the checkpoint of the last completed event, if it changed
+func (c *Checkpointer) checkpoint(ctx context.Context) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.mu.Lock()
+	event := c.completed
+	count := c.sinceCheckpoint
+	c.completed = nil
+	c.sinceCheckpoint = 0
+	c.lastCheckpoint = time.Now()
+	c.mu.Unlock()
+
+	if event == nil {
+		return nil
+	}
+
+	writeCtx, cancel := context.WithTimeout(ctx, c.policy.Timeout)
+	defer cancel()
+	if err := c.client.UpdateCheckpoint(writeCtx, event, nil); err != nil {
+		// Keep the event so the next checkpoint writes it, unless a newer one completed meanwhile
+		c.mu.Lock()
+		if c.completed == nil {
+			c.completed = event
+		}
+		c.sinceCheckpoint += count
+		c.mu.Unlock()
+		return err
+	}
+	return nil
+}
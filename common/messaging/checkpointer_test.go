@@ -0,0 +1,160 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs"
+)
+
+// Records the checkpoints written, fails while err is set
+type fakeCheckpointUpdater struct {
+	mu      sync.Mutex
+	written []int64
+	err     error
+}
+
+func (f *fakeCheckpointUpdater) UpdateCheckpoint(ctx context.Context, latestEvent *azeventhubs.ReceivedEventData, options *azeventhubs.UpdateCheckpointOptions) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	f.written = append(f.written, latestEvent.SequenceNumber)
+	return nil
+}
+
+// Sequence number of the last checkpoint written, -1 if none was
+func (f *fakeCheckpointUpdater) last() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.written) == 0 {
+		return -1
+	}
+	return f.written[len(f.written)-1]
+}
+
+func testEvents(sequenceNumbers ...int64) []*azeventhubs.ReceivedEventData {
+	events := make([]*azeventhubs.ReceivedEventData, len(sequenceNumbers))
+	for i, sequenceNumber := range sequenceNumbers {
+		events[i] = &azeventhubs.ReceivedEventData{SequenceNumber: sequenceNumber}
+	}
+	return events
+}
+
+func TestCheckpointPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  CheckpointPolicy
+		wantErr bool
+	}{
+		{"default", CheckpointPolicy{}, false},
+		{"batch", CheckpointPolicy{Mode: CheckpointPerBatch}, false},
+		{"ack", CheckpointPolicy{Mode: CheckpointOnAck}, false},
+		{"count", CheckpointPolicy{Mode: CheckpointEveryN, Count: 10}, false},
+		{"count without count", CheckpointPolicy{Mode: CheckpointEveryN}, true},
+		{"interval", CheckpointPolicy{Mode: CheckpointOnInterval, Interval: time.Second}, false},
+		{"interval without interval", CheckpointPolicy{Mode: CheckpointOnInterval}, true},
+		{"unknown", CheckpointPolicy{Mode: "never"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.policy.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate error = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckpointerPolicies(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy CheckpointPolicy
+		acks   []int64
+		batch  bool
+		want   int64
+	}{
+		{"batch waits for the end of the batch", CheckpointPolicy{Mode: CheckpointPerBatch}, []int64{1, 2, 3}, false, -1},
+		{"batch at the end of the batch", CheckpointPolicy{Mode: CheckpointPerBatch}, []int64{1, 2, 3}, true, 3},
+		{"ack after every event", CheckpointPolicy{Mode: CheckpointOnAck}, []int64{1, 2}, false, 2},
+		{"count below the count", CheckpointPolicy{Mode: CheckpointEveryN, Count: 3}, []int64{1, 2}, false, -1},
+		{"count reached", CheckpointPolicy{Mode: CheckpointEveryN, Count: 2}, []int64{1, 2, 3}, false, 2},
+		{"interval not elapsed", CheckpointPolicy{Mode: CheckpointOnInterval, Interval: time.Hour}, []int64{1, 2}, true, -1},
+		{"out of order acks stop at the first gap", CheckpointPolicy{Mode: CheckpointOnAck}, []int64{1, 3, 4}, false, 1},
+		{"gap filled", CheckpointPolicy{Mode: CheckpointOnAck}, []int64{2, 3, 1}, false, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			updater := &fakeCheckpointUpdater{}
+			checkpointer := NewCheckpointer(updater, tt.policy)
+			checkpointer.Track(testEvents(1, 2, 3, 4))
+
+			for _, sequenceNumber := range tt.acks {
+				if err := checkpointer.Ack(ctx, &azeventhubs.ReceivedEventData{SequenceNumber: sequenceNumber}); err != nil {
+					t.Fatalf("Ack(%d) error = %v", sequenceNumber, err)
+				}
+			}
+			if tt.batch {
+				if err := checkpointer.BatchDone(ctx); err != nil {
+					t.Fatalf("BatchDone error = %v", err)
+				}
+			}
+			if got := updater.last(); got != tt.want {
+				t.Errorf("last checkpoint = %d, want %d (written %v)", got, tt.want, updater.written)
+			}
+		})
+	}
+}
+
+func TestCheckpointerFlushAndPending(t *testing.T) {
+	ctx := context.Background()
+	updater := &fakeCheckpointUpdater{}
+	checkpointer := NewCheckpointer(updater, CheckpointPolicy{Mode: CheckpointOnInterval, Interval: time.Hour})
+	checkpointer.Track(testEvents(1, 2, 3))
+
+	if err := checkpointer.Ack(ctx, &azeventhubs.ReceivedEventData{SequenceNumber: 9}); err == nil {
+		t.Error("Ack of an event that was not tracked succeeded")
+	}
+	checkpointer.Ack(ctx, &azeventhubs.ReceivedEventData{SequenceNumber: 1})
+	checkpointer.Ack(ctx, &azeventhubs.ReceivedEventData{SequenceNumber: 2})
+	if pending := checkpointer.Pending(); pending != 1 {
+		t.Errorf("Pending = %d, want 1", pending)
+	}
+
+	if err := checkpointer.Flush(ctx); err != nil {
+		t.Fatalf("Flush error = %v", err)
+	}
+	if got := updater.last(); got != 2 {
+		t.Errorf("last checkpoint after Flush = %d, want 2", got)
+	}
+
+	// Nothing new was acknowledged, the checkpoint is not written again
+	checkpointer.Flush(ctx)
+	if len(updater.written) != 1 {
+		t.Errorf("written %v, want a single checkpoint", updater.written)
+	}
+}
+
+func TestCheckpointerRetriesFailedWrites(t *testing.T) {
+	ctx := context.Background()
+	updater := &fakeCheckpointUpdater{err: errors.New("storage unavailable")}
+	checkpointer := NewCheckpointer(updater, CheckpointPolicy{Mode: CheckpointOnAck})
+	checkpointer.Track(testEvents(1, 2))
+
+	if err := checkpointer.Ack(ctx, &azeventhubs.ReceivedEventData{SequenceNumber: 1}); err == nil {
+		t.Fatal("Ack succeeded while the checkpoint could not be written")
+	}
+
+	// The failed checkpoint is written by the next one
+	updater.err = nil
+	if err := checkpointer.Flush(ctx); err != nil {
+		t.Fatalf("Flush error = %v", err)
+	}
+	if got := updater.last(); got != 1 {
+		t.Errorf("last checkpoint = %d, want 1", got)
+	}
+}
@@ -0,0 +1,205 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs/checkpoints"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/google/uuid"
+)
+
+// Types of checkpoint store
+const (
+	BlobCheckpointStoreType   = "blob"
+	FileCheckpointStoreType   = "file"
+	MemoryCheckpointStoreType = "memory"
+)
+
+// CheckpointStore keeps the checkpoints and the partition ownership of the consumer groups.
+// Ownership is claimed with ETags: a claim without an ETag only succeeds if the partition was never owned,
+// a claim with an ETag only succeeds if the ownership was not changed since it was read.
+type CheckpointStore interface {
+	azeventhubs.CheckpointStore
+
+	// Name of the type of store (blob, file or memory)
+	Name() string
+
+	// Check verifies that the store can be reached
+	Check(ctx context.Context) error
+}
+
+// CheckpointStoreOptions selects and configures a checkpoint store
+type CheckpointStoreOptions struct {
+	// blob (default), file or memory
+	Type string
+
+	// Storage account connection string and container of the blob store
+	ConnectionString string
+	ContainerName    string
+
+	// Directory of the file store
+	Dir string
+}
+
+// Creates the checkpoint store described by the options
+func NewCheckpointStore(options CheckpointStoreOptions) (CheckpointStore, error) {
+	switch strings.ToLower(options.Type) {
+	case "", BlobCheckpointStoreType:
+		return NewBlobCheckpointStore(options.ConnectionString, options.ContainerName)
+	case FileCheckpointStoreType:
+		return NewFileCheckpointStore(options.Dir)
+	case MemoryCheckpointStoreType:
+		return NewMemoryCheckpointStore(), nil
+	}
+	return nil, fmt.Errorf("unknown checkpoint store type %q", options.Type)
+}
+
+// BlobCheckpointStore keeps checkpoints and ownership in an Azure Storage container
+type BlobCheckpointStore struct {
+	*checkpoints.BlobStore
+	containerClient *container.Client
+}
+
+// Creates a blob checkpoint store from a storage account connection string and a container name
+func NewBlobCheckpointStore(connectionString, containerName string) (*BlobCheckpointStore, error) {
+	if connectionString == "" || containerName == "" {
+		return nil, errors.New("blob checkpoint store requires a connection string and a container name")
+	}
+
+	// Create a container client using a connection string and container name
+	containerClient, err := container.NewClientFromConnectionString(connectionString, containerName, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create a checkpoint store that will be used by the event hub
+	blobStore, err := checkpoints.NewBlobStore(containerClient, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &BlobCheckpointStore{BlobStore: blobStore, containerClient: containerClient}, nil
+}
+
+// Name of the store
+func (s *BlobCheckpointStore) Name() string {
+	return BlobCheckpointStoreType
+}
+
+// Check reads the container properties
+func (s *BlobCheckpointStore) Check(ctx context.Context) error {
+	_, err := s.containerClient.GetProperties(ctx, nil)
+	return err
+}
+
+// MemoryCheckpointStore keeps checkpoints and ownership in memory, for tests and a single local consumer.
+// Everything is lost when the process stops.
+type MemoryCheckpointStore struct {
+	mu          sync.Mutex
+	ownerships  map[string]azeventhubs.Ownership
+	checkpoints map[string]azeventhubs.Checkpoint
+}
+
+// Creates an empty in-memory checkpoint store
+func NewMemoryCheckpointStore() *MemoryCheckpointStore {
+	return &MemoryCheckpointStore{ownerships: map[string]azeventhubs.Ownership{}, checkpoints: map[string]azeventhubs.Checkpoint{}}
+}
+
+// Name of the store
+func (s *MemoryCheckpointStore) Name() string {
+	return MemoryCheckpointStoreType
+}
+
+// Check always succeeds
+func (s *MemoryCheckpointStore) Check(ctx context.Context) error {
+	return nil
+}
+
+// ClaimOwnership claims the partitions whose ETag still matches, and returns the claimed ones
+func (s *MemoryCheckpointStore) ClaimOwnership(ctx context.Context, partitionOwnership []azeventhubs.Ownership, options *azeventhubs.ClaimOwnershipOptions) ([]azeventhubs.Ownership, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var claimed []azeventhubs.Ownership
+	for _, requested := range partitionOwnership {
+		key := partitionKey(requested.FullyQualifiedNamespace, requested.EventHubName, requested.ConsumerGroup, requested.PartitionID)
+		var current *azeventhubs.Ownership
+		if ownership, ok := s.ownerships[key]; ok {
+			current = &ownership
+		}
+		if !canClaim(current, requested) {
+			continue
+		}
+
+		requested.ETag = newETag()
+		requested.LastModifiedTime = time.Now().UTC()
+		s.ownerships[key] = requested
+		claimed = append(claimed, requested)
+	}
+	return claimed, nil
+}
+
+// ListCheckpoints returns the checkpoints of the consumer group
+func (s *MemoryCheckpointStore) ListCheckpoints(ctx context.Context, fullyQualifiedNamespace string, eventHubName string, consumerGroup string, options *azeventhubs.ListCheckpointsOptions) ([]azeventhubs.Checkpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prefix := partitionKey(fullyQualifiedNamespace, eventHubName, consumerGroup, "")
+	var result []azeventhubs.Checkpoint
+	for key, checkpoint := range s.checkpoints {
+		if strings.HasPrefix(key, prefix) {
+			result = append(result, checkpoint)
+		}
+	}
+	return result, nil
+}
+
+// ListOwnership returns the ownership of the partitions of the consumer group
+func (s *MemoryCheckpointStore) ListOwnership(ctx context.Context, fullyQualifiedNamespace string, eventHubName string, consumerGroup string, options *azeventhubs.ListOwnershipOptions) ([]azeventhubs.Ownership, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prefix := partitionKey(fullyQualifiedNamespace, eventHubName, consumerGroup, "")
+	var result []azeventhubs.Ownership
+	for key, ownership := range s.ownerships {
+		if strings.HasPrefix(key, prefix) {
+			result = append(result, ownership)
+		}
+	}
+	return result, nil
+}
+
+// SetCheckpoint stores the checkpoint of a partition
+func (s *MemoryCheckpointStore) SetCheckpoint(ctx context.Context, checkpoint azeventhubs.Checkpoint, options *azeventhubs.SetCheckpointOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.checkpoints[partitionKey(checkpoint.FullyQualifiedNamespace, checkpoint.EventHubName, checkpoint.ConsumerGroup, checkpoint.PartitionID)] = checkpoint
+	return nil
+}
+
+// Identifies a partition of a consumer group, names are case insensitive like in the blob store
+func partitionKey(fullyQualifiedNamespace, eventHubName, consumerGroup, partitionID string) string {
+	return strings.ToLower(fullyQualifiedNamespace + "/" + eventHubName + "/" + consumerGroup + "/" + partitionID)
+}
+
+// Applies the ETag rules of the blob store: a partition that was never owned can only be claimed without an ETag,
+// an owned partition can only be claimed with its current ETag
+func canClaim(current *azeventhubs.Ownership, requested azeventhubs.Ownership) bool {
+	if current == nil {
+		return requested.ETag == nil
+	}
+	return requested.ETag != nil && current.ETag != nil && *requested.ETag == *current.ETag
+}
+
+// Returns a new unique ETag
+func newETag() *azcore.ETag {
+	etag := azcore.ETag(uuid.New().String())
+	return &etag
+}
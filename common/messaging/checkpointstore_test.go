@@ -0,0 +1,216 @@
+package messaging
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs"
+)
+
+const (
+	testNamespace     = "test.servicebus.windows.net"
+	testEventHub      = "orders"
+	testConsumerGroup = "$Default"
+)
+
+// Stores that are tested against the same contract
+func testCheckpointStores(t *testing.T) map[string]CheckpointStore {
+	t.Helper()
+	fileStore, err := NewFileCheckpointStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]CheckpointStore{
+		MemoryCheckpointStoreType: NewMemoryCheckpointStore(),
+		FileCheckpointStoreType:   fileStore,
+	}
+}
+
+func testOwnership(partitionID, ownerID string, etag *azcore.ETag) azeventhubs.Ownership {
+	return azeventhubs.Ownership{
+		FullyQualifiedNamespace: testNamespace,
+		EventHubName:            testEventHub,
+		ConsumerGroup:           testConsumerGroup,
+		PartitionID:             partitionID,
+		OwnerID:                 ownerID,
+		ETag:                    etag,
+	}
+}
+
+func testCheckpoint(partitionID string, sequenceNumber int64) azeventhubs.Checkpoint {
+	return azeventhubs.Checkpoint{
+		FullyQualifiedNamespace: testNamespace,
+		EventHubName:            testEventHub,
+		ConsumerGroup:           testConsumerGroup,
+		PartitionID:             partitionID,
+		SequenceNumber:          &sequenceNumber,
+		Offset:                  &sequenceNumber,
+	}
+}
+
+func TestNewCheckpointStore(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  CheckpointStoreOptions
+		wantName string
+		wantErr  bool
+	}{
+		{"memory", CheckpointStoreOptions{Type: "memory"}, MemoryCheckpointStoreType, false},
+		{"type is case insensitive", CheckpointStoreOptions{Type: "MEMORY"}, MemoryCheckpointStoreType, false},
+		{"file", CheckpointStoreOptions{Type: "file", Dir: t.TempDir()}, FileCheckpointStoreType, false},
+		{"file without directory", CheckpointStoreOptions{Type: "file"}, "", true},
+		{"blob without connection string", CheckpointStoreOptions{Type: "blob", ContainerName: "checkpoints"}, "", true},
+		{"default is blob", CheckpointStoreOptions{}, "", true},
+		{"unknown", CheckpointStoreOptions{Type: "redis"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := NewCheckpointStore(tt.options)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewCheckpointStore error = %v, want error %t", err, tt.wantErr)
+			}
+			if err == nil && store.Name() != tt.wantName {
+				t.Errorf("Name = %q, want %q", store.Name(), tt.wantName)
+			}
+		})
+	}
+}
+
+func TestCheckpointStoreClaimOwnership(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testCheckpointStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := store.Check(ctx); err != nil {
+				t.Fatalf("Check error = %v", err)
+			}
+
+			claimed, err := store.ClaimOwnership(ctx, []azeventhubs.Ownership{testOwnership("0", "a", nil)}, nil)
+			if err != nil || len(claimed) != 1 || claimed[0].ETag == nil {
+				t.Fatalf("first claim = %+v, %v, want the partition with an ETag", claimed, err)
+			}
+			current := claimed[0].ETag
+			stale := azcore.ETag("stale")
+
+			tests := []struct {
+				name      string
+				requested azeventhubs.Ownership
+				wantOwner string
+			}{
+				{"owned partition without ETag", testOwnership("0", "b", nil), ""},
+				{"owned partition with a stale ETag", testOwnership("0", "b", &stale), ""},
+				{"new partition with an ETag", testOwnership("1", "b", &stale), ""},
+				{"owned partition with its ETag", testOwnership("0", "b", current), "b"},
+				{"ETag changed by the last claim", testOwnership("0", "c", current), ""},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					claimed, err := store.ClaimOwnership(ctx, []azeventhubs.Ownership{tt.requested}, nil)
+					if err != nil {
+						t.Fatalf("ClaimOwnership error = %v", err)
+					}
+					if tt.wantOwner == "" {
+						if len(claimed) != 0 {
+							t.Errorf("claimed %+v, want nothing", claimed)
+						}
+						return
+					}
+					if len(claimed) != 1 || claimed[0].OwnerID != tt.wantOwner || *claimed[0].ETag == *tt.requested.ETag {
+						t.Errorf("claimed %+v, want owner %q with a new ETag", claimed, tt.wantOwner)
+					}
+				})
+			}
+
+			ownerships, err := store.ListOwnership(ctx, testNamespace, testEventHub, testConsumerGroup, nil)
+			if err != nil || len(ownerships) != 1 || ownerships[0].PartitionID != "0" || ownerships[0].OwnerID != "b" {
+				t.Errorf("ListOwnership = %+v, %v, want partition 0 owned by b", ownerships, err)
+			}
+		})
+	}
+}
+
+func TestCheckpointStoreCheckpoints(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testCheckpointStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, checkpoint := range []azeventhubs.Checkpoint{testCheckpoint("0", 10), testCheckpoint("1", 20), testCheckpoint("0", 15)} {
+				if err := store.SetCheckpoint(ctx, checkpoint, nil); err != nil {
+					t.Fatalf("SetCheckpoint error = %v", err)
+				}
+			}
+
+			tests := []struct {
+				name          string
+				namespace     string
+				consumerGroup string
+				want          map[string]int64
+			}{
+				{"last checkpoint of each partition", testNamespace, testConsumerGroup, map[string]int64{"0": 15, "1": 20}},
+				{"names are case insensitive", "TEST.servicebus.windows.net", "$DEFAULT", map[string]int64{"0": 15, "1": 20}},
+				{"other consumer group", testNamespace, "analytics", map[string]int64{}},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					checkpoints, err := store.ListCheckpoints(ctx, tt.namespace, testEventHub, tt.consumerGroup, nil)
+					if err != nil {
+						t.Fatalf("ListCheckpoints error = %v", err)
+					}
+					got := map[string]int64{}
+					for _, checkpoint := range checkpoints {
+						got[checkpoint.PartitionID] = *checkpoint.SequenceNumber
+					}
+					if len(got) != len(tt.want) {
+						t.Fatalf("ListCheckpoints = %v, want %v", got, tt.want)
+					}
+					for partitionID, sequenceNumber := range tt.want {
+						if got[partitionID] != sequenceNumber {
+							t.Errorf("partition %s at %d, want %d", partitionID, got[partitionID], sequenceNumber)
+						}
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestFileCheckpointStoreConcurrentCheckpoints(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store, err := NewFileCheckpointStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := int64(1); i <= 20; i++ {
+		wg.Add(1)
+		go func(sequenceNumber int64) {
+			defer wg.Done()
+			if err := store.SetCheckpoint(ctx, testCheckpoint("0", sequenceNumber), nil); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	checkpoints, err := store.ListCheckpoints(ctx, testNamespace, testEventHub, testConsumerGroup, nil)
+	if err != nil || len(checkpoints) != 1 {
+		t.Fatalf("ListCheckpoints = %+v, %v, want a single readable checkpoint", checkpoints, err)
+	}
+
+	// Neither temporary nor lock files are left behind
+	entries, err := os.ReadDir(filepath.Dir(store.path(testNamespace, testEventHub, testConsumerGroup, "checkpoint", "0")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		t.Errorf("checkpoint directory holds %v, want only 0.json", names)
+	}
+}
@@ -0,0 +1,262 @@
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs"
+)
+
+// A lock older than this is left over by a process that stopped while claiming, and is removed
+const staleLockAge = 30 * time.Second
+
+// FileCheckpointStore keeps checkpoints and ownership as JSON files, with the same layout as the blob store:
+// <dir>/<namespace>/<event hub>/<consumer group>/checkpoint/<partition>.json and .../ownership/<partition>.json.
+// Consumers on the same machine, or sharing the directory, can balance the partitions between them.
+type FileCheckpointStore struct {
+	dir string
+}
+
+// Content of a checkpoint file
+type checkpointFile struct {
+	Offset         *int64 `json:"offset,omitempty"`
+	SequenceNumber *int64 `json:"sequenceNumber,omitempty"`
+}
+
+// Content of an ownership file
+type ownershipFile struct {
+	OwnerID          string    `json:"ownerId"`
+	LastModifiedTime time.Time `json:"lastModifiedTime"`
+	ETag             string    `json:"etag"`
+}
+
+// Creates a file checkpoint store in the directory, which is created if needed
+func NewFileCheckpointStore(dir string) (*FileCheckpointStore, error) {
+	if dir == "" {
+		return nil, errors.New("file checkpoint store requires a directory")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileCheckpointStore{dir: dir}, nil
+}
+
+// Name of the store
+func (s *FileCheckpointStore) Name() string {
+	return FileCheckpointStoreType
+}
+
+// Check verifies that the directory exists
+func (s *FileCheckpointStore) Check(ctx context.Context) error {
+	info, err := os.Stat(s.dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", s.dir)
+	}
+	return nil
+}
+
+// ClaimOwnership claims the partitions whose ETag still matches, and returns the claimed ones.
+// Each claim holds a lock file so concurrent consumers cannot both win.
+func (s *FileCheckpointStore) ClaimOwnership(ctx context.Context, partitionOwnership []azeventhubs.Ownership, options *azeventhubs.ClaimOwnershipOptions) ([]azeventhubs.Ownership, error) {
+	var claimed []azeventhubs.Ownership
+	for _, requested := range partitionOwnership {
+		ok, err := s.claim(ctx, &requested)
+		if err != nil {
+			return claimed, err
+		}
+		if ok {
+			claimed = append(claimed, requested)
+		}
+	}
+	return claimed, nil
+}
+
+// Claims a single partition, requested is updated with the new ETag when the claim succeeds
+func (s *FileCheckpointStore) claim(ctx context.Context, requested *azeventhubs.Ownership) (bool, error) {
+	path := s.path(requested.FullyQualifiedNamespace, requested.EventHubName, requested.ConsumerGroup, "ownership", requested.PartitionID)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return false, err
+	}
+
+	unlock, err := lockFile(ctx, path+".lock")
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	var current *azeventhubs.Ownership
+	var content ownershipFile
+	err = readJSON(path, &content)
+	switch {
+	case err == nil:
+		etag := azcore.ETag(content.ETag)
+		current = &azeventhubs.Ownership{OwnerID: content.OwnerID, LastModifiedTime: content.LastModifiedTime, ETag: &etag}
+	case !errors.Is(err, os.ErrNotExist):
+		return false, err
+	}
+	if !canClaim(current, *requested) {
+		return false, nil
+	}
+
+	requested.ETag = newETag()
+	requested.LastModifiedTime = time.Now().UTC()
+	content = ownershipFile{OwnerID: requested.OwnerID, LastModifiedTime: requested.LastModifiedTime, ETag: string(*requested.ETag)}
+	return true, writeJSON(path, content)
+}
+
+// ListCheckpoints reads the checkpoint files of the consumer group
+func (s *FileCheckpointStore) ListCheckpoints(ctx context.Context, fullyQualifiedNamespace string, eventHubName string, consumerGroup string, options *azeventhubs.ListCheckpointsOptions) ([]azeventhubs.Checkpoint, error) {
+	var result []azeventhubs.Checkpoint
+	err := s.list(fullyQualifiedNamespace, eventHubName, consumerGroup, "checkpoint", func(partitionID, path string) error {
+		var content checkpointFile
+		if err := readJSON(path, &content); err != nil {
+			return err
+		}
+		result = append(result, azeventhubs.Checkpoint{
+			ConsumerGroup:           consumerGroup,
+			EventHubName:            eventHubName,
+			FullyQualifiedNamespace: fullyQualifiedNamespace,
+			PartitionID:             partitionID,
+			Offset:                  content.Offset,
+			SequenceNumber:          content.SequenceNumber,
+		})
+		return nil
+	})
+	return result, err
+}
+
+// ListOwnership reads the ownership files of the consumer group
+func (s *FileCheckpointStore) ListOwnership(ctx context.Context, fullyQualifiedNamespace string, eventHubName string, consumerGroup string, options *azeventhubs.ListOwnershipOptions) ([]azeventhubs.Ownership, error) {
+	var result []azeventhubs.Ownership
+	err := s.list(fullyQualifiedNamespace, eventHubName, consumerGroup, "ownership", func(partitionID, path string) error {
+		var content ownershipFile
+		if err := readJSON(path, &content); err != nil {
+			return err
+		}
+		etag := azcore.ETag(content.ETag)
+		result = append(result, azeventhubs.Ownership{
+			ConsumerGroup:           consumerGroup,
+			EventHubName:            eventHubName,
+			FullyQualifiedNamespace: fullyQualifiedNamespace,
+			PartitionID:             partitionID,
+			OwnerID:                 content.OwnerID,
+			LastModifiedTime:        content.LastModifiedTime,
+			ETag:                    &etag,
+		})
+		return nil
+	})
+	return result, err
+}
+
+// SetCheckpoint writes the checkpoint file of a partition, holding its lock file so concurrent writers are serialized
+func (s *FileCheckpointStore) SetCheckpoint(ctx context.Context, checkpoint azeventhubs.Checkpoint, options *azeventhubs.SetCheckpointOptions) error {
+	path := s.path(checkpoint.FullyQualifiedNamespace, checkpoint.EventHubName, checkpoint.ConsumerGroup, "checkpoint", checkpoint.PartitionID)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	unlock, err := lockFile(ctx, path+".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return writeJSON(path, checkpointFile{Offset: checkpoint.Offset, SequenceNumber: checkpoint.SequenceNumber})
+}
+
+// Path of the checkpoint or ownership file of a partition, names are lower case like in the blob store
+func (s *FileCheckpointStore) path(fullyQualifiedNamespace, eventHubName, consumerGroup, kind, partitionID string) string {
+	return filepath.Join(s.dir, strings.ToLower(fullyQualifiedNamespace), strings.ToLower(eventHubName), strings.ToLower(consumerGroup), kind, partitionID+".json")
+}
+
+// Calls fn for every file of the kind in the consumer group, a consumer group without files is empty
+func (s *FileCheckpointStore) list(fullyQualifiedNamespace, eventHubName, consumerGroup, kind string, fn func(partitionID, path string) error) error {
+	dir := filepath.Dir(s.path(fullyQualifiedNamespace, eventHubName, consumerGroup, kind, ""))
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || filepath.Ext(name) != ".json" {
+			continue
+		}
+		if err := fn(strings.TrimSuffix(name, ".json"), filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Creates the lock file, waiting while another consumer holds it
+func lockFile(ctx context.Context, path string) (func(), error) {
+	for {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err == nil {
+			file.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+
+		if info, statErr := os.Stat(path); statErr == nil && time.Since(info.ModTime()) > staleLockAge {
+			os.Remove(path)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// Reads a JSON file
+func readJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Writes a JSON file through a temporary file of its own in the same directory, so readers never see a partial file
+func writeJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
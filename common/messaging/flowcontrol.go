@@ -0,0 +1,195 @@
+package messaging
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Weight of the last handled event in the average handler latency
+const latencyWeight = 0.2
+
+// Time after which the average handler latency halves while no event is in flight,
+// so a partition that went idle after slow events is not kept throttled
+const latencyHalfLife = 5 * time.Second
+
+// First pause between two receives once the partition is throttled, doubled while it stays throttled
+const initialReceiveDelay = 100 * time.Millisecond
+
+// FlowControlOptions sets the limits of the flow control, a zero threshold is not checked
+type FlowControlOptions struct {
+	// Largest and smallest number of events asked per receive
+	MaxBatchSize int
+	MinBatchSize int
+
+	// Events received and not yet handled above which receiving slows down.
+	// Receiving waits while it is reached, and never asks for more events than are left below it.
+	MaxInFlight int
+
+	// Average handler latency above which receiving slows down
+	MaxLatency time.Duration
+
+	// Longest pause between two receives while throttled
+	MaxDelay time.Duration
+}
+
+// FlowController adapts how fast a partition receives to how fast its events are handled.
+// While the handlers are too slow or too many events are in flight, the batch size is halved and receives are spaced out,
+// once they recover the batch size grows back step by step and the pause shrinks (additive increase, multiplicative decrease).
+type FlowController struct {
+	options  FlowControlOptions
+	inFlight atomic.Int64
+
+	// Signalled when an event is handled, to wake up a receive waiting for room
+	released chan struct{}
+
+	mu        sync.Mutex
+	latency   time.Duration
+	latencyAt time.Time
+	batchSize int
+	delay     time.Duration
+	throttled bool
+}
+
+// Creates a flow controller that starts at the largest batch size
+func NewFlowController(options FlowControlOptions) *FlowController {
+	if options.MaxBatchSize < 1 {
+		options.MaxBatchSize = 1
+	}
+	if options.MinBatchSize < 1 || options.MinBatchSize > options.MaxBatchSize {
+		options.MinBatchSize = 1
+	}
+	return &FlowController{options: options, released: make(chan struct{}, 1), batchSize: options.MaxBatchSize}
+}
+
+// Started counts an event passed to the handlers
+func (c *FlowController) Started() {
+	c.inFlight.Add(1)
+}
+
+// Finished counts an event handled in the given time, a zero latency is not measured (e.g. the event was skipped)
+func (c *FlowController) Finished(latency time.Duration) {
+	c.inFlight.Add(-1)
+	if latency > 0 {
+		c.mu.Lock()
+		if c.latency == 0 {
+			c.latency = latency
+		} else {
+			c.latency = time.Duration(latencyWeight*float64(latency) + (1-latencyWeight)*float64(c.latency))
+		}
+		c.latencyAt = time.Now()
+		c.mu.Unlock()
+	}
+
+	select {
+	case c.released <- struct{}{}:
+	default:
+	}
+}
+
+// InFlight returns the number of events passed to the handlers and not handled yet
+func (c *FlowController) InFlight() int {
+	return int(c.inFlight.Load())
+}
+
+// Next adapts the flow to the current latency and in-flight count, waits as long as the partition is throttled,
+// and returns the number of events to ask for in the next receive
+func (c *FlowController) Next(ctx context.Context) (int, error) {
+	batchSize, delay := c.adjust(ctx)
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	if c.options.MaxInFlight <= 0 {
+		return batchSize, nil
+	}
+
+	// Wait for room below the in-flight limit
+	for {
+		room := c.options.MaxInFlight - c.InFlight()
+		if room > 0 {
+			if batchSize > room {
+				batchSize = room
+			}
+			return batchSize, nil
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-c.released:
+		}
+	}
+}
+
+// Updates the batch size and the pause, and reports the changes of state
+func (c *FlowController) adjust(ctx context.Context) (int, time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	inFlight := c.InFlight()
+	if inFlight == 0 {
+		c.decayLatency(time.Now())
+	}
+	slow := c.options.MaxLatency > 0 && c.latency > c.options.MaxLatency
+	full := c.options.MaxInFlight > 0 && inFlight >= c.options.MaxInFlight
+
+	if slow || full {
+		c.batchSize /= 2
+		if c.batchSize < c.options.MinBatchSize {
+			c.batchSize = c.options.MinBatchSize
+		}
+		if c.delay == 0 {
+			c.delay = initialReceiveDelay
+		} else {
+			c.delay *= 2
+		}
+		if c.options.MaxDelay > 0 && c.delay > c.options.MaxDelay {
+			c.delay = c.options.MaxDelay
+		}
+		if !c.throttled {
+			c.throttled = true
+			logger.Warning(ctx, "Receiving slowed down", "Latency", c.latency.String(), "InFlight", inFlight, "BatchSize", c.batchSize)
+		}
+		return c.batchSize, c.delay
+	}
+
+	// Recover gradually, a tenth of the largest batch at a time
+	step := c.options.MaxBatchSize / 10
+	if step < 1 {
+		step = 1
+	}
+	c.batchSize += step
+	if c.batchSize > c.options.MaxBatchSize {
+		c.batchSize = c.options.MaxBatchSize
+	}
+	c.delay /= 2
+	if c.delay < initialReceiveDelay {
+		c.delay = 0
+	}
+	if c.throttled && c.delay == 0 && c.batchSize == c.options.MaxBatchSize {
+		c.throttled = false
+		logger.Info(ctx, "Receiving back to full speed", "Latency", c.latency.String(), "InFlight", inFlight)
+	}
+	return c.batchSize, c.delay
+}
+
+// Lowers the average latency for the time spent without events in flight, nothing measures it then. Called with the lock held.
+func (c *FlowController) decayLatency(now time.Time) {
+	if c.latency == 0 {
+		return
+	}
+	idle := now.Sub(c.latencyAt)
+	if idle <= 0 {
+		return
+	}
+	c.latency = time.Duration(float64(c.latency) * math.Pow(0.5, float64(idle)/float64(latencyHalfLife)))
+	c.latencyAt = now
+}
@@ -0,0 +1,189 @@
+package messaging
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/microtest/common/telemetry"
+)
+
+// Creates a flow controller that does not log for the duration of the test
+func newTestFlowController(t *testing.T, options FlowControlOptions) *FlowController {
+	t.Helper()
+	telemetry.SetLogOutput(io.Discard)
+	t.Cleanup(func() { telemetry.SetLogOutput(os.Stdout) })
+	return NewFlowController(options)
+}
+
+func TestNewFlowControllerBounds(t *testing.T) {
+	tests := []struct {
+		name    string
+		options FlowControlOptions
+		wantMax int
+		wantMin int
+	}{
+		{"valid bounds", FlowControlOptions{MaxBatchSize: 100, MinBatchSize: 10}, 100, 10},
+		{"no largest batch", FlowControlOptions{}, 1, 1},
+		{"smallest above the largest", FlowControlOptions{MaxBatchSize: 10, MinBatchSize: 50}, 10, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestFlowController(t, tt.options)
+			if c.options.MaxBatchSize != tt.wantMax || c.options.MinBatchSize != tt.wantMin {
+				t.Errorf("bounds = %d..%d, want %d..%d", c.options.MinBatchSize, c.options.MaxBatchSize, tt.wantMin, tt.wantMax)
+			}
+			if c.batchSize != tt.wantMax {
+				t.Errorf("batch size = %d, want to start at %d", c.batchSize, tt.wantMax)
+			}
+		})
+	}
+}
+
+func TestFlowControllerShrinksWhenThrottled(t *testing.T) {
+	tests := []struct {
+		name     string
+		inFlight int
+		latency  time.Duration
+	}{
+		{"handlers too slow", 1, time.Second},
+		{"too many events in flight", 4, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			c := newTestFlowController(t, FlowControlOptions{
+				MaxBatchSize: 100, MinBatchSize: 10, MaxInFlight: 4, MaxLatency: 100 * time.Millisecond, MaxDelay: time.Second,
+			})
+			for i := 0; i < tt.inFlight; i++ {
+				c.Started()
+			}
+			if tt.latency > 0 {
+				// A started event keeps the latency from decaying
+				c.Started()
+				c.Finished(tt.latency)
+			}
+
+			wantSizes := []int{50, 25, 12, 10, 10, 10}
+			wantDelays := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+			for i := range wantSizes {
+				batchSize, delay := c.adjust(ctx)
+				if batchSize != wantSizes[i] || delay != wantDelays[i] {
+					t.Errorf("adjust %d = %d, %v, want %d, %v", i, batchSize, delay, wantSizes[i], wantDelays[i])
+				}
+			}
+			if !c.throttled {
+				t.Error("not reported as throttled")
+			}
+		})
+	}
+}
+
+func TestFlowControllerGrowsBackOnRecovery(t *testing.T) {
+	ctx := context.Background()
+	c := newTestFlowController(t, FlowControlOptions{MaxBatchSize: 100, MinBatchSize: 10, MaxInFlight: 2, MaxDelay: time.Second})
+
+	// Throttled down to the smallest batch
+	c.Started()
+	c.Started()
+	for i := 0; i < 5; i++ {
+		c.adjust(ctx)
+	}
+	c.Finished(0)
+	c.Finished(0)
+
+	// The batch grows by a tenth of the largest batch and the pause halves at every receive
+	var sizes []int
+	for c.throttled {
+		batchSize, _ := c.adjust(ctx)
+		sizes = append(sizes, batchSize)
+		if len(sizes) > 20 {
+			t.Fatalf("still throttled after %v", sizes)
+		}
+	}
+	want := []int{20, 30, 40, 50, 60, 70, 80, 90, 100}
+	if len(sizes) != len(want) {
+		t.Fatalf("batch sizes %v, want %v", sizes, want)
+	}
+	for i := range want {
+		if sizes[i] != want[i] {
+			t.Fatalf("batch sizes %v, want %v", sizes, want)
+		}
+	}
+	if batchSize, delay := c.adjust(ctx); batchSize != 100 || delay != 0 {
+		t.Errorf("adjust after recovery = %d, %v, want 100 without pause", batchSize, delay)
+	}
+}
+
+func TestFlowControllerNextStaysBelowMaxInFlight(t *testing.T) {
+	c := newTestFlowController(t, FlowControlOptions{MaxBatchSize: 100, MaxInFlight: 30})
+	for i := 0; i < 10; i++ {
+		c.Started()
+	}
+	batchSize, err := c.Next(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batchSize != 20 {
+		t.Errorf("Next = %d, want the 20 events left below the limit", batchSize)
+	}
+
+	// At the limit, Next waits for an event to be handled
+	for i := 0; i < 20; i++ {
+		c.Started()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	c.options.MaxDelay = time.Millisecond
+	if _, err := c.Next(ctx); err == nil {
+		t.Error("Next returned while the in-flight limit was reached")
+	}
+}
+
+func TestFlowControllerLatencyDecaysWhileIdle(t *testing.T) {
+	ctx := context.Background()
+	c := newTestFlowController(t, FlowControlOptions{MaxBatchSize: 100, MaxLatency: 100 * time.Millisecond})
+	c.Started()
+	c.Finished(400 * time.Millisecond)
+
+	tests := []struct {
+		name string
+		idle time.Duration
+		want time.Duration
+	}{
+		{"no time idle", 0, 400 * time.Millisecond},
+		{"one half-life", latencyHalfLife, 200 * time.Millisecond},
+		{"two more half-lives", 2 * latencyHalfLife, 50 * time.Millisecond},
+	}
+	at := c.latencyAt
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			at = at.Add(tt.idle)
+			c.mu.Lock()
+			c.decayLatency(at)
+			got := c.latency
+			c.mu.Unlock()
+			if got < tt.want-time.Millisecond || got > tt.want+time.Millisecond {
+				t.Errorf("latency = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Once decayed below the threshold, the partition is no longer slowed down
+	if _, delay := c.adjust(ctx); delay != 0 {
+		t.Errorf("adjust pause = %v, want none once the latency decayed", delay)
+	}
+
+	// The latency does not decay while events are in flight
+	c.Started()
+	c.Finished(time.Second)
+	c.Started()
+	c.mu.Lock()
+	c.latencyAt = c.latencyAt.Add(-time.Minute)
+	c.mu.Unlock()
+	if _, delay := c.adjust(ctx); delay == 0 {
+		t.Error("adjust did not slow down while a slow event is in flight")
+	}
+}
@@ -4,12 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs"
-	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs/checkpoints"
-	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/microtest/common/auth"
+	"github.com/microtest/common/breaker"
 	"github.com/microtest/common/telemetry"
 )
 
@@ -28,14 +30,97 @@ type Event struct {
 	OrderPayload Order
 }
 
+// Logger for the messaging package
+var logger = telemetry.NewLogger("Messaging")
+
 // EventHub producer client
 type ProducerClient struct {
 	innerClient *azeventhubs.ProducerClient
+	mu          sync.RWMutex
+	retryPolicy RetryPolicy
+	breaker     *breaker.Breaker
+}
+
+// RetryPolicy controls how a failed send is retried
+type RetryPolicy struct {
+	// Number of retries after the first attempt, 0 disables retries
+	MaxRetries int
+
+	// Wait before the first retry, doubled after every attempt
+	Delay time.Duration
+}
+
+// Calls of the consumer client used by the processor besides the SDK processor, implemented by *azeventhubs.ConsumerClient
+type eventHubConsumer interface {
+	InstanceID() string
+	GetEventHubProperties(ctx context.Context, options *azeventhubs.GetEventHubPropertiesOptions) (azeventhubs.EventHubProperties, error)
+	GetPartitionProperties(ctx context.Context, partitionID string, options *azeventhubs.GetPartitionPropertiesOptions) (azeventhubs.PartitionProperties, error)
+	NewPartitionClient(partitionID string, options *azeventhubs.PartitionClientOptions) (*azeventhubs.PartitionClient, error)
+	Close(ctx context.Context) error
 }
 
 // EventHub consumer client
 type Processor struct {
-	innerClient *azeventhubs.Processor
+	innerClient     *azeventhubs.Processor
+	consumerClient  eventHubConsumer
+	checkpointStore CheckpointStore
+	namespace       string
+	consumerGroup   string
+
+	// Ownership of a partition not renewed for this long can be claimed by another instance
+	partitionExpiration time.Duration
+
+	// Events processed by this instance, per partition it is processing
+	statsMu        sync.Mutex
+	partitionStats map[string]*processingStats
+}
+
+// Load balancing strategies of the processor
+const (
+	// Claims one partition per update, until the partitions are evenly spread
+	BalancedStrategy = "balanced"
+
+	// Claims every partition it needs in a single update
+	GreedyStrategy = "greedy"
+)
+
+// ProcessorOptions configures the processor
+type ProcessorOptions struct {
+	// Consumer group, each consumer group keeps its own checkpoints. $Default when empty.
+	ConsumerGroup string
+
+	// Where partitions without a checkpoint start, the latest event by default
+	StartPositions azeventhubs.StartPositions
+
+	// balanced (default) or greedy
+	LoadBalancingStrategy string
+
+	// Time between two load balancing updates, 10s when zero
+	UpdateInterval time.Duration
+
+	// Time after which a partition whose owner stopped updating it can be claimed, 60s when zero
+	PartitionExpirationDuration time.Duration
+
+	// Events each partition client receives ahead of ReceiveEvents, 300 when zero, a negative value disables prefetching
+	Prefetch int
+}
+
+// IsOwnershipLost reports whether the error is returned because another consumer took the partition over,
+// which happens every time the partitions are balanced again between the consumers of the group
+func IsOwnershipLost(err error) bool {
+	var ehErr *azeventhubs.Error
+	return errors.As(err, &ehErr) && ehErr.Code == azeventhubs.ErrorCodeOwnershipLost
+}
+
+// Returns the load balancing strategy of the SDK
+func loadBalancingStrategy(strategy string) (azeventhubs.ProcessorStrategy, error) {
+	switch strings.ToLower(strategy) {
+	case "", BalancedStrategy:
+		return azeventhubs.ProcessorStrategyBalanced, nil
+	case GreedyStrategy:
+		return azeventhubs.ProcessorStrategyGreedy, nil
+	}
+	return "", fmt.Errorf("unknown load balancing strategy %q", strategy)
 }
 
 // Message represents the structure of a message
@@ -63,6 +148,15 @@ func ProducerInit(serviceName, connectionString, eventHubName string) (*Producer
 	}, nil
 }
 
+// Check reads the event hub properties to verify the connection to the broker
+func (pc *ProducerClient) Check(ctx context.Context) error {
+	if pc == nil {
+		return errors.New("eventHub instance not initialized")
+	}
+	_, err := pc.innerClient.GetEventHubProperties(ctx, nil)
+	return err
+}
+
 // Close the EventHub producer instance
 func (pc *ProducerClient) ProducerClose() error {
 	startTime := time.Now()
@@ -87,6 +181,65 @@ func (pc *ProducerClient) ProducerClose() error {
 	return nil
 }
 
+// SetRetryPolicy changes the retry policy used by the following sends, it can be called at any time
+func (pc *ProducerClient) SetRetryPolicy(policy RetryPolicy) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.retryPolicy = policy
+}
+
+// Returns the current retry policy
+func (pc *ProducerClient) getRetryPolicy() RetryPolicy {
+	pc.mu.RLock()
+	defer pc.mu.RUnlock()
+	return pc.retryPolicy
+}
+
+// SetCircuitBreaker makes the calls to the broker go through the breaker, so they fail fast with breaker.ErrOpen
+// while the broker is failing. Call it before publishing.
+func (pc *ProducerClient) SetCircuitBreaker(b *breaker.Breaker) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.breaker = b
+}
+
+// Runs a call to the broker through the circuit breaker, if there is one
+func (pc *ProducerClient) call(fn func() error) error {
+	pc.mu.RLock()
+	b := pc.breaker
+	pc.mu.RUnlock()
+	if b == nil {
+		return fn()
+	}
+	return b.Execute(fn)
+}
+
+// Sends the batch, retrying according to the retry policy.
+// Retries stop when the circuit breaker opens or the context is done.
+func (pc *ProducerClient) sendWithRetry(ctx context.Context, batch *azeventhubs.EventDataBatch) error {
+	policy := pc.getRetryPolicy()
+	delay := policy.Delay
+
+	send := func() error {
+		return pc.innerClient.SendEventDataBatch(ctx, batch, nil)
+	}
+	err := pc.call(send)
+	for attempt := 1; err != nil && !errors.Is(err, breaker.ErrOpen) && ctx.Err() == nil && attempt <= policy.MaxRetries; attempt++ {
+		logger.Warning(ctx, "Publish::Send failed, retrying", "Attempt", attempt, "MaxRetries", policy.MaxRetries, "Delay", delay.String(), "Error", err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		delay *= 2
+
+		err = pc.call(send)
+	}
+	return err
+}
+
 // Sends a message to the EventHub
 func (pc *ProducerClient) PublishMessage(ctx context.Context, serviceName string, operationID string, event Event) error {
 	startTime := time.Now()
@@ -99,7 +252,11 @@ func (pc *ProducerClient) PublishMessage(ctx context.Context, serviceName string
 	}
 
 	// Get the EventHub name
-	eventHubProps, err := pc.innerClient.GetEventHubProperties(context.TODO(), nil)
+	var eventHubProps azeventhubs.EventHubProperties
+	err := pc.call(func() (err error) {
+		eventHubProps, err = pc.innerClient.GetEventHubProperties(ctx, nil)
+		return err
+	})
 	if err != nil {
 		telemetry.TrackException(err, telemetry.Error, map[string]string{"Message": "PublishBatch::Failed to get EventHub properties", "Error": err.Error()})
 		return err
@@ -107,25 +264,40 @@ func (pc *ProducerClient) PublishMessage(ctx context.Context, serviceName string
 	eventHubName := eventHubProps.Name
 
 	// Create a new batch
-	batch, err := pc.innerClient.NewEventDataBatch(context.TODO(), nil)
+	var batch *azeventhubs.EventDataBatch
+	err = pc.call(func() (err error) {
+		batch, err = pc.innerClient.NewEventDataBatch(ctx, nil)
+		return err
+	})
+	if errors.Is(err, breaker.ErrOpen) {
+		return err
+	}
 	if err != nil {
-		panic(err)
+		logger.Error(ctx, "Publish::Failed to create batch", "Error", err)
+		telemetry.TrackDependency("Publish::Failed to create batch", serviceName, "EventHub", eventHubName, false, startTime, time.Now(), map[string]string{"Error": err.Error()}, operationID)
+		return err
 	}
 
 	// Convert the message to JSON
 	jsonData, err := json.Marshal(event)
 	if err != nil {
 		// Failed to marshal message, log dependency failure to App Insights
-		log.Printf("Publish::Failed to marshal message: %s\n", err.Error())
+		logger.Error(ctx, "Publish::Failed to marshal message", "Error", err)
 		telemetry.TrackDependency("Publish::Failed to marshal message", serviceName, "EventHub", eventHubName, false, startTime, time.Now(), map[string]string{"Error": err.Error()}, operationID)
 		return err
 	}
 
 	// can be called multiple times with new messages until you
 	// receive an azeventhubs.ErrMessageTooLarge
-	err = batch.AddEventData(&azeventhubs.EventData{
+	eventData := &azeventhubs.EventData{
 		Body: []byte(jsonData),
-	}, nil)
+	}
+
+	// The authenticated client travels with the event
+	if identity, ok := auth.IdentityFrom(ctx); ok {
+		eventData.Properties = map[string]interface{}{"ClientID": identity.ClientID, "AuthMethod": identity.Method}
+	}
+	err = batch.AddEventData(eventData, nil)
 
 	if errors.Is(err, azeventhubs.ErrEventDataTooLarge) {
 		// Message too large to fit into this batch.
@@ -135,66 +307,115 @@ func (pc *ProducerClient) PublishMessage(ctx context.Context, serviceName string
 		//
 		// If this is the _only_ message being added to the batch then it's too big in general, and
 		// will need to be split or shrunk to fit.
-		log.Printf("Publish::Message too large to fit into this batch\n")
-		panic(err)
+		logger.Error(ctx, "Publish::Message too large to fit into this batch", "Error", err, "Size", len(jsonData))
+		return err
 	} else if err != nil {
 		// Some other error occurred
-		log.Printf("Publish::Failed to add message to batch: %s\n", err.Error())
-		panic(err)
+		logger.Error(ctx, "Publish::Failed to add message to batch", "Error", err)
+		return err
 	}
 
 	// Send the batch
-	err = pc.innerClient.SendEventDataBatch(context.TODO(), batch, nil)
+	err = pc.sendWithRetry(ctx, batch)
 
+	// The broker is failing, fail fast without waiting for the send timeout
+	if errors.Is(err, breaker.ErrOpen) {
+		logger.Error(ctx, "Publish::Event hub circuit breaker open", "Error", err)
+		telemetry.TrackDependency("Publish::Event hub circuit breaker open", serviceName, "EventHub", eventHubName, false, startTime, time.Now(), map[string]string{"Error": err.Error()}, operationID)
+		return err
+	}
 	if err != nil {
-		log.Printf("Publish::Failed to send message with error: %s\n", err.Error())
+		logger.Error(ctx, "Publish::Failed to send message", "Error", err)
 		telemetry.TrackDependency("Publish::Failed to send message", serviceName, "EventHub", eventHubName, false, startTime, time.Now(), map[string]string{"Error": err.Error()}, operationID)
-		panic(err)
+		return err
 	}
 
-	log.Printf("Publish::Successfully sent message with size=%d::content=%s\n", len(jsonData), jsonData)
+	logger.Verbose(ctx, "Publish::Successfully sent message", "Size", len(jsonData), "Content", string(jsonData))
 	telemetry.TrackDependencyCtx(ctx, "PublishBatch::Successfully sent batch", serviceName, "EventHub", eventHubName, true, startTime, time.Now(), nil)
 	return nil
 }
 
-// Consumer initialization
-func ProcessorInit(serviceName, eventHubConnectionString, eventHubName, containerName, checkpointStoreConnectionString string) (*Processor, error) {
+// Consumer initialization, checkpoints and partition ownership are kept in the checkpoint store
+func ProcessorInit(serviceName, eventHubConnectionString, eventHubName string, checkpointStore CheckpointStore, options ProcessorOptions) (*Processor, error) {
 	startTime := time.Now()
 
-	// Create a container client using a connection string and container name
-	checkClient, err := container.NewClientFromConnectionString(checkpointStoreConnectionString, containerName, nil)
+	// The namespace identifies the checkpoints of the event hub in the checkpoint store
+	properties, err := azeventhubs.ParseConnectionString(eventHubConnectionString)
 	if err != nil {
-		telemetry.TrackException(err, telemetry.Error, map[string]string{"Client": serviceName, "Error": err.Error(), "Message": "Error creating container client"})
-		panic(err)
+		telemetry.TrackException(err, telemetry.Error, map[string]string{"Client": serviceName, "Error": err.Error(), "Message": "Invalid event hub connection string"})
+		return nil, err
 	}
-
-	// Create a checkpoint store that will be used by the event hub
-	checkpointStore, err := checkpoints.NewBlobStore(checkClient, nil)
+	strategy, err := loadBalancingStrategy(options.LoadBalancingStrategy)
 	if err != nil {
-		telemetry.TrackException(err, telemetry.Error, map[string]string{"Client": serviceName, "Error": err.Error(), "Message": "Error creating checkpoint store"})
-		panic(err)
+		return nil, err
+	}
+	consumerGroup := options.ConsumerGroup
+	if consumerGroup == "" {
+		consumerGroup = azeventhubs.DefaultConsumerGroup
+	}
+	partitionExpiration := options.PartitionExpirationDuration
+	if partitionExpiration <= 0 {
+		partitionExpiration = defaultPartitionExpiration
 	}
 
 	// Create a consumer client using a connection string to the namespace and the event hub
-	consumerClient, err := azeventhubs.NewConsumerClientFromConnectionString(eventHubConnectionString, eventHubName, azeventhubs.DefaultConsumerGroup, nil)
+	consumerClient, err := azeventhubs.NewConsumerClientFromConnectionString(eventHubConnectionString, eventHubName, consumerGroup, nil)
 	if err != nil {
 		telemetry.TrackException(err, telemetry.Error, map[string]string{"Client": serviceName, "Error": err.Error(), "Message": "Error creating consumer client"})
-		panic(err)
+		return nil, err
 	}
 
-	defer consumerClient.Close(context.TODO())
-
 	// Create a processor to receive and process events
-	innerClient, err := azeventhubs.NewProcessor(consumerClient, checkpointStore, nil)
+	innerClient, err := azeventhubs.NewProcessor(consumerClient, checkpointStore, &azeventhubs.ProcessorOptions{
+		StartPositions:              options.StartPositions,
+		LoadBalancingStrategy:       strategy,
+		UpdateInterval:              options.UpdateInterval,
+		PartitionExpirationDuration: options.PartitionExpirationDuration,
+		Prefetch:                    int32(options.Prefetch),
+	})
 	if err != nil {
 		telemetry.TrackException(err, telemetry.Error, map[string]string{"Client": serviceName, "Error": err.Error(), "Message": "Error creating processor"})
-		panic(err)
+		consumerClient.Close(context.Background())
+		return nil, err
 	}
 
 	// Log the dependency to App Insights (success)
-	telemetry.TrackDependency("New event hub consumer initialized", serviceName, "EventHub", eventHubName, true, startTime, time.Now(), nil, "")
+	telemetry.TrackDependency("New event hub consumer initialized", serviceName, "EventHub", eventHubName, true, startTime, time.Now(), map[string]string{"CheckpointStore": checkpointStore.Name(), "ConsumerGroup": consumerGroup, "LoadBalancingStrategy": string(strategy)}, "")
 
 	return &Processor{
-		innerClient: innerClient,
+		innerClient:     innerClient,
+		consumerClient:  consumerClient,
+		checkpointStore: checkpointStore,
+		namespace:       properties.FullyQualifiedNamespace,
+		consumerGroup:   consumerGroup,
+
+		partitionExpiration: partitionExpiration,
+		partitionStats:      map[string]*processingStats{},
 	}, nil
 }
+
+// Run claims partitions and dispatches them until the context is cancelled, then releases their ownership
+func (p *Processor) Run(ctx context.Context) error {
+	return p.innerClient.Run(ctx)
+}
+
+// NextPartitionClient waits for the next partition claimed by the processor, nil once the processor stopped
+func (p *Processor) NextPartitionClient(ctx context.Context) *azeventhubs.ProcessorPartitionClient {
+	return p.innerClient.NextPartitionClient(ctx)
+}
+
+// Check reads the event hub properties to verify the connection to the broker
+func (p *Processor) Check(ctx context.Context) error {
+	_, err := p.consumerClient.GetEventHubProperties(ctx, nil)
+	return err
+}
+
+// CheckpointStore returns the store of the checkpoints and partition ownership
+func (p *Processor) CheckpointStore() CheckpointStore {
+	return p.checkpointStore
+}
+
+// Close closes the consumer client, call it after Run returned
+func (p *Processor) Close(ctx context.Context) error {
+	return p.consumerClient.Close(ctx)
+}
@@ -0,0 +1,54 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs"
+)
+
+func TestIsOwnershipLost(t *testing.T) {
+	ownershipLost := &azeventhubs.Error{Code: azeventhubs.ErrorCodeOwnershipLost}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"ownership lost", ownershipLost, true},
+		{"wrapped ownership lost", fmt.Errorf("receive: %w", ownershipLost), true},
+		{"connection lost", &azeventhubs.Error{Code: azeventhubs.ErrorCodeConnectionLost}, false},
+		{"other error", errors.New("ownership lost"), false},
+		{"deadline", context.DeadlineExceeded, false},
+		{"nil", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsOwnershipLost(tt.err); got != tt.want {
+				t.Errorf("IsOwnershipLost = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadBalancingStrategy(t *testing.T) {
+	tests := []struct {
+		strategy string
+		want     azeventhubs.ProcessorStrategy
+		wantErr  bool
+	}{
+		{"", azeventhubs.ProcessorStrategyBalanced, false},
+		{"balanced", azeventhubs.ProcessorStrategyBalanced, false},
+		{"Greedy", azeventhubs.ProcessorStrategyGreedy, false},
+		{"random", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			got, err := loadBalancingStrategy(tt.strategy)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("loadBalancingStrategy(%q) = %q, %v, want %q, error %t", tt.strategy, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package messaging
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs"
+	"github.com/microtest/common/telemetry"
+)
+
+// Window of the events per second, in seconds
+const rateWindow = 60
+
+// Default time after which the ownership of a partition that is not renewed expires, as in the SDK
+const defaultPartitionExpiration = time.Minute
+
+// PartitionStatus describes the ownership and progress of a partition.
+// Events per second and the last processed event are only known by the instance that owns the partition.
+type PartitionStatus struct {
+	PartitionID string `json:"partitionId"`
+
+	// Instance that owns the partition, empty if it was never claimed
+	OwnerID             string     `json:"ownerId,omitempty"`
+	OwnedByThisInstance bool       `json:"ownedByThisInstance"`
+	OwnershipUpdated    *time.Time `json:"ownershipUpdated,omitempty"`
+	OwnershipExpired    bool       `json:"ownershipExpired"`
+
+	// Last checkpoint of the consumer group
+	CheckpointSequenceNumber *int64 `json:"checkpointSequenceNumber,omitempty"`
+	CheckpointOffset         *int64 `json:"checkpointOffset,omitempty"`
+
+	// Last event enqueued in the partition
+	LastEnqueuedSequenceNumber int64     `json:"lastEnqueuedSequenceNumber"`
+	LastEnqueuedTime           time.Time `json:"lastEnqueuedTime"`
+
+	// Events enqueued after the last processed one, or after the checkpoint on other instances
+	Lag *int64 `json:"lag,omitempty"`
+
+	// Processing by this instance
+	EventsPerSecond             float64    `json:"eventsPerSecond"`
+	LastProcessedSequenceNumber *int64     `json:"lastProcessedSequenceNumber,omitempty"`
+	LastEventTime               *time.Time `json:"lastEventTime,omitempty"`
+}
+
+// Events processed in a partition by this instance, counted per second over the rate window
+type processingStats struct {
+	mu                 sync.Mutex
+	counts             [rateWindow]int64
+	seconds            [rateWindow]int64
+	started            time.Time
+	lastEventTime      time.Time
+	lastSequenceNumber int64
+}
+
+// Counts a processed event
+func (s *processingStats) record(now time.Time, sequenceNumber int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	second := now.Unix()
+	bucket := second % rateWindow
+	if s.seconds[bucket] != second {
+		s.seconds[bucket] = second
+		s.counts[bucket] = 0
+	}
+	s.counts[bucket]++
+	if sequenceNumber > s.lastSequenceNumber || s.lastEventTime.IsZero() {
+		s.lastSequenceNumber = sequenceNumber
+	}
+	s.lastEventTime = now
+}
+
+// Returns the events per second over the rate window, or since processing of the partition started if it is shorter
+func (s *processingStats) rate(now time.Time) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var total int64
+	for i, second := range s.seconds {
+		if now.Unix()-second < rateWindow {
+			total += s.counts[i]
+		}
+	}
+
+	window := now.Sub(s.started).Seconds()
+	if window > rateWindow {
+		window = rateWindow
+	}
+	if window < 1 {
+		window = 1
+	}
+	return float64(total) / window
+}
+
+// PartitionStarted starts counting the events processed in the partition, call it when processing of the partition starts.
+// A partition claimed again after it moved to another instance starts from fresh stats.
+func (p *Processor) PartitionStarted(partitionID string) {
+	p.statsMu.Lock()
+	defer p.statsMu.Unlock()
+	p.partitionStats[partitionID] = &processingStats{started: time.Now()}
+}
+
+// PartitionStopped forgets the events processed in the partition, call it when processing of the partition stops
+func (p *Processor) PartitionStopped(partitionID string) {
+	p.statsMu.Lock()
+	defer p.statsMu.Unlock()
+	delete(p.partitionStats, partitionID)
+}
+
+// RecordProcessed counts an event processed in the partition, for the partition status and metrics.
+// Events of a partition that is not being processed are not counted.
+func (p *Processor) RecordProcessed(partitionID string, event *azeventhubs.ReceivedEventData) {
+	p.statsMu.Lock()
+	stats, ok := p.partitionStats[partitionID]
+	p.statsMu.Unlock()
+	if ok {
+		stats.record(time.Now(), event.SequenceNumber)
+	}
+}
+
+// Partitions returns the status of every partition of the event hub, from the checkpoint store,
+// the partition properties and the events processed by this instance
+func (p *Processor) Partitions(ctx context.Context) ([]PartitionStatus, error) {
+	properties, err := p.consumerClient.GetEventHubProperties(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	ownerships, err := p.checkpointStore.ListOwnership(ctx, p.namespace, properties.Name, p.consumerGroup, nil)
+	if err != nil {
+		return nil, err
+	}
+	checkpoints, err := p.checkpointStore.ListCheckpoints(ctx, p.namespace, properties.Name, p.consumerGroup, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ownershipByPartition := map[string]azeventhubs.Ownership{}
+	for _, ownership := range ownerships {
+		ownershipByPartition[ownership.PartitionID] = ownership
+	}
+	checkpointByPartition := map[string]azeventhubs.Checkpoint{}
+	for _, checkpoint := range checkpoints {
+		checkpointByPartition[checkpoint.PartitionID] = checkpoint
+	}
+
+	now := time.Now()
+	instanceID := p.consumerClient.InstanceID()
+	statuses := make([]PartitionStatus, 0, len(properties.PartitionIDs))
+	for _, partitionID := range properties.PartitionIDs {
+		partition, err := p.consumerClient.GetPartitionProperties(ctx, partitionID, nil)
+		if err != nil {
+			return nil, err
+		}
+		status := PartitionStatus{
+			PartitionID:                partitionID,
+			LastEnqueuedSequenceNumber: partition.LastEnqueuedSequenceNumber,
+			LastEnqueuedTime:           partition.LastEnqueuedOn,
+		}
+
+		if ownership, ok := ownershipByPartition[partitionID]; ok && ownership.OwnerID != "" {
+			updated := ownership.LastModifiedTime
+			status.OwnerID = ownership.OwnerID
+			status.OwnedByThisInstance = ownership.OwnerID == instanceID
+			status.OwnershipUpdated = &updated
+			status.OwnershipExpired = now.Sub(updated) > p.partitionExpiration
+		}
+
+		// The last processed event, the checkpoint when this instance did not process any
+		processed := int64(-1)
+		known := partition.IsEmpty
+		if checkpoint, ok := checkpointByPartition[partitionID]; ok && checkpoint.SequenceNumber != nil {
+			status.CheckpointSequenceNumber = checkpoint.SequenceNumber
+			status.CheckpointOffset = checkpoint.Offset
+			processed, known = *checkpoint.SequenceNumber, true
+		}
+
+		p.statsMu.Lock()
+		stats, ok := p.partitionStats[partitionID]
+		p.statsMu.Unlock()
+		if ok && status.OwnedByThisInstance {
+			status.EventsPerSecond = stats.rate(now)
+			stats.mu.Lock()
+			if !stats.lastEventTime.IsZero() {
+				lastEventTime, lastSequenceNumber := stats.lastEventTime, stats.lastSequenceNumber
+				status.LastEventTime = &lastEventTime
+				status.LastProcessedSequenceNumber = &lastSequenceNumber
+				if !known || lastSequenceNumber > processed {
+					processed, known = lastSequenceNumber, true
+				}
+			}
+			stats.mu.Unlock()
+		}
+
+		if known {
+			lag := partition.LastEnqueuedSequenceNumber - processed
+			if lag < 0 || partition.IsEmpty {
+				lag = 0
+			}
+			status.Lag = &lag
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// TrackPartitionMetrics sends the lag, events per second and time since the last event of the partitions
+// owned by this instance, so each partition is reported once across the instances
+func (p *Processor) TrackPartitionMetrics(ctx context.Context) error {
+	statuses, err := p.Partitions(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, status := range statuses {
+		if !status.OwnedByThisInstance {
+			continue
+		}
+		properties := map[string]string{"PartitionID": status.PartitionID, "ConsumerGroup": p.consumerGroup, "OwnerID": status.OwnerID}
+		if status.Lag != nil {
+			telemetry.TrackMetric("PartitionLag", float64(*status.Lag), properties)
+		}
+		telemetry.TrackMetric("PartitionEventsPerSecond", status.EventsPerSecond, properties)
+		if status.LastEventTime != nil {
+			telemetry.TrackMetric("PartitionSecondsSinceLastEvent", time.Since(*status.LastEventTime).Seconds(), properties)
+		}
+		logger.Verbose(ctx, "Partition metrics", "PartitionID", status.PartitionID, "Lag", lagValue(status.Lag), "EventsPerSecond", status.EventsPerSecond)
+	}
+	return nil
+}
+
+// Formats the lag for logs, unknown when there is no checkpoint nor processed event
+func lagValue(lag *int64) string {
+	if lag == nil {
+		return "unknown"
+	}
+	return strconv.FormatInt(*lag, 10)
+}
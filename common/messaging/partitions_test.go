@@ -0,0 +1,190 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs"
+)
+
+// Consumer client of an event hub whose partitions have the given properties, it cannot receive events
+type fakeConsumer struct {
+	partitions map[string]azeventhubs.PartitionProperties
+}
+
+func (f *fakeConsumer) InstanceID() string { return "this" }
+
+func (f *fakeConsumer) GetEventHubProperties(ctx context.Context, options *azeventhubs.GetEventHubPropertiesOptions) (azeventhubs.EventHubProperties, error) {
+	properties := azeventhubs.EventHubProperties{Name: testEventHub}
+	for _, partitionID := range []string{"0", "1", "2", "3"} {
+		if _, ok := f.partitions[partitionID]; ok {
+			properties.PartitionIDs = append(properties.PartitionIDs, partitionID)
+		}
+	}
+	return properties, nil
+}
+
+func (f *fakeConsumer) GetPartitionProperties(ctx context.Context, partitionID string, options *azeventhubs.GetPartitionPropertiesOptions) (azeventhubs.PartitionProperties, error) {
+	return f.partitions[partitionID], nil
+}
+
+func (f *fakeConsumer) NewPartitionClient(partitionID string, options *azeventhubs.PartitionClientOptions) (*azeventhubs.PartitionClient, error) {
+	return nil, errors.New("receiving is not supported")
+}
+
+func (f *fakeConsumer) Close(ctx context.Context) error { return nil }
+
+// Creates a processor over the partitions, with a memory checkpoint store
+func newTestProcessor(partitions map[string]azeventhubs.PartitionProperties) *Processor {
+	return &Processor{
+		consumerClient:      &fakeConsumer{partitions: partitions},
+		checkpointStore:     NewMemoryCheckpointStore(),
+		namespace:           testNamespace,
+		consumerGroup:       testConsumerGroup,
+		partitionExpiration: defaultPartitionExpiration,
+		partitionStats:      map[string]*processingStats{},
+	}
+}
+
+func TestProcessingStatsRate(t *testing.T) {
+	started := time.Unix(1000, 0)
+	stats := &processingStats{started: started}
+	for i := 0; i < 30; i++ {
+		stats.record(started, int64(i))
+	}
+
+	// Checked in order, with an event processed first when record is set
+	tests := []struct {
+		name   string
+		at     time.Duration
+		record bool
+		want   float64
+	}{
+		{"first second", 0, false, 30},
+		{"shorter than the window", 10 * time.Second, false, 3},
+		{"full window", 30 * time.Second, true, 31.0 / 30},
+		{"first events out of the window", 70 * time.Second, false, 1.0 / 60},
+		{"every event out of the window", 2 * time.Minute, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.record {
+				stats.record(started.Add(tt.at), 30)
+			}
+			if got := stats.rate(started.Add(tt.at)); got != tt.want {
+				t.Errorf("rate = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if stats.lastSequenceNumber != 30 {
+		t.Errorf("last sequence number = %d, want 30", stats.lastSequenceNumber)
+	}
+}
+
+func TestProcessorPartitionStats(t *testing.T) {
+	p := newTestProcessor(nil)
+	event := &azeventhubs.ReceivedEventData{SequenceNumber: 5}
+
+	// Events of a partition that is not processed are not counted
+	p.RecordProcessed("0", event)
+	if len(p.partitionStats) != 0 {
+		t.Fatalf("stats %v created for a partition that is not processed", p.partitionStats)
+	}
+
+	p.PartitionStarted("0")
+	first := p.partitionStats["0"]
+	p.RecordProcessed("0", event)
+	if first.lastSequenceNumber != 5 {
+		t.Errorf("last sequence number = %d, want 5", first.lastSequenceNumber)
+	}
+
+	// The partition moves to another instance, events still being handled are not counted
+	p.PartitionStopped("0")
+	p.RecordProcessed("0", event)
+	if _, ok := p.partitionStats["0"]; ok {
+		t.Fatal("stats kept after the partition stopped")
+	}
+
+	// The partition comes back, the stats start over
+	p.PartitionStarted("0")
+	if again := p.partitionStats["0"]; again == first || !again.lastEventTime.IsZero() || again.started.Before(first.started) {
+		t.Errorf("stats of the partition claimed again = %+v, want new stats", again)
+	}
+}
+
+func TestProcessorPartitions(t *testing.T) {
+	ctx := context.Background()
+	enqueued := time.Now().Add(-time.Minute).UTC()
+	p := newTestProcessor(map[string]azeventhubs.PartitionProperties{
+		"0": {LastEnqueuedSequenceNumber: 100, LastEnqueuedOn: enqueued},
+		"1": {LastEnqueuedSequenceNumber: 50, LastEnqueuedOn: enqueued},
+		"2": {LastEnqueuedSequenceNumber: 10, LastEnqueuedOn: enqueued},
+		"3": {LastEnqueuedSequenceNumber: -1, IsEmpty: true},
+	})
+
+	// Partition 0 is processed here, 1 by another instance, 2 and 3 by none
+	claimed, err := p.checkpointStore.ClaimOwnership(ctx, []azeventhubs.Ownership{testOwnership("0", "this", nil), testOwnership("1", "other", nil)}, nil)
+	if err != nil || len(claimed) != 2 {
+		t.Fatalf("ClaimOwnership = %+v, %v", claimed, err)
+	}
+	for _, checkpoint := range []azeventhubs.Checkpoint{testCheckpoint("0", 80), testCheckpoint("1", 45)} {
+		if err := p.checkpointStore.SetCheckpoint(ctx, checkpoint, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.PartitionStarted("0")
+	p.RecordProcessed("0", &azeventhubs.ReceivedEventData{SequenceNumber: 90})
+	p.RecordProcessed("0", &azeventhubs.ReceivedEventData{SequenceNumber: 91})
+
+	// Stats left by this instance for a partition it no longer owns are ignored
+	p.PartitionStarted("1")
+	p.RecordProcessed("1", &azeventhubs.ReceivedEventData{SequenceNumber: 49})
+
+	statuses, err := p.Partitions(ctx)
+	if err != nil {
+		t.Fatalf("Partitions error = %v", err)
+	}
+	if len(statuses) != 4 {
+		t.Fatalf("got %d statuses, want 4", len(statuses))
+	}
+
+	tests := []struct {
+		name          string
+		status        PartitionStatus
+		wantOwner     string
+		wantOwned     bool
+		wantLag       int64
+		wantLagKnown  bool
+		wantProcessed bool
+	}{
+		{"processed by this instance, lag after the last processed event", statuses[0], "this", true, 9, true, true},
+		{"processed by another instance, lag after the checkpoint", statuses[1], "other", false, 5, true, false},
+		{"never claimed nor checkpointed, lag unknown", statuses[2], "", false, 0, false, false},
+		{"empty partition", statuses[3], "", false, 0, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := tt.status
+			if status.OwnerID != tt.wantOwner || status.OwnedByThisInstance != tt.wantOwned {
+				t.Errorf("owner = %q (this instance %t), want %q (%t)", status.OwnerID, status.OwnedByThisInstance, tt.wantOwner, tt.wantOwned)
+			}
+			if status.OwnerID != "" && (status.OwnershipUpdated == nil || status.OwnershipExpired) {
+				t.Errorf("ownership updated %v, expired %t, want a recent update", status.OwnershipUpdated, status.OwnershipExpired)
+			}
+			if (status.Lag != nil) != tt.wantLagKnown || (status.Lag != nil && *status.Lag != tt.wantLag) {
+				t.Errorf("Lag = %v, want %d (known %t)", lagValue(status.Lag), tt.wantLag, tt.wantLagKnown)
+			}
+			if processed := status.LastProcessedSequenceNumber != nil; processed != tt.wantProcessed {
+				t.Errorf("last processed event known %t, want %t", processed, tt.wantProcessed)
+			}
+			if tt.wantProcessed && (*status.LastProcessedSequenceNumber != 91 || status.EventsPerSecond != 2) {
+				t.Errorf("last processed %d at %v events per second, want 91 at 2", *status.LastProcessedSequenceNumber, status.EventsPerSecond)
+			}
+			if !tt.wantProcessed && status.EventsPerSecond != 0 {
+				t.Errorf("EventsPerSecond = %v, want 0 for a partition this instance does not process", status.EventsPerSecond)
+			}
+		})
+	}
+}
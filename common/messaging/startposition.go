@@ -0,0 +1,173 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs"
+)
+
+// Maximum time to wait for the event at a start position when checkpoints are reset
+const resetReceiveTimeout = 10 * time.Second
+
+// ParseStartPosition reads a start position: earliest, latest, sequence:<number> or time:<RFC 3339 time>.
+// The event at the sequence number or time is included.
+func ParseStartPosition(value string) (azeventhubs.StartPosition, error) {
+	value = strings.TrimSpace(value)
+	kind, argument, _ := strings.Cut(value, ":")
+	switch strings.ToLower(kind) {
+	case "earliest":
+		earliest := true
+		return azeventhubs.StartPosition{Earliest: &earliest}, nil
+	case "", "latest":
+		latest := true
+		return azeventhubs.StartPosition{Latest: &latest}, nil
+	case "sequence":
+		sequenceNumber, err := strconv.ParseInt(argument, 10, 64)
+		if err != nil {
+			return azeventhubs.StartPosition{}, fmt.Errorf("invalid start sequence number %q: %w", argument, err)
+		}
+		return azeventhubs.StartPosition{SequenceNumber: &sequenceNumber, Inclusive: true}, nil
+	case "time":
+		enqueuedTime, err := time.Parse(time.RFC3339, argument)
+		if err != nil {
+			return azeventhubs.StartPosition{}, fmt.Errorf("invalid start time %q: %w", argument, err)
+		}
+		return azeventhubs.StartPosition{EnqueuedTime: &enqueuedTime, Inclusive: true}, nil
+	}
+	return azeventhubs.StartPosition{}, fmt.Errorf("unknown start position %q", value)
+}
+
+// ParseStartPositions reads the default start position and the per partition ones, written as <partition>=<position>,...
+// e.g. "0=earliest,1=sequence:1200"
+func ParseStartPositions(defaultPosition, perPartition string) (azeventhubs.StartPositions, error) {
+	var positions azeventhubs.StartPositions
+	var err error
+	if positions.Default, err = ParseStartPosition(defaultPosition); err != nil {
+		return positions, err
+	}
+
+	for _, item := range strings.Split(perPartition, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		partitionID, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return positions, fmt.Errorf("invalid partition start position %q, expected <partition>=<position>", item)
+		}
+		position, err := ParseStartPosition(value)
+		if err != nil {
+			return positions, fmt.Errorf("partition %s: %w", partitionID, err)
+		}
+		if positions.PerPartition == nil {
+			positions.PerPartition = map[string]azeventhubs.StartPosition{}
+		}
+		positions.PerPartition[strings.TrimSpace(partitionID)] = position
+	}
+	return positions, nil
+}
+
+// ResetCheckpoints moves the checkpoints of every partition of the consumer group to the start positions, to replay events.
+// A checkpoint marks the last processed event, so it is set to the event just before the position.
+// Consumers of the consumer group must be stopped, otherwise they overwrite the checkpoints with their own position.
+func (p *Processor) ResetCheckpoints(ctx context.Context, positions azeventhubs.StartPositions) ([]azeventhubs.Checkpoint, error) {
+	properties, err := p.consumerClient.GetEventHubProperties(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var reset []azeventhubs.Checkpoint
+	for _, partitionID := range properties.PartitionIDs {
+		position := positions.Default
+		if perPartition, ok := positions.PerPartition[partitionID]; ok {
+			position = perPartition
+		}
+
+		checkpoint, err := p.checkpointAt(ctx, partitionID, position)
+		if err != nil {
+			return reset, fmt.Errorf("partition %s: %w", partitionID, err)
+		}
+		checkpoint.FullyQualifiedNamespace = p.namespace
+		checkpoint.EventHubName = properties.Name
+		checkpoint.ConsumerGroup = p.consumerGroup
+		checkpoint.PartitionID = partitionID
+
+		if err := p.checkpointStore.SetCheckpoint(ctx, checkpoint, nil); err != nil {
+			return reset, fmt.Errorf("partition %s: %w", partitionID, err)
+		}
+		logger.Info(ctx, "Checkpoint reset", "PartitionID", partitionID, "Offset", *checkpoint.Offset, "SequenceNumber", *checkpoint.SequenceNumber)
+		reset = append(reset, checkpoint)
+	}
+	return reset, nil
+}
+
+// Returns the checkpoint from which a consumer starts at the position
+func (p *Processor) checkpointAt(ctx context.Context, partitionID string, position azeventhubs.StartPosition) (azeventhubs.Checkpoint, error) {
+	properties, err := p.consumerClient.GetPartitionProperties(ctx, partitionID, nil)
+	if err != nil {
+		return azeventhubs.Checkpoint{}, err
+	}
+
+	// Offset -1 is before the first event of the partition
+	earliest := checkpointOf(-1, -1)
+	latest := checkpointOf(properties.LastEnqueuedOffset, properties.LastEnqueuedSequenceNumber)
+	switch {
+	case position.Earliest != nil && *position.Earliest:
+		return earliest, nil
+	case position.Latest != nil && *position.Latest, properties.IsEmpty:
+		return latest, nil
+	case position.SequenceNumber != nil && *position.SequenceNumber > properties.LastEnqueuedSequenceNumber:
+		return latest, nil
+	case position.EnqueuedTime != nil && position.EnqueuedTime.After(properties.LastEnqueuedOn):
+		return latest, nil
+	}
+
+	// Find the first event at the position, without one the position is after the last event
+	first, err := p.receiveFirst(ctx, partitionID, position)
+	if err != nil || first == nil {
+		return latest, err
+	}
+	if first.SequenceNumber <= properties.BeginningSequenceNumber {
+		return earliest, nil
+	}
+
+	// The checkpoint is the event just before
+	previousSequenceNumber := first.SequenceNumber - 1
+	previous, err := p.receiveFirst(ctx, partitionID, azeventhubs.StartPosition{SequenceNumber: &previousSequenceNumber, Inclusive: true})
+	if err != nil {
+		return azeventhubs.Checkpoint{}, err
+	}
+	if previous == nil {
+		return azeventhubs.Checkpoint{}, errors.New("event before the start position not found")
+	}
+	return checkpointOf(previous.Offset, previous.SequenceNumber), nil
+}
+
+// Receives the first event at the position, nil if there is none
+func (p *Processor) receiveFirst(ctx context.Context, partitionID string, position azeventhubs.StartPosition) (*azeventhubs.ReceivedEventData, error) {
+	partitionClient, err := p.consumerClient.NewPartitionClient(partitionID, &azeventhubs.PartitionClientOptions{StartPosition: position, Prefetch: -1})
+	if err != nil {
+		return nil, err
+	}
+	defer partitionClient.Close(context.Background())
+
+	receiveCtx, cancel := context.WithTimeout(ctx, resetReceiveTimeout)
+	defer cancel()
+	events, err := partitionClient.ReceiveEvents(receiveCtx, 1, nil)
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return nil, nil
+	}
+	return events[0], nil
+}
+
+// Creates a checkpoint with an offset and a sequence number, both are required by the blob store
+func checkpointOf(offset, sequenceNumber int64) azeventhubs.Checkpoint {
+	return azeventhubs.Checkpoint{Offset: &offset, SequenceNumber: &sequenceNumber}
+}
@@ -0,0 +1,128 @@
+package messaging
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs"
+)
+
+func TestParseStartPosition(t *testing.T) {
+	yes := true
+	sequenceNumber := int64(1200)
+	enqueuedTime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value   string
+		want    azeventhubs.StartPosition
+		wantErr bool
+	}{
+		{"earliest", azeventhubs.StartPosition{Earliest: &yes}, false},
+		{" Earliest ", azeventhubs.StartPosition{Earliest: &yes}, false},
+		{"latest", azeventhubs.StartPosition{Latest: &yes}, false},
+		{"", azeventhubs.StartPosition{Latest: &yes}, false},
+		{"sequence:1200", azeventhubs.StartPosition{SequenceNumber: &sequenceNumber, Inclusive: true}, false},
+		{"time:2024-03-01T12:00:00Z", azeventhubs.StartPosition{EnqueuedTime: &enqueuedTime, Inclusive: true}, false},
+		{"sequence:", azeventhubs.StartPosition{}, true},
+		{"sequence:first", azeventhubs.StartPosition{}, true},
+		{"time:yesterday", azeventhubs.StartPosition{}, true},
+		{"offset:10", azeventhubs.StartPosition{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseStartPosition(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseStartPosition error = %v, want error %t", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseStartPosition = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseStartPositions(t *testing.T) {
+	positions, err := ParseStartPositions("latest", "0=earliest, 2=sequence:5,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if positions.Default.Latest == nil || len(positions.PerPartition) != 2 {
+		t.Fatalf("ParseStartPositions = %+v, want latest by default and 2 partitions", positions)
+	}
+	if position := positions.PerPartition["0"]; position.Earliest == nil {
+		t.Errorf("partition 0 starts at %+v, want earliest", position)
+	}
+	if position := positions.PerPartition["2"]; position.SequenceNumber == nil || *position.SequenceNumber != 5 {
+		t.Errorf("partition 2 starts at %+v, want sequence 5", position)
+	}
+
+	for _, perPartition := range []string{"0", "0=sequence:x"} {
+		if _, err := ParseStartPositions("latest", perPartition); err == nil {
+			t.Errorf("ParseStartPositions(%q) succeeded, want an error", perPartition)
+		}
+	}
+}
+
+func TestResetCheckpoints(t *testing.T) {
+	ctx := context.Background()
+	lastEnqueuedOn := time.Now().Add(-time.Hour)
+	processor := newTestProcessor(map[string]azeventhubs.PartitionProperties{
+		"0": {BeginningSequenceNumber: 10, LastEnqueuedSequenceNumber: 90, LastEnqueuedOffset: 9000, LastEnqueuedOn: lastEnqueuedOn},
+		"1": {BeginningSequenceNumber: 10, LastEnqueuedSequenceNumber: 40, LastEnqueuedOffset: 4000, LastEnqueuedOn: lastEnqueuedOn},
+		"2": {BeginningSequenceNumber: 10, LastEnqueuedSequenceNumber: 50, LastEnqueuedOffset: 5000, LastEnqueuedOn: lastEnqueuedOn},
+		"3": {IsEmpty: true, LastEnqueuedSequenceNumber: -1, LastEnqueuedOffset: -1},
+	})
+	positions, err := ParseStartPositions("earliest", "1=latest,2=sequence:60,3=sequence:5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reset, err := processor.ResetCheckpoints(ctx, positions)
+	if err != nil {
+		t.Fatalf("ResetCheckpoints error = %v", err)
+	}
+	if len(reset) != 4 {
+		t.Fatalf("ResetCheckpoints reset %d partitions, want 4", len(reset))
+	}
+
+	// Earliest is before the first event, a position after the last event or in an empty partition is the last event
+	want := map[string][2]int64{
+		"0": {-1, -1},
+		"1": {4000, 40},
+		"2": {5000, 50},
+		"3": {-1, -1},
+	}
+	checkpoints, err := processor.checkpointStore.ListCheckpoints(ctx, testNamespace, testEventHub, testConsumerGroup, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(checkpoints) != len(want) {
+		t.Fatalf("store has %d checkpoints, want %d", len(checkpoints), len(want))
+	}
+	for _, checkpoint := range checkpoints {
+		got := [2]int64{*checkpoint.Offset, *checkpoint.SequenceNumber}
+		if got != want[checkpoint.PartitionID] {
+			t.Errorf("partition %s checkpoint at offset %d, sequence %d, want %v", checkpoint.PartitionID, got[0], got[1], want[checkpoint.PartitionID])
+		}
+	}
+}
+
+func TestResetCheckpointsReceiveFailure(t *testing.T) {
+	processor := newTestProcessor(map[string]azeventhubs.PartitionProperties{
+		"0": {BeginningSequenceNumber: 10, LastEnqueuedSequenceNumber: 90, LastEnqueuedOffset: 9000},
+	})
+	positions, err := ParseStartPositions("sequence:50", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The event at the position has to be received, a failure leaves the checkpoint untouched
+	if _, err := processor.ResetCheckpoints(context.Background(), positions); err == nil {
+		t.Fatal("ResetCheckpoints succeeded, want the receive error")
+	}
+	checkpoints, _ := processor.checkpointStore.ListCheckpoints(context.Background(), testNamespace, testEventHub, testConsumerGroup, nil)
+	if len(checkpoints) != 0 {
+		t.Errorf("store has checkpoints %v after a failed reset, want none", checkpoints)
+	}
+}
@@ -0,0 +1,110 @@
+package messaging
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs"
+	"github.com/microtest/common/telemetry"
+)
+
+// EventHandler processes an event received from a partition
+type EventHandler func(ctx context.Context, event *azeventhubs.ReceivedEventData)
+
+// Event waiting in a lane
+type laneItem struct {
+	ctx   context.Context
+	event *azeventhubs.ReceivedEventData
+}
+
+// WorkerPool processes the events of a partition concurrently in lanes, one goroutine per lane.
+// Events with the same key always go to the same lane, so they are handled in the order they were received.
+// Use it with a Checkpointer so the checkpoint only covers events that are fully completed.
+// The context passed to Submit only stops accepting events: every queued event is handled when the pool
+// is closed, with the values of that context and the lifetime of the pool.
+type WorkerPool struct {
+	handler   EventHandler
+	lanes     []chan laneItem
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+
+	// Cancelled once the queued events are handled
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Creates a pool with the number of lanes, each one queuing up to queueSize events before Submit blocks
+func NewWorkerPool(lanes, queueSize int, handler EventHandler) *WorkerPool {
+	if lanes < 1 {
+		lanes = 1
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &WorkerPool{handler: handler, lanes: make([]chan laneItem, lanes), ctx: ctx, cancel: cancel}
+	for i := range p.lanes {
+		p.lanes[i] = make(chan laneItem, queueSize)
+		p.wg.Add(1)
+		go p.work(p.lanes[i])
+	}
+	return p
+}
+
+// Submit queues the event in the lane of its key, waiting while the lane is full.
+// It fails once ctx is done, a queued event is handled even if ctx is done meanwhile.
+func (p *WorkerPool) Submit(ctx context.Context, key string, event *azeventhubs.ReceivedEventData) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	lane := p.lanes[laneIndex(key, len(p.lanes))]
+	select {
+	case lane <- laneItem{ctx: poolContext{Context: p.ctx, values: ctx}, event: event}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting events and waits until the queued ones are handled
+func (p *WorkerPool) Close() {
+	p.closeOnce.Do(func() {
+		for _, lane := range p.lanes {
+			close(lane)
+		}
+	})
+	p.wg.Wait()
+	p.cancel()
+}
+
+// Handles the events of a lane one after the other
+func (p *WorkerPool) work(lane chan laneItem) {
+	defer p.wg.Done()
+	defer telemetry.RecoverPanic()
+
+	for item := range lane {
+		p.handler(item.ctx, item.event)
+	}
+}
+
+// Context of a queued event: the values of the context it was submitted with, the cancellation of the pool
+type poolContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c poolContext) Value(key any) any {
+	return c.values.Value(key)
+}
+
+// Maps a key to a lane, an empty key always goes to the first lane
+func laneIndex(key string, lanes int) int {
+	if lanes == 1 || key == "" {
+		return 0
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return int(hash.Sum32() % uint32(lanes))
+}
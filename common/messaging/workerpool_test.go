@@ -0,0 +1,178 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs"
+)
+
+// Context key used to check that handlers get the values of the submit context
+type testContextKey struct{}
+
+func TestLaneIndex(t *testing.T) {
+	tests := []struct {
+		name  string
+		key   string
+		lanes int
+	}{
+		{"single lane", "order-1", 1},
+		{"empty key", "", 8},
+		{"order key", "order-1", 8},
+		{"other order key", "order-2", 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lane := laneIndex(tt.key, tt.lanes)
+			if lane < 0 || lane >= tt.lanes {
+				t.Fatalf("laneIndex = %d, want a lane below %d", lane, tt.lanes)
+			}
+			if (tt.lanes == 1 || tt.key == "") && lane != 0 {
+				t.Errorf("laneIndex = %d, want the first lane", lane)
+			}
+			if again := laneIndex(tt.key, tt.lanes); again != lane {
+				t.Errorf("laneIndex changed from %d to %d for the same key", lane, again)
+			}
+		})
+	}
+}
+
+func TestWorkerPoolKeepsOrderPerKey(t *testing.T) {
+	const keys, eventsPerKey = 10, 50
+
+	var mu sync.Mutex
+	handled := map[string][]int64{}
+	pool := NewWorkerPool(4, 5, func(ctx context.Context, event *azeventhubs.ReceivedEventData) {
+		key := ctx.Value(testContextKey{}).(string)
+		mu.Lock()
+		handled[key] = append(handled[key], event.SequenceNumber)
+		mu.Unlock()
+	})
+
+	// Events of the keys are interleaved, as in a partition
+	for i := int64(0); i < eventsPerKey; i++ {
+		for k := 0; k < keys; k++ {
+			key := fmt.Sprintf("order-%d", k)
+			ctx := context.WithValue(context.Background(), testContextKey{}, key)
+			if err := pool.Submit(ctx, key, &azeventhubs.ReceivedEventData{SequenceNumber: i}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	pool.Close()
+
+	for k := 0; k < keys; k++ {
+		key := fmt.Sprintf("order-%d", k)
+		events := handled[key]
+		if len(events) != eventsPerKey {
+			t.Fatalf("%s: handled %d events, want %d", key, len(events), eventsPerKey)
+		}
+		for i, sequenceNumber := range events {
+			if sequenceNumber != int64(i) {
+				t.Fatalf("%s: handled %v, want the events in the order they were submitted", key, events)
+			}
+		}
+	}
+}
+
+func TestWorkerPoolHandlesLanesConcurrently(t *testing.T) {
+	// Two keys in different lanes
+	first, second := "order-1", ""
+	for i := 2; second == ""; i++ {
+		if key := fmt.Sprintf("order-%d", i); laneIndex(key, 2) != laneIndex(first, 2) {
+			second = key
+		}
+	}
+
+	// The event of the first key only finishes once the event of the second key was handled
+	secondHandled := make(chan struct{})
+	pool := NewWorkerPool(2, 1, func(ctx context.Context, event *azeventhubs.ReceivedEventData) {
+		if event.SequenceNumber == 1 {
+			select {
+			case <-secondHandled:
+			case <-time.After(5 * time.Second):
+				t.Error("lanes are not handled concurrently")
+			}
+			return
+		}
+		close(secondHandled)
+	})
+	pool.Submit(context.Background(), first, &azeventhubs.ReceivedEventData{SequenceNumber: 1})
+	pool.Submit(context.Background(), second, &azeventhubs.ReceivedEventData{SequenceNumber: 2})
+	pool.Close()
+}
+
+func TestWorkerPoolBoundsQueuedEvents(t *testing.T) {
+	const queueSize = 2
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	pool := NewWorkerPool(1, queueSize, func(ctx context.Context, event *azeventhubs.ReceivedEventData) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+	})
+	defer pool.Close()
+	defer close(release)
+
+	// One event in the handler, then the queue fills up
+	pool.Submit(context.Background(), "order-1", &azeventhubs.ReceivedEventData{SequenceNumber: 0})
+	<-started
+	for i := 1; i <= queueSize; i++ {
+		if err := pool.Submit(context.Background(), "order-1", &azeventhubs.ReceivedEventData{SequenceNumber: int64(i)}); err != nil {
+			t.Fatalf("Submit %d error = %v", i, err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := pool.Submit(ctx, "order-1", &azeventhubs.ReceivedEventData{SequenceNumber: 3}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Submit to a full lane error = %v, want to wait until the context is done", err)
+	}
+}
+
+func TestWorkerPoolDrainsQueuedEventsOnClose(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var handled []int64
+	var handlerCtx context.Context
+	pool := NewWorkerPool(1, 10, func(ctx context.Context, event *azeventhubs.ReceivedEventData) {
+		<-release
+		mu.Lock()
+		defer mu.Unlock()
+		if ctx.Err() != nil {
+			t.Errorf("event %d handled with a cancelled context", event.SequenceNumber)
+		}
+		if ctx.Value(testContextKey{}) != "partition-0" {
+			t.Errorf("event %d handled without the values of the submit context", event.SequenceNumber)
+		}
+		handled = append(handled, event.SequenceNumber)
+		handlerCtx = ctx
+	})
+
+	// The partition stops while events are queued
+	partitionCtx, stopPartition := context.WithCancel(context.WithValue(context.Background(), testContextKey{}, "partition-0"))
+	for i := int64(1); i <= 5; i++ {
+		if err := pool.Submit(partitionCtx, "order-1", &azeventhubs.ReceivedEventData{SequenceNumber: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stopPartition()
+	if err := pool.Submit(partitionCtx, "order-1", &azeventhubs.ReceivedEventData{SequenceNumber: 6}); err == nil {
+		t.Error("Submit succeeded after the partition stopped")
+	}
+
+	close(release)
+	pool.Close()
+	if len(handled) != 5 {
+		t.Fatalf("handled %v, want the 5 queued events", handled)
+	}
+	if handlerCtx.Err() == nil {
+		t.Error("context of the handlers not cancelled once the pool is closed")
+	}
+}
@@ -0,0 +1,88 @@
+package ratelimit
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/microtest/common/telemetry"
+)
+
+// Logger for the ratelimit package
+var logger = telemetry.NewLogger("RateLimit")
+
+// Rule applies a limiter to the requests, each key of the rule gets its own bucket
+type Rule struct {
+	// Name of the rule, in logs
+	Name string
+
+	Limiter *Limiter
+
+	// Returns the key of the request, a request without a key is not limited by the rule
+	Key func(r *http.Request) string
+}
+
+// Middleware rejects the requests that exceed any of the rules with 429 Too Many Requests and a Retry-After header.
+// Rules are checked in order, the tokens taken by the first rules are given back when a later one rejects the request.
+func Middleware(rules ...Rule) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for i, rule := range rules {
+				key := rule.Key(r)
+				if key == "" {
+					continue
+				}
+				allowed, wait := rule.Limiter.Allow(key)
+				if allowed {
+					continue
+				}
+
+				for _, previous := range rules[:i] {
+					if previousKey := previous.Key(r); previousKey != "" {
+						previous.Limiter.Cancel(previousKey)
+					}
+				}
+				logger.Info(r.Context(), "Request rate limited", "Rule", rule.Name, "Path", r.URL.Path, "RetryAfter", wait.String())
+				w.Header().Set("Retry-After", retryAfter(wait))
+				http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// GlobalKey puts every request in the same bucket
+func GlobalKey(r *http.Request) string {
+	return "global"
+}
+
+// ClientIP returns the IP of the client. With trustForwardedFor the first address of X-Forwarded-For is used,
+// only enable it behind a proxy that sets the header.
+func ClientIP(trustForwardedFor bool) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		if trustForwardedFor {
+			if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+				first, _, _ := strings.Cut(forwarded, ",")
+				return strings.TrimSpace(first)
+			}
+		}
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return r.RemoteAddr
+		}
+		return host
+	}
+}
+
+// Formats the wait as a Retry-After value, whole seconds rounded up
+func retryAfter(wait time.Duration) string {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.Itoa(seconds)
+}
@@ -0,0 +1,103 @@
+package ratelimit
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/microtest/common/telemetry"
+)
+
+func TestMiddleware(t *testing.T) {
+	telemetry.SetLogOutput(io.Discard)
+	t.Cleanup(func() { telemetry.SetLogOutput(os.Stdout) })
+
+	client, _ := newTestLimiter(Limit{Rate: 1, Burst: 1})
+	global, _ := newTestLimiter(Limit{Rate: 1, Burst: 2})
+	handler := Middleware(
+		Rule{Name: "client", Limiter: client, Key: func(r *http.Request) string { return r.Header.Get("X-Client") }},
+		Rule{Name: "global", Limiter: global, Key: GlobalKey},
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		name           string
+		client         string
+		wantStatus     int
+		wantRetryAfter string
+	}{
+		{"first request of a", "a", http.StatusNoContent, ""},
+		{"a over its limit", "a", http.StatusTooManyRequests, "1"},
+		{"b within both limits", "b", http.StatusNoContent, ""},
+		{"c over the global limit", "c", http.StatusTooManyRequests, "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/publish", nil)
+			request.Header.Set("X-Client", tt.client)
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+
+			if response.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", response.Code, tt.wantStatus)
+			}
+			if got := response.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.wantRetryAfter)
+			}
+		})
+	}
+
+	// The token taken by the client rule was given back when the global rule rejected c
+	if allowed, _ := client.Allow("c"); !allowed {
+		t.Error("client token not given back after the global rule rejected the request")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name              string
+		remoteAddr        string
+		forwardedFor      string
+		trustForwardedFor bool
+		want              string
+	}{
+		{"remote address", "10.0.0.1:5000", "", false, "10.0.0.1"},
+		{"forwarded header ignored", "10.0.0.1:5000", "203.0.113.7", false, "10.0.0.1"},
+		{"first forwarded address", "10.0.0.1:5000", " 203.0.113.7 , 10.0.0.2", true, "203.0.113.7"},
+		{"no forwarded header", "10.0.0.1:5000", "", true, "10.0.0.1"},
+		{"address without port", "10.0.0.1", "", false, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			request.RemoteAddr = tt.remoteAddr
+			if tt.forwardedFor != "" {
+				request.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			if got := ClientIP(tt.trustForwardedFor)(request); got != tt.want {
+				t.Errorf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		wait time.Duration
+		want string
+	}{
+		{0, "1"},
+		{100 * time.Millisecond, "1"},
+		{time.Second, "1"},
+		{1500 * time.Millisecond, "2"},
+	}
+	for _, tt := range tests {
+		if got := retryAfter(tt.wait); got != tt.want {
+			t.Errorf("retryAfter(%v) = %q, want %q", tt.wait, got, tt.want)
+		}
+	}
+}
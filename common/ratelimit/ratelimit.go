@@ -0,0 +1,126 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Limit of a token bucket
+type Limit struct {
+	// Tokens added per second, requests per second in the long run. 0 or less disables the limit.
+	Rate float64
+
+	// Size of the bucket, requests that can be sent at once. The rate rounded up (at least 1) when 0 or less.
+	Burst int
+}
+
+// Enabled reports whether the limit applies
+func (l Limit) Enabled() bool {
+	return l.Rate > 0
+}
+
+// Returns the size of the bucket
+func (l Limit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Ceil(l.Rate))
+}
+
+// Token bucket of a key
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter keeps a token bucket per key, e.g. per client IP, all sharing the same limit.
+// Use a single key for a global limit. The limit can be changed at any time.
+type Limiter struct {
+	mu        sync.Mutex
+	limit     Limit
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// Creates a limiter with the limit
+func NewLimiter(limit Limit) *Limiter {
+	return &Limiter{limit: limit, buckets: map[string]*bucket{}, lastSweep: time.Now(), now: time.Now}
+}
+
+// SetLimit changes the limit, buckets keep their tokens up to the new burst
+func (l *Limiter) SetLimit(limit Limit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limit = limit
+	for _, b := range l.buckets {
+		b.tokens = math.Min(b.tokens, limit.burst())
+	}
+}
+
+// Limit returns the current limit
+func (l *Limiter) Limit() Limit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// Allow takes a token from the bucket of the key.
+// When the bucket is empty it returns false and how long to wait until a token is available.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.limit.Enabled() {
+		return true, 0
+	}
+
+	now := l.now()
+	l.sweep(now)
+	b := l.refill(key, now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.limit.Rate * float64(time.Second))
+	return false, wait
+}
+
+// Cancel gives back the token taken by Allow, when the request is rejected by another limit
+func (l *Limiter) Cancel(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if b, ok := l.buckets[key]; ok {
+		b.tokens = math.Min(b.tokens+1, l.limit.burst())
+	}
+}
+
+// Returns the bucket of the key with the tokens added since it was last used, a new bucket is full
+func (l *Limiter) refill(key string, now time.Time) *bucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.limit.burst(), last: now}
+		l.buckets[key] = b
+		return b
+	}
+	b.tokens = math.Min(b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate, l.limit.burst())
+	b.last = now
+	return b
+}
+
+// Removes the buckets that are full again once a minute, so keys seen once do not use memory forever.
+// A removed bucket is created full, so nothing changes for the key.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate >= l.limit.burst() {
+			delete(l.buckets, key)
+		}
+	}
+}
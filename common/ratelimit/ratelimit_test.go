@@ -0,0 +1,139 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// Creates a limiter whose clock is moved by the test
+func newTestLimiter(limit Limit) (*Limiter, *time.Time) {
+	now := time.Unix(1000, 0)
+	limiter := NewLimiter(limit)
+	limiter.now = func() time.Time { return now }
+	limiter.lastSweep = now
+	return limiter, &now
+}
+
+func TestLimitBurst(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit Limit
+		want  float64
+	}{
+		{"explicit burst", Limit{Rate: 10, Burst: 3}, 3},
+		{"rate rounded up", Limit{Rate: 2.5}, 3},
+		{"at least one", Limit{Rate: 0.1}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.limit.burst(); got != tt.want {
+				t.Errorf("burst = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimiterAllow(t *testing.T) {
+	type step struct {
+		advance  time.Duration
+		key      string
+		want     bool
+		wantWait time.Duration
+	}
+	tests := []struct {
+		name  string
+		limit Limit
+		steps []step
+	}{
+		{
+			name:  "disabled",
+			limit: Limit{},
+			steps: []step{{0, "a", true, 0}, {0, "a", true, 0}, {0, "a", true, 0}},
+		},
+		{
+			name:  "burst then wait for a token",
+			limit: Limit{Rate: 2, Burst: 2},
+			steps: []step{
+				{0, "a", true, 0},
+				{0, "a", true, 0},
+				{0, "a", false, 500 * time.Millisecond},
+				{250 * time.Millisecond, "a", false, 250 * time.Millisecond},
+				{250 * time.Millisecond, "a", true, 0},
+			},
+		},
+		{
+			name:  "keys have their own bucket",
+			limit: Limit{Rate: 1, Burst: 1},
+			steps: []step{{0, "a", true, 0}, {0, "a", false, time.Second}, {0, "b", true, 0}},
+		},
+		{
+			name:  "tokens never exceed the burst",
+			limit: Limit{Rate: 1, Burst: 1},
+			steps: []step{{0, "a", true, 0}, {time.Hour, "a", true, 0}, {0, "a", false, time.Second}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter, now := newTestLimiter(tt.limit)
+			for i, s := range tt.steps {
+				*now = now.Add(s.advance)
+				allowed, wait := limiter.Allow(s.key)
+				if allowed != s.want || wait != s.wantWait {
+					t.Errorf("step %d: Allow(%q) = %t, %v, want %t, %v", i, s.key, allowed, wait, s.want, s.wantWait)
+				}
+			}
+		})
+	}
+}
+
+func TestLimiterCancelGivesTheTokenBack(t *testing.T) {
+	limiter, _ := newTestLimiter(Limit{Rate: 1, Burst: 1})
+	if allowed, _ := limiter.Allow("a"); !allowed {
+		t.Fatal("first request rejected")
+	}
+	limiter.Cancel("a")
+	if allowed, _ := limiter.Allow("a"); !allowed {
+		t.Error("request rejected after Cancel")
+	}
+
+	// Cancel never fills a bucket above the burst
+	limiter.Cancel("a")
+	limiter.Cancel("a")
+	limiter.Allow("a")
+	if allowed, _ := limiter.Allow("a"); allowed {
+		t.Error("bucket holds more tokens than the burst")
+	}
+}
+
+func TestLimiterSetLimit(t *testing.T) {
+	limiter, _ := newTestLimiter(Limit{Rate: 10, Burst: 10})
+	limiter.Allow("a")
+	limiter.SetLimit(Limit{Rate: 1, Burst: 1})
+
+	if got := limiter.Limit(); got != (Limit{Rate: 1, Burst: 1}) {
+		t.Errorf("Limit = %+v, want the new limit", got)
+	}
+	if allowed, _ := limiter.Allow("a"); !allowed {
+		t.Fatal("request rejected with a token left")
+	}
+	if allowed, _ := limiter.Allow("a"); allowed {
+		t.Error("tokens kept above the new burst")
+	}
+}
+
+func TestLimiterSweepsFullBuckets(t *testing.T) {
+	limiter, now := newTestLimiter(Limit{Rate: 1, Burst: 5})
+	limiter.Allow("idle")
+	limiter.Allow("busy")
+
+	*now = now.Add(time.Minute)
+	for i := 0; i < 5; i++ {
+		limiter.Allow("busy")
+	}
+	if _, ok := limiter.buckets["idle"]; ok {
+		t.Error("full bucket not removed by the sweep")
+	}
+	if _, ok := limiter.buckets["busy"]; !ok {
+		t.Error("bucket in use removed by the sweep")
+	}
+}
@@ -6,4 +6,13 @@ type OperationIDKey string
 const (
 	// OperationIDKeyContextKey is the key used to store the operation ID in context
 	OperationIDKeyContextKey OperationIDKey = "operationID"
+
+	// PartitionIDKeyContextKey is the key used to store the event hub partition ID in context
+	PartitionIDKeyContextKey OperationIDKey = "partitionID"
+
+	// TargetingKeyContextKey is the key used to store the feature flag targeting context (customer and groups) in context
+	TargetingKeyContextKey OperationIDKey = "targeting"
+
+	// ClientIdentityKeyContextKey is the key used to store the authenticated client identity in context
+	ClientIdentityKeyContextKey OperationIDKey = "clientIdentity"
 )
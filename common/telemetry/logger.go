@@ -0,0 +1,205 @@
+package telemetry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/microtest/common/shared"
+
+	"github.com/microsoft/ApplicationInsights-Go/appinsights/contracts"
+)
+
+// Minimum severity written by every logger, stored as an int32 so it can be changed at runtime
+var logLevel atomic.Int32
+
+// Output shared by every logger, guarded so JSON lines are never interleaved
+var (
+	logOutputMu sync.Mutex
+	logOutput   io.Writer = os.Stdout
+)
+
+// Name of the service, added to every log record once telemetry is initialized
+var roleName string
+
+// Read the initial log level from the LOG_LEVEL environment variable
+func init() {
+	SetLogLevel(envLogLevel())
+}
+
+// Returns the level set by LOG_LEVEL, everything is written when it is not set or unknown
+func envLogLevel() contracts.SeverityLevel {
+	level, err := ParseLevel(os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		return Verbose
+	}
+	return level
+}
+
+// Logger writes structured, leveled log records as JSON to stdout and sends the same record to App Insights
+type Logger struct {
+	component string
+	fields    []interface{}
+}
+
+// Creates a new logger for the given component (e.g. the service or package name)
+func NewLogger(component string) *Logger {
+	return &Logger{component: component}
+}
+
+// With returns a logger that adds the given key/value pairs to every record
+func (l *Logger) With(keyValues ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyValues))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyValues...)
+	return &Logger{component: l.component, fields: fields}
+}
+
+// Logs a message with Verbose severity
+func (l *Logger) Verbose(ctx context.Context, message string, keyValues ...interface{}) {
+	l.log(ctx, Verbose, message, keyValues)
+}
+
+// Logs a message with Information severity
+func (l *Logger) Info(ctx context.Context, message string, keyValues ...interface{}) {
+	l.log(ctx, Information, message, keyValues)
+}
+
+// Logs a message with Warning severity
+func (l *Logger) Warning(ctx context.Context, message string, keyValues ...interface{}) {
+	l.log(ctx, Warning, message, keyValues)
+}
+
+// Logs a message with Error severity, an error value in the fields is also sent as an exception
+func (l *Logger) Error(ctx context.Context, message string, keyValues ...interface{}) {
+	l.log(ctx, Error, message, keyValues)
+}
+
+// Logs a message with Critical severity, an error value in the fields is also sent as an exception
+func (l *Logger) Critical(ctx context.Context, message string, keyValues ...interface{}) {
+	l.log(ctx, Critical, message, keyValues)
+}
+
+// SetLogLevel sets the minimum severity that is written by every logger
+func SetLogLevel(level contracts.SeverityLevel) {
+	logLevel.Store(int32(level))
+}
+
+// GetLogLevel returns the minimum severity that is written by every logger
+func GetLogLevel() contracts.SeverityLevel {
+	return contracts.SeverityLevel(logLevel.Load())
+}
+
+// SetLogOutput replaces the writer used by every logger (stdout by default)
+func SetLogOutput(w io.Writer) {
+	logOutputMu.Lock()
+	defer logOutputMu.Unlock()
+	logOutput = w
+}
+
+// ParseLevel converts a level name (verbose, information, warning, error, critical) into a severity level
+func ParseLevel(level string) (contracts.SeverityLevel, error) {
+	switch strings.ToLower(strings.TrimSpace(level)) {
+	case "verbose", "debug":
+		return Verbose, nil
+	case "information", "info":
+		return Information, nil
+	case "warning", "warn":
+		return Warning, nil
+	case "error":
+		return Error, nil
+	case "critical", "fatal":
+		return Critical, nil
+	}
+	return Verbose, fmt.Errorf("unknown log level %q", level)
+}
+
+// Writes the record to stdout and sends it to App Insights
+func (l *Logger) log(ctx context.Context, severity contracts.SeverityLevel, message string, keyValues []interface{}) {
+	if severity < GetLogLevel() {
+		return
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	// Build the record with the fixed fields first
+	record := map[string]interface{}{
+		"time":    time.Now().UTC().Format(time.RFC3339Nano),
+		"level":   strings.ToLower(severity.String()),
+		"message": Redact(message),
+	}
+	if roleName != "" {
+		record["service"] = roleName
+	}
+	if l.component != "" {
+		record["component"] = l.component
+	}
+	properties := map[string]string{}
+	if operationID, ok := ctx.Value(shared.OperationIDKeyContextKey).(string); ok && operationID != "" {
+		record["operationId"] = operationID
+	}
+	if partitionID, ok := ctx.Value(shared.PartitionIDKeyContextKey).(string); ok && partitionID != "" {
+		record["partitionId"] = partitionID
+		properties["PartitionID"] = partitionID
+	}
+
+	// Add the logger fields and then the call fields, the later ones win
+	var recordErr error
+	fields := append(append([]interface{}{}, l.fields...), keyValues...)
+	for i := 0; i < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		var value interface{} = "(MISSING)"
+		if i+1 < len(fields) {
+			value = fields[i+1]
+		}
+		if err, ok := value.(error); ok {
+			recordErr = err
+			value = err.Error()
+		}
+
+		// Mask secrets and personal data before anything is written
+		if IsSensitiveField(key) {
+			value = RedactedMask
+		} else if text, ok := value.(string); ok {
+			value = Redact(text)
+		}
+		record[key] = value
+		properties[key] = fmt.Sprint(value)
+	}
+
+	writeRecord(record)
+
+	// Without App Insights the record above is the only output
+	if currentClient() == nil {
+		return
+	}
+	telemetryMessage := message
+	if l.component != "" {
+		telemetryMessage = l.component + "::" + message
+	}
+	if recordErr != nil && severity >= Error {
+		properties["Message"] = telemetryMessage
+		TrackExceptionCtx(ctx, recordErr, severity, properties)
+		return
+	}
+	TrackTraceCtx(ctx, telemetryMessage, severity, properties)
+}
+
+// Serializes the record as a single JSON line
+func writeRecord(record map[string]interface{}) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		line = []byte(fmt.Sprintf(`{"level":"error","message":"failed to serialize log record: %s"}`, err.Error()))
+	}
+
+	logOutputMu.Lock()
+	defer logOutputMu.Unlock()
+	logOutput.Write(append(line, '\n'))
+}
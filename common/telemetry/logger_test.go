@@ -0,0 +1,181 @@
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/microtest/common/shared"
+
+	"github.com/microsoft/ApplicationInsights-Go/appinsights/contracts"
+)
+
+// Captures the log output and sets the level for the duration of the test
+func captureLogs(t *testing.T, level contracts.SeverityLevel) *bytes.Buffer {
+	t.Helper()
+	var output bytes.Buffer
+	SetLogOutput(&output)
+	previous := GetLogLevel()
+	SetLogLevel(level)
+	t.Cleanup(func() { SetLogLevel(previous) })
+	return &output
+}
+
+// Decodes the JSON lines written by the loggers
+func logRecords(t *testing.T, output *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		level   string
+		want    contracts.SeverityLevel
+		wantErr bool
+	}{
+		{"verbose", Verbose, false},
+		{"debug", Verbose, false},
+		{"Information", Information, false},
+		{"info", Information, false},
+		{" WARNING ", Warning, false},
+		{"warn", Warning, false},
+		{"error", Error, false},
+		{"critical", Critical, false},
+		{"fatal", Critical, false},
+		{"", Verbose, true},
+		{"loud", Verbose, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level, func(t *testing.T) {
+			got, err := ParseLevel(tt.level)
+			if got != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("ParseLevel(%q) = %v, %v, want %v, error %t", tt.level, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEnvLogLevel(t *testing.T) {
+	tests := []struct {
+		value string
+		want  contracts.SeverityLevel
+	}{
+		{"", Verbose},
+		{"warning", Warning},
+		{"ERROR", Error},
+		{"unknown", Verbose},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("LOG_LEVEL", tt.value)
+			if got := envLogLevel(); got != tt.want {
+				t.Errorf("envLogLevel with LOG_LEVEL=%q = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoggerLevels(t *testing.T) {
+	tests := []struct {
+		name       string
+		minLevel   contracts.SeverityLevel
+		wantLevels []string
+	}{
+		{"everything", Verbose, []string{"verbose", "information", "warning", "error", "critical"}},
+		{"warning and above", Warning, []string{"warning", "error", "critical"}},
+		{"critical only", Critical, []string{"critical"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := newTestRecorder(t)
+			output := captureLogs(t, tt.minLevel)
+			logger := NewLogger("Consumer")
+			ctx := context.Background()
+			logger.Verbose(ctx, "message")
+			logger.Info(ctx, "message")
+			logger.Warning(ctx, "message")
+			logger.Error(ctx, "message")
+			logger.Critical(ctx, "message")
+
+			records := logRecords(t, output)
+			if len(records) != len(tt.wantLevels) {
+				t.Fatalf("got %d records, want %d", len(records), len(tt.wantLevels))
+			}
+			for i, level := range tt.wantLevels {
+				if records[i]["level"] != level {
+					t.Errorf("record %d level = %v, want %s", i, records[i]["level"], level)
+				}
+			}
+
+			// The same records are sent as traces with the matching severity
+			traces := recorder.Traces()
+			if len(traces) != len(tt.wantLevels) {
+				t.Fatalf("got %d traces, want %d", len(traces), len(tt.wantLevels))
+			}
+			for i, trace := range traces {
+				if level := strings.ToLower(trace.Severity.String()); level != tt.wantLevels[i] {
+					t.Errorf("trace %d severity = %s, want %s", i, level, tt.wantLevels[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLoggerRecord(t *testing.T) {
+	recorder := newTestRecorder(t)
+	output := captureLogs(t, Verbose)
+	ctx := context.WithValue(context.Background(), shared.OperationIDKeyContextKey, "op-1")
+	ctx = context.WithValue(ctx, shared.PartitionIDKeyContextKey, "3")
+
+	logger := NewLogger("Consumer").With("EventHub", "orders", "Attempt", 1)
+	logger.Info(ctx, "Event received", "Attempt", 2, "OrderID", "42", "Dangling")
+	logger.Error(ctx, "Event failed", "Error", errors.New("handler timed out"))
+
+	records := logRecords(t, output)
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2", len(records))
+	}
+	want := map[string]interface{}{
+		"level":       "information",
+		"message":     "Event received",
+		"component":   "Consumer",
+		"operationId": "op-1",
+		"partitionId": "3",
+		"EventHub":    "orders",
+		"Attempt":     float64(2),
+		"OrderID":     "42",
+		"Dangling":    "(MISSING)",
+	}
+	for key, value := range want {
+		if records[0][key] != value {
+			t.Errorf("%s = %v, want %v", key, records[0][key], value)
+		}
+	}
+	if records[1]["Error"] != "handler timed out" {
+		t.Errorf("Error = %v, want the error message", records[1]["Error"])
+	}
+
+	// The info record is a trace of the operation, the error record an exception
+	traces := recorder.TracesForOperation("op-1")
+	if len(traces) != 1 || traces[0].Message != "Consumer::Event received" || traces[0].Properties["PartitionID"] != "3" {
+		t.Errorf("traces = %+v, want the info record with its partition", traces)
+	}
+	exceptions := recorder.Exceptions()
+	if len(exceptions) != 1 || exceptions[0].Properties["Message"] != "Consumer::Event failed" {
+		t.Errorf("exceptions = %+v, want the error record", exceptions)
+	}
+}
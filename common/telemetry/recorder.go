@@ -0,0 +1,322 @@
+package telemetry
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	appinsights "github.com/microsoft/ApplicationInsights-Go/appinsights"
+	"github.com/microsoft/ApplicationInsights-Go/appinsights/contracts"
+)
+
+// Kinds of telemetry items captured by the Recorder
+const (
+	KindTrace      = "Trace"
+	KindException  = "Exception"
+	KindRequest    = "Request"
+	KindDependency = "Dependency"
+	KindMetric     = "Metric"
+	KindEvent      = "Event"
+	KindOther      = "Other"
+)
+
+// Record is a telemetry item captured by the Recorder
+type Record struct {
+	Kind         string
+	Name         string
+	Message      string
+	Severity     contracts.SeverityLevel
+	Type         string
+	Target       string
+	Data         string
+	ResponseCode string
+	Success      bool
+	Value        float64
+	Duration     time.Duration
+	Properties   map[string]string
+	OperationID  string
+	ParentID     string
+	Timestamp    time.Time
+	Item         appinsights.Telemetry
+}
+
+// Recorder is an in-memory telemetry backend that keeps every tracked item, used to assert on telemetry in tests
+type Recorder struct {
+	mu        sync.Mutex
+	records   []Record
+	context   *appinsights.TelemetryContext
+	isEnabled bool
+}
+
+// Creates a new empty recorder
+func NewRecorder() *Recorder {
+	return &Recorder{
+		context:   appinsights.NewTelemetryContext(""),
+		isEnabled: true,
+	}
+}
+
+// InitTelemetryRecorder replaces the App Insights client with a new recorder and returns it
+func InitTelemetryRecorder(serviceName string) *Recorder {
+	recorder := NewRecorder()
+	recorder.Context().Tags.Cloud().SetRole(serviceName)
+	roleName = serviceName
+	setClient(recorder)
+	return recorder
+}
+
+// Gets the telemetry context for this recorder
+func (r *Recorder) Context() *appinsights.TelemetryContext {
+	return r.context
+}
+
+// Gets the instrumentation key, always empty for a recorder
+func (r *Recorder) InstrumentationKey() string {
+	return r.context.InstrumentationKey()
+}
+
+// Gets a channel that discards everything, the recorder never transmits
+func (r *Recorder) Channel() appinsights.TelemetryChannel {
+	return recorderChannel{}
+}
+
+// Gets whether this recorder is enabled and will accept telemetry
+func (r *Recorder) IsEnabled() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.isEnabled
+}
+
+// Enables or disables the recorder
+func (r *Recorder) SetIsEnabled(enabled bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.isEnabled = enabled
+}
+
+// Captures the specified telemetry item
+func (r *Recorder) Track(item appinsights.Telemetry) {
+	if item == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.isEnabled {
+		return
+	}
+
+	// Create operation ID if it does not exist, as the App Insights client does when sending
+	tags := item.ContextTags()
+	if tags != nil {
+		if _, ok := tags[contracts.OperationId]; !ok {
+			tags[contracts.OperationId] = uuid.New().String()
+		}
+	}
+
+	r.records = append(r.records, newRecord(item))
+}
+
+// Log a user action with the specified name
+func (r *Recorder) TrackEvent(name string) {
+	r.Track(appinsights.NewEventTelemetry(name))
+}
+
+// Log a numeric value that is not specified with a specific event
+func (r *Recorder) TrackMetric(name string, value float64) {
+	r.Track(appinsights.NewMetricTelemetry(name, value))
+}
+
+// Log a trace message with the specified severity level
+func (r *Recorder) TrackTrace(message string, severity contracts.SeverityLevel) {
+	r.Track(appinsights.NewTraceTelemetry(message, severity))
+}
+
+// Log an HTTP request with the specified method, URL, duration and response code
+func (r *Recorder) TrackRequest(method, url string, duration time.Duration, responseCode string) {
+	r.Track(appinsights.NewRequestTelemetry(method, url, duration, responseCode))
+}
+
+// Log a dependency with the specified name, type, target, and success status
+func (r *Recorder) TrackRemoteDependency(name, dependencyType, target string, success bool) {
+	r.Track(appinsights.NewRemoteDependencyTelemetry(name, dependencyType, target, success))
+}
+
+// Log an availability test result with the specified test name, duration, and success status
+func (r *Recorder) TrackAvailability(name string, duration time.Duration, success bool) {
+	r.Track(appinsights.NewAvailabilityTelemetry(name, duration, success))
+}
+
+// Log an exception with the specified error, which may be a string, error or Stringer
+func (r *Recorder) TrackException(err interface{}) {
+	r.Track(appinsights.NewExceptionTelemetry(err))
+}
+
+// Records returns a copy of every captured item, in the order they were tracked
+func (r *Recorder) Records() []Record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	records := make([]Record, len(r.records))
+	copy(records, r.records)
+	return records
+}
+
+// Reset discards every captured item
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records = nil
+}
+
+// Filter returns the captured items that match the predicate
+func (r *Recorder) Filter(match func(Record) bool) []Record {
+	var result []Record
+	for _, record := range r.Records() {
+		if match(record) {
+			result = append(result, record)
+		}
+	}
+	return result
+}
+
+// Returns all captured items of the given kind
+func (r *Recorder) Kind(kind string) []Record {
+	return r.Filter(func(record Record) bool { return record.Kind == kind })
+}
+
+// Returns all captured traces
+func (r *Recorder) Traces() []Record {
+	return r.Kind(KindTrace)
+}
+
+// Returns all captured exceptions
+func (r *Recorder) Exceptions() []Record {
+	return r.Kind(KindException)
+}
+
+// Returns all captured requests
+func (r *Recorder) Requests() []Record {
+	return r.Kind(KindRequest)
+}
+
+// Returns all captured dependencies
+func (r *Recorder) Dependencies() []Record {
+	return r.Kind(KindDependency)
+}
+
+// Returns all captured metrics
+func (r *Recorder) Metrics() []Record {
+	return r.Kind(KindMetric)
+}
+
+// Returns the dependencies tracked against target with the given success flag
+func (r *Recorder) DependenciesFor(target string, success bool) []Record {
+	return r.Filter(func(record Record) bool {
+		return record.Kind == KindDependency && record.Target == target && record.Success == success
+	})
+}
+
+// Returns the dependencies with Success=false tracked against target
+func (r *Recorder) FailedDependencies(target string) []Record {
+	return r.DependenciesFor(target, false)
+}
+
+// Returns all items that belong to the operation, either as the operation itself or as a child of it
+func (r *Recorder) ForOperation(operationID string) []Record {
+	return r.Filter(func(record Record) bool {
+		return operationID != "" && (record.OperationID == operationID || record.ParentID == operationID)
+	})
+}
+
+// Returns the traces tracked under the operation
+func (r *Recorder) TracesForOperation(operationID string) []Record {
+	var result []Record
+	for _, record := range r.ForOperation(operationID) {
+		if record.Kind == KindTrace {
+			result = append(result, record)
+		}
+	}
+	return result
+}
+
+// Returns the items that carry the property with the given value
+func (r *Recorder) WithProperty(key, value string) []Record {
+	return r.Filter(func(record Record) bool {
+		v, ok := record.Properties[key]
+		return ok && v == value
+	})
+}
+
+// Converts a telemetry item into a record, copying the properties so later changes are not seen
+func newRecord(item appinsights.Telemetry) Record {
+	record := Record{
+		Kind:       KindOther,
+		Timestamp:  item.Time(),
+		Properties: make(map[string]string),
+		Item:       item,
+	}
+	for k, v := range item.GetProperties() {
+		record.Properties[k] = v
+	}
+	if tags := item.ContextTags(); tags != nil {
+		record.OperationID = tags[contracts.OperationId]
+		record.ParentID = tags[contracts.OperationParentId]
+	}
+
+	switch t := item.(type) {
+	case *appinsights.TraceTelemetry:
+		record.Kind = KindTrace
+		record.Name = t.Message
+		record.Message = t.Message
+		record.Severity = t.SeverityLevel
+		record.Success = true
+	case *appinsights.ExceptionTelemetry:
+		record.Kind = KindException
+		record.Message = fmt.Sprint(t.Error)
+		record.Severity = t.SeverityLevel
+	case *appinsights.RequestTelemetry:
+		record.Kind = KindRequest
+		record.Name = t.Name
+		record.Data = t.Url
+		record.ResponseCode = t.ResponseCode
+		record.Success = t.Success
+		record.Duration = t.Duration
+		record.Target = t.Source
+	case *appinsights.RemoteDependencyTelemetry:
+		record.Kind = KindDependency
+		record.Name = t.Name
+		record.Type = t.Type
+		record.Target = t.Target
+		record.Data = t.Data
+		record.ResponseCode = t.ResultCode
+		record.Success = t.Success
+		record.Duration = t.Duration
+	case *appinsights.MetricTelemetry:
+		record.Kind = KindMetric
+		record.Name = t.Name
+		record.Value = t.Value
+	case *appinsights.EventTelemetry:
+		record.Kind = KindEvent
+		record.Name = t.Name
+	}
+
+	return record
+}
+
+// Telemetry channel used by the recorder, it has nothing to send
+type recorderChannel struct{}
+
+func (recorderChannel) EndpointAddress() string  { return "" }
+func (recorderChannel) Send(*contracts.Envelope) {}
+func (recorderChannel) Flush()                   {}
+func (recorderChannel) Stop()                    {}
+func (recorderChannel) IsThrottled() bool        { return false }
+
+func (recorderChannel) Close(retryTimeout ...time.Duration) <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
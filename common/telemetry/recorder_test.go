@@ -0,0 +1,135 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/microtest/common/shared"
+)
+
+// Sends telemetry to a new recorder for the duration of the test
+func newTestRecorder(t *testing.T) *Recorder {
+	t.Helper()
+	SetLogOutput(io.Discard)
+	recorder := InitTelemetryRecorder("test")
+	t.Cleanup(func() {
+		Shutdown(context.Background())
+		SetLogOutput(os.Stdout)
+	})
+	return recorder
+}
+
+func TestRecorderCorrelatesPublishTelemetry(t *testing.T) {
+	recorder := newTestRecorder(t)
+	logger := NewLogger("Publisher")
+
+	// Same sequence as a publish request: the request gives the operation ID, the rest is tracked under it
+	operationID := TrackRequest("/publish", "/publish", time.Millisecond, "200", true, "127.0.0.1", nil)
+	if operationID == "" {
+		t.Fatal("TrackRequest returned no operation ID")
+	}
+	ctx := context.WithValue(context.Background(), shared.OperationIDKeyContextKey, operationID)
+	logger.Info(ctx, "Publishing message", "OrderID", "42")
+	TrackDependencyCtx(ctx, "PublishBatch::Successfully sent batch", "publisher", "EventHub", "orders", true, time.Now(), time.Now(), nil)
+
+	// Telemetry of another operation is not correlated
+	TrackDependency("Publish::Failed to send message", "publisher", "EventHub", "orders", false, time.Now(), time.Now(), nil, "other")
+
+	correlated := recorder.ForOperation(operationID)
+	if len(correlated) != 3 {
+		t.Fatalf("got %d correlated items, want 3: %+v", len(correlated), correlated)
+	}
+
+	tests := []struct {
+		name string
+		kind string
+	}{
+		{"request", KindRequest},
+		{"log trace", KindTrace},
+		{"event hub dependency", KindDependency},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var found []Record
+			for _, record := range correlated {
+				if record.Kind == tt.kind {
+					found = append(found, record)
+				}
+			}
+			if len(found) != 1 {
+				t.Fatalf("got %d %s items in the operation, want 1", len(found), tt.kind)
+			}
+			if tt.kind != KindRequest && found[0].ParentID != operationID {
+				t.Errorf("ParentID = %q, want %q", found[0].ParentID, operationID)
+			}
+		})
+	}
+
+	if traces := recorder.TracesForOperation(operationID); len(traces) != 1 || traces[0].Properties["OrderID"] != "42" {
+		t.Errorf("TracesForOperation = %+v, want the publish log with OrderID 42", traces)
+	}
+	if dependencies := recorder.DependenciesFor("orders", true); len(dependencies) != 1 || dependencies[0].ParentID != operationID {
+		t.Errorf("DependenciesFor = %+v, want the sent batch of the operation", dependencies)
+	}
+}
+
+func TestRecorderQueries(t *testing.T) {
+	recorder := newTestRecorder(t)
+	TrackRequest("GET", "/health", time.Millisecond, "200", true, "", map[string]string{"Route": "health"})
+	TrackDependency("Send", "publisher", "EventHub", "orders", false, time.Now(), time.Now(), map[string]string{"Route": "publish"}, "")
+	TrackDependency("Send", "publisher", "EventHub", "orders", true, time.Now(), time.Now(), nil, "")
+	TrackDependency("Get", "publisher", "AppConfig", "config", true, time.Now(), time.Now(), nil, "")
+	TrackMetric("EventsFailed", 2, nil)
+	TrackException(errors.New("boom"), Error, nil)
+
+	tests := []struct {
+		name  string
+		query func() []Record
+		want  int
+	}{
+		{"requests", recorder.Requests, 1},
+		{"dependencies", recorder.Dependencies, 3},
+		{"metrics", recorder.Metrics, 1},
+		{"exceptions", recorder.Exceptions, 1},
+		{"traces", recorder.Traces, 0},
+		{"failed dependencies", func() []Record { return recorder.FailedDependencies("orders") }, 1},
+		{"successful dependencies", func() []Record { return recorder.DependenciesFor("orders", true) }, 1},
+		{"with property", func() []Record { return recorder.WithProperty("Route", "publish") }, 1},
+		{"unknown operation", func() []Record { return recorder.ForOperation("unknown") }, 0},
+		{"empty operation", func() []Record { return recorder.ForOperation("") }, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.query(); len(got) != tt.want {
+				t.Errorf("got %d items, want %d: %+v", len(got), tt.want, got)
+			}
+		})
+	}
+
+	if records := recorder.Records(); len(records) != 6 {
+		t.Fatalf("Records returned %d items, want 6", len(records))
+	}
+	recorder.Reset()
+	if records := recorder.Records(); len(records) != 0 {
+		t.Errorf("Records returned %d items after Reset, want 0", len(records))
+	}
+}
+
+func TestRecorderDisabled(t *testing.T) {
+	recorder := newTestRecorder(t)
+	recorder.SetIsEnabled(false)
+	TrackMetric("Ignored", 1, nil)
+	if records := recorder.Records(); len(records) != 0 {
+		t.Errorf("disabled recorder captured %d items", len(records))
+	}
+
+	recorder.SetIsEnabled(true)
+	TrackMetric("Captured", 1, nil)
+	if metrics := recorder.Metrics(); len(metrics) != 1 || metrics[0].Name != "Captured" || metrics[0].Value != 1 {
+		t.Errorf("Metrics = %+v, want the Captured metric", metrics)
+	}
+}
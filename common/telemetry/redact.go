@@ -0,0 +1,166 @@
+package telemetry
+
+import (
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	appinsights "github.com/microsoft/ApplicationInsights-Go/appinsights"
+)
+
+// Mask written in place of redacted values
+const RedactedMask = "*****"
+
+// Secrets embedded in connection strings or query strings, the value up to the next separator is masked
+var secretPattern = regexp.MustCompile(`(?i)\b((?:SharedAccessKey|AccountKey|InstrumentationKey|SharedAccessSignature|AccessKey|Password|Pwd|sig)\s*=\s*)([^;&,"'\s]+)`)
+
+// Field names whose whole value is a secret, matched as a case-insensitive substring
+var secretFieldNames = []string{"connectionstring", "instrumentationkey", "accountkey", "sharedaccesskey", "password", "secret", "apikey", "token"}
+
+var (
+	redactMu sync.RWMutex
+
+	// Literal secret values registered at runtime (e.g. the instrumentation key)
+	secretValues []string
+
+	// Personal data fields, masked as properties and inside JSON payloads
+	piiFields       []string
+	piiFieldPattern *regexp.Regexp
+)
+
+// Personal data fields masked by default, REDACT_FIELDS adds more as a comma separated list
+func init() {
+	SetRedactedFields(defaultRedactedFields()...)
+}
+
+// Returns the personal data fields masked by default and those of REDACT_FIELDS
+func defaultRedactedFields() []string {
+	fields := []string{"CustomerID"}
+	for _, field := range strings.Split(os.Getenv("REDACT_FIELDS"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// SetRedactedFields replaces the personal data fields that are masked in logs and telemetry
+func SetRedactedFields(fields ...string) {
+	redactMu.Lock()
+	defer redactMu.Unlock()
+
+	piiFields = nil
+	quoted := make([]string, 0, len(fields))
+	for _, field := range fields {
+		if field == "" {
+			continue
+		}
+		piiFields = append(piiFields, strings.ToLower(field))
+		quoted = append(quoted, regexp.QuoteMeta(field))
+	}
+
+	piiFieldPattern = nil
+	if len(quoted) > 0 {
+		// Matches "Field": "value" or "Field": value in a JSON document
+		piiFieldPattern = regexp.MustCompile(`(?i)("(?:` + strings.Join(quoted, "|") + `)"\s*:\s*)("(?:[^"\\]|\\.)*"|[^,}\]\s]+)`)
+	}
+}
+
+// RegisterSecret adds literal values that are always masked wherever they appear
+func RegisterSecret(values ...string) {
+	redactMu.Lock()
+	defer redactMu.Unlock()
+
+	for _, value := range values {
+		// Very short values would mask unrelated text
+		if len(value) >= 8 {
+			secretValues = append(secretValues, value)
+		}
+	}
+}
+
+// Redact masks secrets and personal data found in a free text value
+func Redact(value string) string {
+	if value == "" {
+		return value
+	}
+
+	redactMu.RLock()
+	defer redactMu.RUnlock()
+
+	for _, secret := range secretValues {
+		value = strings.ReplaceAll(value, secret, RedactedMask)
+	}
+	value = secretPattern.ReplaceAllString(value, "${1}"+RedactedMask)
+	if piiFieldPattern != nil {
+		value = piiFieldPattern.ReplaceAllString(value, `${1}"`+RedactedMask+`"`)
+	}
+	return value
+}
+
+// IsSensitiveField reports whether every value of the named field must be masked
+func IsSensitiveField(name string) bool {
+	name = strings.ToLower(name)
+	for _, secret := range secretFieldNames {
+		if strings.Contains(name, secret) {
+			return true
+		}
+	}
+
+	redactMu.RLock()
+	defer redactMu.RUnlock()
+	for _, field := range piiFields {
+		if name == field {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactField masks the value of a named field or property
+func RedactField(name, value string) string {
+	if IsSensitiveField(name) {
+		return RedactedMask
+	}
+	return Redact(value)
+}
+
+// RedactProperties masks secrets and personal data in place
+func RedactProperties(properties map[string]string) map[string]string {
+	for k, v := range properties {
+		properties[k] = RedactField(k, v)
+	}
+	return properties
+}
+
+// Error that replaces one whose message contained sensitive data
+type redactedError struct {
+	message string
+	inner   error
+}
+
+func (e *redactedError) Error() string { return e.message }
+func (e *redactedError) Unwrap() error { return e.inner }
+
+// Masks the sensitive data of a telemetry item before it is sent
+func redactItem(item appinsights.Telemetry) {
+	RedactProperties(item.GetProperties())
+
+	switch t := item.(type) {
+	case *appinsights.TraceTelemetry:
+		t.Message = Redact(t.Message)
+	case *appinsights.ExceptionTelemetry:
+		if err, ok := t.Error.(error); ok {
+			if message := Redact(err.Error()); message != err.Error() {
+				t.Error = &redactedError{message: message, inner: err}
+			}
+		}
+	case *appinsights.RequestTelemetry:
+		t.Name = Redact(t.Name)
+		t.Url = Redact(t.Url)
+	case *appinsights.RemoteDependencyTelemetry:
+		t.Name = Redact(t.Name)
+		t.Data = Redact(t.Data)
+	}
+}
@@ -0,0 +1,157 @@
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Secret registered at runtime, like the instrumentation key read by InitTelemetry
+const testSecret = "0f3e2d1c-4b5a-6978-8a9b-0c1d2e3f4a5b"
+
+// Masks the personal data fields of REDACT_FIELDS for the duration of the test
+func useRedactedFields(t *testing.T, fields ...string) {
+	t.Helper()
+	t.Setenv("REDACT_FIELDS", " "+strings.Join(fields, " , ")+", ")
+	SetRedactedFields(defaultRedactedFields()...)
+	t.Cleanup(func() { SetRedactedFields("CustomerID") })
+}
+
+func TestRedact(t *testing.T) {
+	useRedactedFields(t, "Email")
+	RegisterSecret(testSecret, "short")
+
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{
+			"event hub connection string",
+			"Endpoint=sb://test.servicebus.windows.net/;SharedAccessKeyName=send;SharedAccessKey=abc123+/=;EntityPath=orders",
+			"Endpoint=sb://test.servicebus.windows.net/;SharedAccessKeyName=send;SharedAccessKey=*****;EntityPath=orders",
+		},
+		{
+			"storage connection string",
+			"DefaultEndpointsProtocol=https;AccountName=checkpoints;AccountKey=c3RvcmFnZQ==;EndpointSuffix=core.windows.net",
+			"DefaultEndpointsProtocol=https;AccountName=checkpoints;AccountKey=*****;EndpointSuffix=core.windows.net",
+		},
+		{
+			"instrumentation key in a connection string",
+			"InstrumentationKey=00000000-1111-2222-3333-444444444444;IngestionEndpoint=https://westeurope.in.applicationinsights.azure.com/",
+			"InstrumentationKey=*****;IngestionEndpoint=https://westeurope.in.applicationinsights.azure.com/",
+		},
+		{"registered secret", "dial failed for key " + testSecret, "dial failed for key *****"},
+		{"short values are not registered", "short message", "short message"},
+		{"customer in a JSON payload", `{"OrderID":"1","CustomerID":"c-42","Total":10}`, `{"OrderID":"1","CustomerID":"*****","Total":10}`},
+		{"field added by REDACT_FIELDS", `{"email": "jane@example.com"}`, `{"email": "*****"}`},
+		{"nothing to mask", "order 1 published", "order 1 published"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Redact(tt.value); got != tt.want {
+				t.Errorf("Redact = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsSensitiveField(t *testing.T) {
+	useRedactedFields(t, "Email")
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"EventHubConnectionString", true},
+		{"APPINSIGHTS_INSTRUMENTATIONKEY", true},
+		{"HMAC_SECRETS", true},
+		{"ApiKey", true},
+		{"customerid", true},
+		{"Email", true},
+		{"CustomerName", false},
+		{"OrderID", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsSensitiveField(tt.name); got != tt.want {
+				t.Errorf("IsSensitiveField(%q) = %t, want %t", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoggerRedactsOutputAndTelemetry(t *testing.T) {
+	recorder := newTestRecorder(t)
+	useRedactedFields(t, "Email")
+	RegisterSecret(testSecret)
+	var output bytes.Buffer
+	SetLogOutput(&output)
+
+	NewLogger("Publisher").Info(context.Background(), "Connecting with key "+testSecret,
+		"ConnectionString", "Endpoint=sb://test/;SharedAccessKey=abc123",
+		"Storage", "AccountName=checkpoints;AccountKey=c3RvcmFnZQ==",
+		"CustomerID", "c-42",
+		"Email", "jane@example.com",
+		"Payload", `{"CustomerID":"c-43"}`,
+		"OrderID", "1",
+	)
+
+	revealed := []string{testSecret, "abc123", "c3RvcmFnZQ", "c-42", "c-43", "jane@example.com"}
+	for _, secret := range revealed {
+		if strings.Contains(output.String(), secret) {
+			t.Errorf("log output reveals %q: %s", secret, output.String())
+		}
+	}
+	if !strings.Contains(output.String(), `"OrderID":"1"`) {
+		t.Errorf("log output lost the OrderID: %s", output.String())
+	}
+
+	traces := recorder.Traces()
+	if len(traces) != 1 {
+		t.Fatalf("got %d traces, want 1", len(traces))
+	}
+	for _, secret := range revealed {
+		if strings.Contains(traces[0].Message, secret) {
+			t.Errorf("trace message reveals %q: %s", secret, traces[0].Message)
+		}
+		for key, value := range traces[0].Properties {
+			if strings.Contains(value, secret) {
+				t.Errorf("trace property %s reveals %q: %s", key, secret, value)
+			}
+		}
+	}
+	if traces[0].Properties["CustomerID"] != RedactedMask || traces[0].Properties["OrderID"] != "1" {
+		t.Errorf("trace properties = %v, want CustomerID masked and OrderID kept", traces[0].Properties)
+	}
+}
+
+func TestTrackRedactsItems(t *testing.T) {
+	recorder := newTestRecorder(t)
+	RegisterSecret(testSecret)
+
+	TrackTrace("key "+testSecret, Information, map[string]string{"CustomerID": "c-42", "Connection": "AccountKey=c3RvcmFnZQ=="}, "")
+	TrackException(errors.New("dial sb://test/;SharedAccessKey=abc123 failed"), Error, nil)
+	TrackRequest("GET", "/orders?sig=abc123", time.Millisecond, "200", true, "127.0.0.1", nil)
+	TrackDependency("Send", "publisher", "EventHub", "orders", true, time.Now(), time.Now(), map[string]string{"InstrumentationKey": testSecret}, "")
+
+	records := recorder.Records()
+	if len(records) != 4 {
+		t.Fatalf("got %d records, want 4", len(records))
+	}
+	for _, record := range records {
+		fields := []string{record.Name, record.Message, record.Data}
+		for _, value := range record.Properties {
+			fields = append(fields, value)
+		}
+		for _, field := range fields {
+			for _, secret := range []string{testSecret, "c-42", "c3RvcmFnZQ", "abc123"} {
+				if strings.Contains(field, secret) {
+					t.Errorf("%s item reveals %q: %s", record.Kind, secret, field)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package telemetry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	appinsights "github.com/microsoft/ApplicationInsights-Go/appinsights"
+	"github.com/microsoft/ApplicationInsights-Go/appinsights/contracts"
+)
+
+// SamplingRule sets the sampling rate of the telemetry items it matches, the first matching rule wins.
+// Empty fields match everything.
+type SamplingRule struct {
+	Kind            string  `json:"kind,omitempty"`
+	MessageContains string  `json:"messageContains,omitempty"`
+	MinLevel        string  `json:"minLevel,omitempty"`
+	MaxLevel        string  `json:"maxLevel,omitempty"`
+	Success         *bool   `json:"success,omitempty"`
+	Rate            float64 `json:"rate"`
+}
+
+// SamplingOptions configures which telemetry items are sent
+type SamplingOptions struct {
+	// Rate applied to items that no rule matches, between 0 (drop all) and 1 (keep all)
+	Rate float64 `json:"rate"`
+
+	// Maximum number of sampled operations started per second, 0 means no limit. The limit is decided on the first
+	// item of an operation and applies to the whole operation. Items kept by a rule with rate 1 are never limited
+	MaxPerSecond int `json:"maxPerSecond"`
+
+	// Rules evaluated in order before the default rate
+	Rules []SamplingRule `json:"rules"`
+}
+
+// Sampling rule after its levels have been parsed
+type compiledRule struct {
+	SamplingRule
+	minLevel, maxLevel *contracts.SeverityLevel
+}
+
+// How long the rate limit decision of an operation is remembered, items of an operation that lasts longer are decided again
+const samplingDecisionTTL = 30 * time.Second
+
+// Sampler decides whether an item is sent, keyed by operation ID so a sampled trace stays complete
+type sampler struct {
+	mu           sync.Mutex
+	rate         float64
+	maxPerSecond int
+	rules        []compiledRule
+	window       int64
+	windowCount  int
+
+	// Rate limit decisions of the operations, the maps are rotated every samplingDecisionTTL
+	decisions         map[string]bool
+	previousDecisions map[string]bool
+	decisionsSince    time.Time
+}
+
+var samplingState = &sampler{rate: 1}
+
+// Read the initial sampling options from TELEMETRY_SAMPLING_RATE, TELEMETRY_SAMPLING_MAX_PER_SECOND and TELEMETRY_SAMPLING_RULES (JSON),
+// the rules are added after the default ones so errors are always kept
+func init() {
+	ctx := context.Background()
+	options := SamplingOptions{Rate: 1, Rules: DefaultSamplingRules()}
+	if value := os.Getenv("TELEMETRY_SAMPLING_RATE"); value != "" {
+		if rate, err := strconv.ParseFloat(value, 64); err == nil {
+			options.Rate = rate
+		} else {
+			logger.Error(ctx, "Invalid TELEMETRY_SAMPLING_RATE, keeping every item", "Value", value, "Error", err)
+		}
+	}
+	if value := os.Getenv("TELEMETRY_SAMPLING_MAX_PER_SECOND"); value != "" {
+		if maxPerSecond, err := strconv.Atoi(value); err == nil {
+			options.MaxPerSecond = maxPerSecond
+		} else {
+			logger.Error(ctx, "Invalid TELEMETRY_SAMPLING_MAX_PER_SECOND, no limit applied", "Value", value, "Error", err)
+		}
+	}
+	if rules := os.Getenv("TELEMETRY_SAMPLING_RULES"); rules != "" {
+		var parsed []SamplingRule
+		if err := json.Unmarshal([]byte(rules), &parsed); err == nil {
+			options.Rules = append(options.Rules, parsed...)
+		} else {
+			logger.Error(ctx, "Invalid TELEMETRY_SAMPLING_RULES, using the default rules", "Error", err)
+		}
+	}
+	if err := SetSampling(options); err != nil {
+		logger.Error(ctx, "Invalid TELEMETRY_SAMPLING_RULES, using the default rules", "Error", err)
+		options.Rules = DefaultSamplingRules()
+		SetSampling(options)
+	}
+}
+
+// DefaultSamplingRules always keeps metrics, exceptions, errors and failed requests and dependencies.
+// Metrics are not sampled: a dropped value is not extrapolated, it is missing from the charts and alerts.
+func DefaultSamplingRules() []SamplingRule {
+	failed := false
+	return []SamplingRule{
+		{Kind: KindMetric, Rate: 1},
+		{Kind: KindException, Rate: 1},
+		{Kind: KindTrace, MinLevel: "error", Rate: 1},
+		{Kind: KindRequest, Success: &failed, Rate: 1},
+		{Kind: KindDependency, Success: &failed, Rate: 1},
+	}
+}
+
+// SetSampling replaces the sampling options, rules with an unknown level are rejected
+func SetSampling(options SamplingOptions) error {
+	rules := make([]compiledRule, 0, len(options.Rules))
+	for _, rule := range options.Rules {
+		compiled := compiledRule{SamplingRule: rule}
+		if rule.MinLevel != "" {
+			level, err := ParseLevel(rule.MinLevel)
+			if err != nil {
+				return fmt.Errorf("sampling rule: %w", err)
+			}
+			compiled.minLevel = &level
+		}
+		if rule.MaxLevel != "" {
+			level, err := ParseLevel(rule.MaxLevel)
+			if err != nil {
+				return fmt.Errorf("sampling rule: %w", err)
+			}
+			compiled.maxLevel = &level
+		}
+		rules = append(rules, compiled)
+	}
+
+	samplingState.mu.Lock()
+	defer samplingState.mu.Unlock()
+	samplingState.rate = clampRate(options.Rate)
+	samplingState.maxPerSecond = options.MaxPerSecond
+	samplingState.rules = rules
+	return nil
+}
+
+// SetSamplingRate changes only the default rate, keeping the rules and the rate limit
+func SetSamplingRate(rate float64) {
+	samplingState.mu.Lock()
+	defer samplingState.mu.Unlock()
+	samplingState.rate = clampRate(rate)
+}
+
+// SetSamplingMaxPerSecond changes only the rate limit, 0 means no limit
+func SetSamplingMaxPerSecond(maxPerSecond int) {
+	samplingState.mu.Lock()
+	defer samplingState.mu.Unlock()
+	samplingState.maxPerSecond = maxPerSecond
+}
+
+// Decides whether the item is sent
+func (s *sampler) keep(item appinsights.Telemetry) bool {
+	record := newRecord(item)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rate := s.rate
+	for _, rule := range s.rules {
+		if rule.matches(record) {
+			rate = clampRate(rule.Rate)
+
+			// Items that a rule always keeps skip the rate limit
+			if rate >= 1 {
+				return true
+			}
+			break
+		}
+	}
+
+	// The same operation gives the same decision for every item in it
+	key := record.ParentID
+	if key == "" {
+		key = record.OperationID
+	}
+	if samplingScore(key) >= rate {
+		return false
+	}
+
+	if s.maxPerSecond > 0 {
+		return s.withinLimit(key, time.Now())
+	}
+	return true
+}
+
+// Applies the rate limit to the operation. The first item of an operation decides, the decision is
+// remembered so the rest of a kept operation is not dropped once the limit is reached. Called with the lock held.
+func (s *sampler) withinLimit(key string, now time.Time) bool {
+	if now.Sub(s.decisionsSince) >= samplingDecisionTTL || s.decisions == nil {
+		s.previousDecisions = s.decisions
+		s.decisions = map[string]bool{}
+		s.decisionsSince = now
+	}
+	if kept, ok := s.decisions[key]; ok {
+		return kept
+	}
+	if kept, ok := s.previousDecisions[key]; ok {
+		s.decisions[key] = kept
+		return kept
+	}
+
+	window := now.Unix()
+	if window != s.window {
+		s.window = window
+		s.windowCount = 0
+	}
+	kept := s.windowCount < s.maxPerSecond
+	if kept {
+		s.windowCount++
+	}
+	s.decisions[key] = kept
+	return kept
+}
+
+// Checks if the rule applies to the record
+func (rule compiledRule) matches(record Record) bool {
+	if rule.Kind != "" && !strings.EqualFold(rule.Kind, record.Kind) {
+		return false
+	}
+	if rule.MessageContains != "" && !strings.Contains(record.Message+record.Name, rule.MessageContains) {
+		return false
+	}
+	if rule.minLevel != nil || rule.maxLevel != nil {
+		// Levels only apply to traces and exceptions
+		if record.Kind != KindTrace && record.Kind != KindException {
+			return false
+		}
+		if rule.minLevel != nil && record.Severity < *rule.minLevel {
+			return false
+		}
+		if rule.maxLevel != nil && record.Severity > *rule.maxLevel {
+			return false
+		}
+	}
+	if rule.Success != nil && *rule.Success != record.Success {
+		return false
+	}
+	return true
+}
+
+// Maps an operation ID to a stable value in [0, 1)
+func samplingScore(key string) float64 {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return float64(hash.Sum32()%10000) / 10000
+}
+
+// Makes sure the item has an operation ID before sampling, App Insights would assign a new one anyway
+func ensureOperationID(item appinsights.Telemetry) {
+	if tags := item.ContextTags(); tags != nil {
+		if _, ok := tags[contracts.OperationId]; !ok {
+			tags[contracts.OperationId] = uuid.New().String()
+		}
+	}
+}
+
+// Keeps the rate between 0 and 1
+func clampRate(rate float64) float64 {
+	if rate < 0 {
+		return 0
+	}
+	if rate > 1 {
+		return 1
+	}
+	return rate
+}
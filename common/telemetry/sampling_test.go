@@ -0,0 +1,170 @@
+package telemetry
+
+import (
+	"testing"
+	"time"
+
+	appinsights "github.com/microsoft/ApplicationInsights-Go/appinsights"
+	"github.com/microsoft/ApplicationInsights-Go/appinsights/contracts"
+)
+
+// Restores the default sampling options at the end of the test
+func resetSampling(t *testing.T) {
+	t.Cleanup(func() {
+		SetSampling(SamplingOptions{Rate: 1, Rules: DefaultSamplingRules()})
+	})
+}
+
+// Returns an item of the operation, with the operation as parent like the items tracked from a context
+func itemOf(item appinsights.Telemetry, operationID string) appinsights.Telemetry {
+	item.ContextTags()[contracts.OperationParentId] = operationID
+	return item
+}
+
+func TestSetSamplingRejectsUnknownLevels(t *testing.T) {
+	resetSampling(t)
+	tests := []struct {
+		name    string
+		rule    SamplingRule
+		wantErr bool
+	}{
+		{"no level", SamplingRule{Kind: KindTrace, Rate: 0.5}, false},
+		{"known levels", SamplingRule{MinLevel: "warning", MaxLevel: "error", Rate: 0.5}, false},
+		{"unknown min level", SamplingRule{MinLevel: "loud", Rate: 0.5}, true},
+		{"unknown max level", SamplingRule{MaxLevel: "quiet", Rate: 0.5}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := SetSampling(SamplingOptions{Rate: 1, Rules: []SamplingRule{tt.rule}})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("SetSampling error = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSamplingRules(t *testing.T) {
+	resetSampling(t)
+	options := SamplingOptions{
+		Rate: 0,
+		Rules: append(DefaultSamplingRules(),
+			SamplingRule{Kind: KindTrace, MessageContains: "health", Rate: 0},
+			SamplingRule{Kind: KindTrace, Rate: 1},
+		),
+	}
+	if err := SetSampling(options); err != nil {
+		t.Fatal(err)
+	}
+
+	failed := appinsights.NewRemoteDependencyTelemetry("Send", "EventHub", "orders", false)
+	tests := []struct {
+		name string
+		item appinsights.Telemetry
+		want bool
+	}{
+		{"error trace kept by default rule", appinsights.NewTraceTelemetry("health check failed", Error), true},
+		{"health trace dropped by rule", appinsights.NewTraceTelemetry("health check", Information), false},
+		{"other trace kept by rule", appinsights.NewTraceTelemetry("published", Information), true},
+		{"failed dependency kept by default rule", failed, true},
+		{"successful dependency sampled at the default rate", appinsights.NewRemoteDependencyTelemetry("Send", "EventHub", "orders", true), false},
+		{"metric kept by default rule", appinsights.NewMetricTelemetry("EventsFailed", 1), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ensureOperationID(tt.item)
+			if got := samplingState.keep(tt.item); got != tt.want {
+				t.Errorf("keep = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSamplingKeepsMetrics(t *testing.T) {
+	recorder := newTestRecorder(t)
+	resetSampling(t)
+	if err := SetSampling(SamplingOptions{Rate: 0, MaxPerSecond: 1, Rules: DefaultSamplingRules()}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything else is dropped, metrics are neither sampled nor rate limited
+	TrackTrace("published", Information, nil, "")
+	for _, partitionID := range []string{"0", "1", "2"} {
+		TrackMetric("PartitionLag", 10, map[string]string{"PartitionID": partitionID})
+	}
+	TrackMetric("CircuitBreakerTransition", 1, map[string]string{"Name": "eventhub"})
+
+	if traces := recorder.Traces(); len(traces) != 0 {
+		t.Errorf("got %d traces, want them sampled out", len(traces))
+	}
+	if metrics := recorder.Metrics(); len(metrics) != 4 {
+		t.Errorf("got %d metrics, want every metric: %+v", len(metrics), metrics)
+	}
+}
+
+func TestSamplingKeepsOperationsWhole(t *testing.T) {
+	resetSampling(t)
+	if err := SetSampling(SamplingOptions{Rate: 0.5}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every item of an operation gets the decision of the operation
+	for _, operationID := range []string{"a", "b", "c", "d", "e", "f"} {
+		want := samplingScore(operationID) < 0.5
+		items := []appinsights.Telemetry{
+			appinsights.NewTraceTelemetry("published", Information),
+			appinsights.NewRemoteDependencyTelemetry("Send", "EventHub", "orders", true),
+			appinsights.NewMetricTelemetry("Published", 1),
+		}
+		for _, item := range items {
+			if got := samplingState.keep(itemOf(item, operationID)); got != want {
+				t.Errorf("operation %s: keep = %t, want %t", operationID, got, want)
+			}
+		}
+	}
+}
+
+func TestSamplingRateLimitDecidesPerOperation(t *testing.T) {
+	s := &sampler{rate: 1, maxPerSecond: 2}
+	now := time.Unix(1000, 0)
+
+	tests := []struct {
+		name      string
+		operation string
+		at        time.Time
+		want      bool
+	}{
+		{"first operation", "a", now, true},
+		{"second operation", "b", now, true},
+		{"third operation over the limit", "c", now, false},
+		{"item of a kept operation", "a", now, true},
+		{"item of a dropped operation", "c", now, false},
+		{"new second", "d", now.Add(time.Second), true},
+		{"dropped operation stays dropped in a new second", "c", now.Add(time.Second), false},
+		{"decision kept across a rotation", "a", now.Add(samplingDecisionTTL), true},
+		{"decision forgotten after two rotations", "c", now.Add(3 * samplingDecisionTTL), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.withinLimit(tt.operation, tt.at); got != tt.want {
+				t.Errorf("withinLimit(%q) = %t, want %t", tt.operation, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClampRate(t *testing.T) {
+	tests := []struct {
+		rate, want float64
+	}{
+		{-1, 0},
+		{0, 0},
+		{0.25, 0.25},
+		{1, 1},
+		{2, 1},
+	}
+	for _, tt := range tests {
+		if got := clampRate(tt.rate); got != tt.want {
+			t.Errorf("clampRate(%v) = %v, want %v", tt.rate, got, tt.want)
+		}
+	}
+}
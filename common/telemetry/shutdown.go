@@ -0,0 +1,116 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	appinsights "github.com/microsoft/ApplicationInsights-Go/appinsights"
+)
+
+// Time given to flush telemetry when the process is about to exit because of a panic
+const PanicFlushTimeout = 5 * time.Second
+
+// ErrShutdownTimeout is returned by Shutdown when the buffered telemetry was not sent before the deadline
+var ErrShutdownTimeout = errors.New("telemetry shutdown timed out before all items were sent")
+
+// Logger for the telemetry package itself
+var logger = NewLogger("Telemetry")
+
+// Number of items tracked and not yet accepted by App Insights, these are lost if the process exits
+var pending atomic.Int64
+
+var deliveriesOnce sync.Once
+
+// Decrements pending by the items App Insights accepted. The SDK only reports them as a diagnostics message
+// of each transmission, items that are retried are counted once they are accepted.
+func countDeliveries() {
+	deliveriesOnce.Do(func() {
+		appinsights.NewDiagnosticsMessageListener(func(message string) error {
+			var accepted, received int64
+			if _, err := fmt.Sscanf(message, "Items accepted/received: %d/%d", &accepted, &received); err == nil {
+				delivered(accepted)
+			}
+			return nil
+		})
+	})
+}
+
+// Removes delivered items from pending, without going below zero
+func delivered(count int64) {
+	for {
+		current := pending.Load()
+		next := current - count
+		if next < 0 {
+			next = 0
+		}
+		if pending.CompareAndSwap(current, next) {
+			return
+		}
+	}
+}
+
+// Flush asks the channel to send the buffered telemetry now, without waiting for it
+func Flush() {
+	client := currentClient()
+	if client == nil {
+		return
+	}
+	client.Channel().Flush()
+}
+
+// Shutdown flushes the buffered telemetry and closes the channel, waiting until the context is done.
+// It returns the number of items that were dropped because they were not sent in time.
+// After Shutdown, telemetry calls fall back to the standard logger.
+func Shutdown(ctx context.Context) (int64, error) {
+	// Telemetry sent from now on falls back to the standard logger
+	holder := activeClient.Swap(nil)
+	if holder == nil {
+		return 0, nil
+	}
+	channel := holder.Channel()
+
+	// Retry failed submissions until the context deadline, if there is one
+	var done <-chan struct{}
+	if deadline, ok := ctx.Deadline(); ok {
+		done = channel.Close(time.Until(deadline))
+	} else {
+		done = channel.Close()
+	}
+
+	select {
+	case <-done:
+		pending.Store(0)
+		return 0, nil
+	case <-ctx.Done():
+		dropped := pending.Swap(0)
+		return dropped, fmt.Errorf("%w: %d item(s) dropped", ErrShutdownTimeout, dropped)
+	}
+}
+
+// RecoverPanic tracks a panic as a critical exception and flushes telemetry before the panic continues and the process exits.
+// Use it as the first deferred call in main and in every goroutine: defer telemetry.RecoverPanic()
+func RecoverPanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	err, ok := r.(error)
+	if !ok {
+		err = fmt.Errorf("panic: %v", r)
+	}
+	TrackException(err, Critical, map[string]string{"Message": "Unhandled panic", "Error": err.Error(), "Stack": string(debug.Stack())})
+
+	ctx, cancel := context.WithTimeout(context.Background(), PanicFlushTimeout)
+	defer cancel()
+	if dropped, err := Shutdown(ctx); err != nil {
+		logger.Critical(ctx, "Telemetry not flushed before exit", "Dropped", dropped, "Error", err)
+	}
+
+	panic(r)
+}
@@ -0,0 +1,107 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	appinsights "github.com/microsoft/ApplicationInsights-Go/appinsights"
+)
+
+// Channel whose Close completes once sent is closed, like a channel still retrying transmissions
+type slowChannel struct {
+	recorderChannel
+	sent         chan struct{}
+	retryTimeout time.Duration
+}
+
+func (c *slowChannel) Close(retryTimeout ...time.Duration) <-chan struct{} {
+	if len(retryTimeout) > 0 {
+		c.retryTimeout = retryTimeout[0]
+	}
+	return c.sent
+}
+
+// Recorder that transmits through the slow channel
+type slowClient struct {
+	*Recorder
+	channel *slowChannel
+}
+
+func (c *slowClient) Channel() appinsights.TelemetryChannel { return c.channel }
+
+// Sends telemetry to a client whose channel finishes sending when the returned channel is closed
+func useSlowClient(t *testing.T) (*slowChannel, *Recorder) {
+	t.Helper()
+	recorder := newTestRecorder(t)
+	channel := &slowChannel{sent: make(chan struct{})}
+	setClient(&slowClient{Recorder: recorder, channel: channel})
+	pending.Store(0)
+	return channel, recorder
+}
+
+func TestShutdownWithoutTelemetry(t *testing.T) {
+	newTestRecorder(t)
+	Shutdown(context.Background())
+	if dropped, err := Shutdown(context.Background()); dropped != 0 || err != nil {
+		t.Errorf("Shutdown = %d, %v, want nothing to flush", dropped, err)
+	}
+}
+
+func TestShutdownFlushesInTime(t *testing.T) {
+	channel, _ := useSlowClient(t)
+	for i := 0; i < 3; i++ {
+		TrackMetric("EventsProcessed", 1, nil)
+	}
+	if got := pending.Load(); got != 3 {
+		t.Fatalf("pending = %d, want 3", got)
+	}
+	close(channel.sent)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if dropped, err := Shutdown(ctx); dropped != 0 || err != nil {
+		t.Errorf("Shutdown = %d, %v, want every item sent", dropped, err)
+	}
+	if channel.retryTimeout <= 0 || channel.retryTimeout > time.Second {
+		t.Errorf("channel retries for %v, want until the deadline", channel.retryTimeout)
+	}
+	if got := pending.Load(); got != 0 {
+		t.Errorf("pending = %d after Shutdown, want 0", got)
+	}
+}
+
+func TestShutdownReportsDroppedItems(t *testing.T) {
+	_, recorder := useSlowClient(t)
+	for i := 0; i < 5; i++ {
+		TrackMetric("EventsProcessed", 1, nil)
+	}
+
+	// App Insights accepted two of them, the transmission of the rest is still retried
+	delivered(2)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	dropped, err := Shutdown(ctx)
+	if dropped != 3 || !errors.Is(err, ErrShutdownTimeout) {
+		t.Errorf("Shutdown = %d, %v, want 3 items dropped", dropped, err)
+	}
+
+	// Telemetry tracked after Shutdown is not sent
+	if currentClient() != nil {
+		t.Error("client still set after Shutdown")
+	}
+	TrackMetric("AfterShutdown", 1, nil)
+	if metrics := recorder.Metrics(); len(metrics) != 5 {
+		t.Errorf("got %d metrics, want the 5 tracked before Shutdown", len(metrics))
+	}
+}
+
+func TestDeliveredNeverGoesBelowZero(t *testing.T) {
+	pending.Store(2)
+	t.Cleanup(func() { pending.Store(0) })
+	delivered(5)
+	if got := pending.Load(); got != 0 {
+		t.Errorf("pending = %d, want 0", got)
+	}
+}
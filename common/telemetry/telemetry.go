@@ -5,6 +5,7 @@ import (
 	"errors"
 	"log"
 	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/microtest/common/shared"
@@ -13,7 +14,27 @@ import (
 	"github.com/microsoft/ApplicationInsights-Go/appinsights/contracts"
 )
 
-var client appinsights.TelemetryClient
+// App Insights client, or a recorder. It is replaced by the Init functions and cleared by Shutdown
+// while other goroutines send telemetry, so it is only accessed through currentClient and setClient.
+var activeClient atomic.Pointer[clientHolder]
+
+type clientHolder struct {
+	appinsights.TelemetryClient
+}
+
+// Returns the client telemetry is sent to, nil when telemetry is not initialized or was shut down
+func currentClient() appinsights.TelemetryClient {
+	if holder := activeClient.Load(); holder != nil {
+		return holder.TelemetryClient
+	}
+	return nil
+}
+
+// Replaces the client telemetry is sent to
+func setClient(client appinsights.TelemetryClient) {
+	countDeliveries()
+	activeClient.Store(&clientHolder{client})
+}
 
 type RequestTelemetryData = appinsights.RequestTelemetry
 
@@ -36,11 +57,14 @@ func InitTelemetry(serviceName string) error {
 		return err
 	}
 
-	// Create the client
-	client = appinsights.NewTelemetryClient(instrumentationKey)
+	// Create the client, the key itself is never written to logs or telemetry
+	RegisterSecret(instrumentationKey)
+	client := appinsights.NewTelemetryClient(instrumentationKey)
 
 	// Set the role name
 	client.Context().Tags.Cloud().SetRole(serviceName)
+	roleName = serviceName
+	setClient(client)
 
 	// Send a trace message to make sure it's working
 	client.TrackTrace(serviceName+"::Telemetry::App Insights initialized", contracts.Information)
@@ -56,8 +80,9 @@ func InitTelemetryKey(serviceName string, instrumentationKey string) error {
 		return err
 	}
 
-	// Create the client
-	client = appinsights.NewTelemetryClient(instrumentationKey)
+	// Create the client, the key itself is never written to logs or telemetry
+	RegisterSecret(instrumentationKey)
+	client := appinsights.NewTelemetryClient(instrumentationKey)
 	if client == nil {
 		// TO DO: This is not working properly
 		err := errors.New("app insights client not initialized")
@@ -66,6 +91,8 @@ func InitTelemetryKey(serviceName string, instrumentationKey string) error {
 
 	// Set the role name
 	client.Context().Tags.Cloud().SetRole(serviceName)
+	roleName = serviceName
+	setClient(client)
 
 	// Send a trace message to make sure it's working
 	client.TrackTrace(serviceName+"::Telemetry::App Insights initialized", contracts.Information)
@@ -73,10 +100,40 @@ func InitTelemetryKey(serviceName string, instrumentationKey string) error {
 	return nil
 }
 
+// Check reports whether telemetry is initialized and sent to App Insights
+func Check(ctx context.Context) error {
+	client := currentClient()
+	if client == nil {
+		return errors.New("app insights client not initialized")
+	}
+	if !client.IsEnabled() {
+		return errors.New("app insights client disabled")
+	}
+	return nil
+}
+
 // TrackException sends an exception to App Insights
 func TrackException(err error, Severity contracts.SeverityLevel, Properties map[string]string) {
+	client := currentClient()
+	if client == nil {
+		log.Printf("Exception: %s\n", Redact(err.Error()))
+		return
+	}
+
+	exception := appinsights.NewExceptionTelemetry(err)
+	exception.SeverityLevel = Severity
+	for k, v := range Properties {
+		exception.Properties[k] = v
+	}
+
+	track(client, exception)
+}
+
+// TrackExceptionCtx sends an exception to App Insights, correlated with the operation ID in the context
+func TrackExceptionCtx(ctx context.Context, err error, Severity contracts.SeverityLevel, Properties map[string]string) {
+	client := currentClient()
 	if client == nil {
-		log.Printf("Exception: %s\n", err.Error())
+		log.Printf("Exception: %s\n", Redact(err.Error()))
 		return
 	}
 
@@ -86,13 +143,22 @@ func TrackException(err error, Severity contracts.SeverityLevel, Properties map[
 		exception.Properties[k] = v
 	}
 
-	client.Track(exception)
+	// Get the operationID from the context
+	if operationID, ok := ctx.Value(shared.OperationIDKeyContextKey).(string); ok {
+		// Set parent id
+		if operationID != "" {
+			exception.Tags.Operation().SetParentId(operationID)
+		}
+	}
+
+	track(client, exception)
 }
 
 // Sends a trace message to App Insights
 func TrackTrace(Message string, Severity contracts.SeverityLevel, Properties map[string]string, parentID string) string {
+	client := currentClient()
 	if client == nil {
-		log.Printf("Message: %s, Properties: %v, Severity: %v\n", Message, Properties, Severity)
+		log.Printf("Message: %s, Properties: %v, Severity: %v\n", Redact(Message), RedactProperties(copyProperties(Properties)), Severity)
 		return ""
 	}
 
@@ -105,7 +171,7 @@ func TrackTrace(Message string, Severity contracts.SeverityLevel, Properties map
 	if parentID != "" {
 		trace.Tags.Operation().SetParentId(parentID)
 	}
-	client.Track(trace)
+	track(client, trace)
 
 	// Return the operation id
 	return trace.Tags.Operation().GetId()
@@ -113,8 +179,9 @@ func TrackTrace(Message string, Severity contracts.SeverityLevel, Properties map
 
 // Sends a trace message to App Insights
 func TrackTraceCtx(ctx context.Context, Message string, Severity contracts.SeverityLevel, Properties map[string]string) string {
+	client := currentClient()
 	if client == nil {
-		log.Printf("Message: %s, Properties: %v, Severity: %v\n", Message, Properties, Severity)
+		log.Printf("Message: %s, Properties: %v, Severity: %v\n", Redact(Message), RedactProperties(copyProperties(Properties)), Severity)
 		return ""
 	}
 
@@ -133,7 +200,7 @@ func TrackTraceCtx(ctx context.Context, Message string, Severity contracts.Sever
 	}
 
 	// Send the trace to App Insights
-	client.Track(trace)
+	track(client, trace)
 
 	// Return the operation id
 	return trace.Tags.Operation().GetId()
@@ -141,8 +208,9 @@ func TrackTraceCtx(ctx context.Context, Message string, Severity contracts.Sever
 
 // Send a request trace to App Insights
 func TrackRequest(Method, Url string, Duration time.Duration, ResponseCode string, Success bool, Source string, Properties map[string]string) string {
+	client := currentClient()
 	if client == nil {
-		log.Printf("Name: %s, Url: %v, Duration: %s, ResponseCode: %s, Success: %t\n", Method, Url, Duration, ResponseCode, Success)
+		log.Printf("Name: %s, Url: %v, Duration: %s, ResponseCode: %s, Success: %t\n", Method, Redact(Url), Duration, ResponseCode, Success)
 		return ""
 	}
 
@@ -153,7 +221,7 @@ func TrackRequest(Method, Url string, Duration time.Duration, ResponseCode strin
 	}
 
 	// Send the request to App Insights
-	client.Track(request)
+	track(client, request)
 
 	// Return the operation id
 	return request.Tags.Operation().GetId()
@@ -174,8 +242,9 @@ func TrackDependency(
 	// Create more descriptive information to trace, with the caller name and the dependency data
 	dependencyText := dependencyName + "::" + dependencyData
 
+	client := currentClient()
 	if client == nil {
-		log.Printf("Dependency: %s, Name: %s, Type: %s, Target: %s, Success: %t\n", dependencyData, dependencyName, dependencyType, dependencyTarget, dependencySuccess)
+		log.Printf("Dependency: %s, Name: %s, Type: %s, Target: %s, Success: %t\n", Redact(dependencyData), dependencyName, dependencyType, dependencyTarget, dependencySuccess)
 		return ""
 	}
 
@@ -193,7 +262,7 @@ func TrackDependency(
 		dependency.Tags.Operation().SetParentId(parentID)
 	}
 
-	client.Track(dependency)
+	track(client, dependency)
 
 	return dependency.Tags.Operation().GetId()
 }
@@ -213,8 +282,9 @@ func TrackDependencyCtx(
 	// Create more descriptive information to trace, with the caller name and the dependency data
 	dependencyText := dependencyName + "::" + dependencyData
 
+	client := currentClient()
 	if client == nil {
-		log.Printf("Dependency: %s, Name: %s, Type: %s, Target: %s, Success: %t\n", dependencyData, dependencyName, dependencyType, dependencyTarget, dependencySuccess)
+		log.Printf("Dependency: %s, Name: %s, Type: %s, Target: %s, Success: %t\n", Redact(dependencyData), dependencyName, dependencyType, dependencyTarget, dependencySuccess)
 		return ""
 	}
 
@@ -236,7 +306,46 @@ func TrackDependencyCtx(
 	}
 
 	// Send the dependency to App Insights
-	client.Track(dependency)
+	track(client, dependency)
 
 	return dependency.Tags.Operation().GetId()
 }
+
+// Track a metric value to App Insights
+func TrackMetric(name string, value float64, properties map[string]string) {
+	client := currentClient()
+	if client == nil {
+		log.Printf("Metric: %s, Value: %v, Properties: %v\n", name, value, RedactProperties(copyProperties(properties)))
+		return
+	}
+
+	metric := appinsights.NewMetricTelemetry(name, value)
+	for k, v := range properties {
+		metric.Properties[k] = v
+	}
+
+	track(client, metric)
+}
+
+// Submits a telemetry item to the client
+func track(client appinsights.TelemetryClient, item appinsights.Telemetry) {
+	redactItem(item)
+
+	// Drop the item if it is not sampled
+	ensureOperationID(item)
+	if !samplingState.keep(item) {
+		return
+	}
+
+	pending.Add(1)
+	client.Track(item)
+}
+
+// Returns a copy of the properties so the caller's map is not modified
+func copyProperties(properties map[string]string) map[string]string {
+	result := make(map[string]string, len(properties))
+	for k, v := range properties {
+		result[k] = v
+	}
+	return result
+}